@@ -0,0 +1,599 @@
+// Copyright (c) 2012 Alexander Sychev. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package scms
+
+import (
+	"appengine"
+	"appengine/datastore"
+	"bytes"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+// The API under /api is used by scmsctl. Requests are authorized by the token
+// kept in "$Config" named "api", it is sent as "Authorization: Bearer <token>".
+// The API is disabled until a token is generated in the editor.
+//
+//	GET    /api/pages                   names of pages
+//	GET    /api/pages/<name>            a page as JSON
+//	PUT    /api/pages/<name>            a page from JSON
+//	DELETE /api/pages/<name>
+//	GET    /api/files                   names of files
+//	GET    /api/files/<name>            the content of a file
+//	PUT    /api/files/<name>            the content of a file, Content-Type is kept
+//	DELETE /api/files/<name>
+//	GET    /api/groups                  names of groups
+//	GET    /api/groups/<name>           records of a group as in exports
+//	PUT    /api/groups/<name>           a group, optionally {"Slug": ...}
+//	DELETE /api/groups/<name>           a group with all its records and their drafts
+//	GET    /api/records/<group>?key=    a record, key is a key path
+//	PUT    /api/records/<group>?key=    a record from JSON, a new one with ?parent= if key is omitted
+//	DELETE /api/records/<group>?key=
+//	PUT    /api/default                 the name of the default page, it must be published
+//	POST   /api/publish                 publishes drafts
+//	POST   /api/validate                errors of templates of pages
+//	GET    /api/export/all.zip          an archive of the site, also tree.zip
+//	POST   /api/import?section=&mode=&field=&dry=  imports an archive, dry only lists changes
+//
+// Sections of imports are the same as in the editor: all, files, pages,
+// groups, wxr, markdown/<group> and csv/<group>.
+//
+// Pages, files and records are changed in drafts like in the editor, the
+// changes are seen after publishing. Groups, the default page and imports
+// change the site at once like in the editor; an import discards drafts of
+// entities it changes.
+type apiConfig struct {
+	Token string
+}
+
+func apiKey(c appengine.Context) *datastore.Key {
+	return datastore.NewKey(c, "$Config", "api", 0, nil)
+}
+
+// newToken generates and keeps a new token of the API, the previous one stops working.
+func newToken(c appengine.Context) error {
+	b := make([]byte, 20)
+	if _, err := io.ReadFull(rand.Reader, b); err != nil {
+		return err
+	}
+	_, err := datastore.Put(c, apiKey(c), &apiConfig{fmt.Sprintf("%x", b)})
+	return err
+}
+
+func (this *Context) GetToken() (string, error) {
+	if this.ctx == nil {
+		return "", &scmsError{"invalid context"}
+	}
+	var cfg apiConfig
+	if err := datastore.Get(this.ctx, apiKey(this.ctx), &cfg); err != nil && err != datastore.ErrNoSuchEntity {
+		return "", err
+	}
+	return cfg.Token, nil
+}
+
+func (this *Value) GetToken() (string, error) {
+	return this.ctx.GetToken()
+}
+
+// authorized reports whether r has the token of the API.
+func authorized(c appengine.Context, r *http.Request) bool {
+	var cfg apiConfig
+	if err := datastore.Get(c, apiKey(c), &cfg); err != nil {
+		if err != datastore.ErrNoSuchEntity {
+			c.Errorf("can't get the token of API: %v", err)
+		}
+		return false
+	}
+	h := r.Header.Get("Authorization")
+	if len(cfg.Token) == 0 || !strings.HasPrefix(h, "Bearer ") {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(h[len("Bearer "):]), []byte(cfg.Token)) == 1
+}
+
+type apiStatus struct {
+	code int
+	err  string
+}
+
+func (this *apiStatus) Error() string {
+	return this.err
+}
+
+func notFound(what string) error {
+	return &apiStatus{http.StatusNotFound, what + " is not found"}
+}
+
+func badRequest(format string, args ...interface{}) error {
+	return &apiStatus{http.StatusBadRequest, fmt.Sprintf(format, args...)}
+}
+
+func apiError(c appengine.Context, w http.ResponseWriter, err error) {
+	code := http.StatusInternalServerError
+	if s, ok := err.(*apiStatus); ok {
+		code = s.code
+	} else if err == datastore.ErrNoSuchEntity {
+		code = http.StatusNotFound
+	}
+	c.Errorf("api: %v", err)
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(code)
+	j, _ := json.Marshal(map[string]string{"Error": err.Error()})
+	w.Write(j)
+}
+
+func apiJSON(w http.ResponseWriter, v interface{}) error {
+	j, err := json.MarshalIndent(v, "", "\t")
+	if err != nil {
+		return err
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	_, err = w.Write(j)
+	return err
+}
+
+// readBody reads the body of r up to the limit of an entry of imported archives.
+func readBody(c appengine.Context, r *http.Request, limit int64) ([]byte, error) {
+	d, err := ioutil.ReadAll(io.LimitReader(r.Body, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(d)) > limit {
+		return nil, &apiStatus{http.StatusRequestEntityTooLarge, fmt.Sprintf("body exceeds the limit %v", limit)}
+	}
+	return d, nil
+}
+
+func apiHandler(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+	if !authorized(c, r) {
+		apiError(c, w, &apiStatus{http.StatusUnauthorized, "invalid token"})
+		return
+	}
+	p := strings.SplitN(strings.TrimLeft(r.URL.Path[len("/api"):], "/"), "/", 2)
+	name := ""
+	if len(p) == 2 {
+		name = p[1]
+	}
+	c.Infof("api: %v %q %q", r.Method, p[0], name)
+	var err error
+	switch p[0] {
+	case "pages":
+		err = apiPages(c, w, r, name)
+	case "files":
+		err = apiFiles(c, w, r, cleanName(name))
+	case "groups":
+		err = apiGroups(c, w, r, name)
+	case "records":
+		err = apiRecords(c, w, r, name)
+	case "default":
+		err = apiDefault(c, w, r)
+	case "publish":
+		if r.Method != "POST" {
+			err = badRequest("unsupported method %v", r.Method)
+		} else if err = publish(c); err == nil {
+			invalidate(c)
+		}
+	case "validate":
+		err = apiValidate(c, w)
+	case "export":
+		switch name {
+		case "all.zip":
+			serveExport(c, w, "all", exportAll)
+		case "tree.zip":
+			serveExport(c, w, "tree", exportTree)
+		default:
+			err = notFound("export " + name)
+		}
+		return
+	case "import":
+		err = apiImport(c, w, r)
+	default:
+		err = notFound(r.URL.Path)
+	}
+	if err != nil {
+		apiError(c, w, err)
+	}
+}
+
+// names returns names of entities of kind including drafts.
+func names(c appengine.Context, kind string) ([]string, error) {
+	ctx := &Context{ctx: c, draft: true}
+	cur, err := ctx.Get(kind, "Name", "", 0, 0)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]string, 0, len(cur))
+	for _, v := range cur {
+		if n, ok := v.Data["Name"].(string); ok {
+			out = append(out, n)
+		}
+	}
+	return out, nil
+}
+
+func apiPages(c appengine.Context, w http.ResponseWriter, r *http.Request, name string) error {
+	if len(name) == 0 {
+		if r.Method != "GET" {
+			return badRequest("unsupported method %v", r.Method)
+		}
+		n, err := names(c, "$Pages")
+		if err != nil {
+			return err
+		}
+		return apiJSON(w, n)
+	}
+	k := datastore.NewKey(c, "$Pages", name, 0, nil)
+	switch r.Method {
+	case "GET":
+		var p Page
+		if err := getDraft(c, k, &p); err != nil {
+			return err
+		}
+		return apiJSON(w, &p)
+	case "PUT":
+		d, err := readBody(c, r, getLimits(c).Entry)
+		if err != nil {
+			return err
+		}
+		var p Page
+		if err := json.Unmarshal(d, &p); err != nil {
+			return badRequest("invalid page: %v", err)
+		}
+		if name != template.URLQueryEscaper(name) || strings.ToLower(name) != name {
+			return badRequest("invalid name of page %q", name)
+		}
+		p.Name = name
+		if len(p.Base) == 0 || len(p.Template) == 0 {
+			return badRequest("base template and template must not be empty")
+		}
+		return putDraft(c, k, &p)
+	case "DELETE":
+		var p Page
+		if err := getDraft(c, k, &p); err != nil {
+			return err
+		}
+		return deleteDraft(c, k)
+	}
+	return badRequest("unsupported method %v", r.Method)
+}
+
+func apiFiles(c appengine.Context, w http.ResponseWriter, r *http.Request, name string) error {
+	if len(name) == 0 {
+		if r.Method != "GET" {
+			return badRequest("unsupported method %v", r.Method)
+		}
+		n, err := names(c, "$Files")
+		if err != nil {
+			return err
+		}
+		return apiJSON(w, n)
+	}
+	k := datastore.NewKey(c, "$Files", name, 0, nil)
+	switch r.Method {
+	case "GET":
+		var f File
+		if err := getDraft(c, k, &f); err != nil {
+			return err
+		}
+		w.Header().Set("Content-Type", f.contentType(c))
+		_, err := io.Copy(w, f.reader(c))
+		return err
+	case "PUT":
+		if err := checkFileName(name); err != nil {
+			return badRequest("%v", err)
+		}
+		d, err := readBody(c, r, getLimits(c).Entry)
+		if err != nil {
+			return err
+		}
+		var f File
+		if err := getDraft(c, k, &f); err != nil && err != datastore.ErrNoSuchEntity {
+			return err
+		}
+		f.Name = name
+		if ct := r.Header.Get("Content-Type"); len(ct) != 0 && ct != "application/octet-stream" {
+			f.ContentType = ct
+		}
+		n := int64(len(d))
+		if err := f.setContent(c, sectionOpener(bytes.NewReader(d), n), n); err != nil {
+			return err
+		}
+		return putDraft(c, k, &f)
+	case "DELETE":
+		var f File
+		if err := getDraft(c, k, &f); err != nil {
+			return err
+		}
+		return deleteDraft(c, k)
+	}
+	return badRequest("unsupported method %v", r.Method)
+}
+
+func apiGroups(c appengine.Context, w http.ResponseWriter, r *http.Request, name string) error {
+	if len(name) == 0 {
+		if r.Method != "GET" {
+			return badRequest("unsupported method %v", r.Method)
+		}
+		var g []Group
+		if _, err := datastore.NewQuery("$Groups").GetAll(c, &g); err != nil {
+			return err
+		}
+		n := make([]string, 0, len(g))
+		for _, v := range g {
+			n = append(n, v.Name)
+		}
+		return apiJSON(w, n)
+	}
+	k := datastore.NewKey(c, "$Groups", name, 0, nil)
+	var g Group
+	err := datastore.Get(c, k, &g)
+	if err != nil && (err != datastore.ErrNoSuchEntity || r.Method != "PUT") {
+		return err
+	}
+	ctx := &Context{ctx: c, draft: true}
+	switch r.Method {
+	case "GET":
+		cur, err := ctx.GetTree(name)
+		if err != nil {
+			return err
+		}
+		recs, err := exportRecords(cur)
+		if err != nil {
+			return err
+		}
+		return apiJSON(w, recs)
+	case "PUT":
+		if strings.HasPrefix(name, "$") || name != template.URLQueryEscaper(name) {
+			return badRequest("invalid name of group %q", name)
+		}
+		d, err := readBody(c, r, getLimits(c).Entry)
+		if err != nil {
+			return err
+		}
+		var p Group
+		if len(bytes.TrimSpace(d)) != 0 {
+			if err := json.Unmarshal(d, &p); err != nil {
+				return badRequest("invalid group: %v", err)
+			}
+		}
+		slug := g.Slug != p.Slug
+		g.Name, g.Slug = name, p.Slug
+		if _, err := datastore.Put(c, k, &g); err != nil {
+			return err
+		}
+		if slug {
+			return updateSlugs(c, name)
+		}
+		return nil
+	case "DELETE":
+		// records are deleted before the group, so a failure leaves the
+		// group with the rest of them
+		keys, err := datastore.NewQuery(name).KeysOnly().GetAll(c, nil)
+		if err != nil {
+			return err
+		}
+		cur, err := ctx.GetTree(name)
+		if err != nil {
+			return err
+		}
+		seen := make(map[string]bool)
+		for _, v := range keys {
+			seen[v.Encode()] = true
+		}
+		var walk func(Cursor)
+		walk = func(cur Cursor) {
+			for _, v := range cur {
+				if !seen[v.Key.Encode()] {
+					keys = append(keys, v.Key)
+				}
+				walk(v.Children)
+			}
+		}
+		walk(cur)
+		for _, v := range keys {
+			if err := removeSlugs(c, v); err != nil {
+				return err
+			}
+		}
+		if err := discardDrafts(c, keys); err != nil {
+			return err
+		}
+		for len(keys) != 0 {
+			n := 500
+			if n > len(keys) {
+				n = len(keys)
+			}
+			if err := datastore.DeleteMulti(c, keys[:n]); err != nil {
+				return err
+			}
+			keys = keys[n:]
+		}
+		if err := datastore.Delete(c, k); err != nil {
+			return err
+		}
+		invalidate(c)
+		return nil
+	}
+	return badRequest("unsupported method %v", r.Method)
+}
+
+// queryKey returns the key of the parameter n of r which is a key path.
+func queryKey(c appengine.Context, r *http.Request, n string) (*datastore.Key, error) {
+	s := r.URL.Query().Get(n)
+	if len(s) == 0 {
+		return nil, nil
+	}
+	k, err := decodeKey(c, json.RawMessage(s))
+	if err != nil {
+		return nil, badRequest("invalid %v: %v", n, err)
+	}
+	return k, nil
+}
+
+func apiRecords(c appengine.Context, w http.ResponseWriter, r *http.Request, group string) error {
+	var g Group
+	if err := datastore.Get(c, datastore.NewKey(c, "$Groups", group, 0, nil), &g); err != nil {
+		if err == datastore.ErrNoSuchEntity {
+			return notFound("group " + group)
+		}
+		return err
+	}
+	k, err := queryKey(c, r, "key")
+	if err != nil {
+		return err
+	}
+	if k != nil && k.Kind() != group {
+		return badRequest("key %v is not a key of group %q", toPath(k), group)
+	}
+	if k == nil && r.Method != "PUT" {
+		return badRequest("key is missing")
+	}
+	switch r.Method {
+	case "GET":
+		var e entity
+		if err := getDraft(c, k, &e); err != nil {
+			return err
+		}
+		recs, err := exportRecords(Cursor{Value{Key: k, Data: e.data}})
+		if err != nil {
+			return err
+		}
+		return apiJSON(w, recs[0])
+	case "PUT":
+		d, err := readBody(c, r, getLimits(c).Entry)
+		if err != nil {
+			return err
+		}
+		var rec record
+		if err := json.Unmarshal(d, &rec); err != nil {
+			return badRequest("invalid record: %v", err)
+		}
+		rec.Key, rec.Children = nil, nil
+		cur, err := importRecords(c, []record{rec})
+		if err != nil {
+			return badRequest("invalid record: %v", err)
+		}
+		if k == nil {
+			parent, err := queryKey(c, r, "parent")
+			if err != nil {
+				return err
+			}
+			id, _, err := datastore.AllocateIDs(c, group, parent, 1)
+			if err != nil {
+				return err
+			}
+			k = datastore.NewKey(c, group, "", id, parent)
+		}
+		if err := putDraft(c, k, &entity{cur[0].Data}); err != nil {
+			return err
+		}
+		return apiJSON(w, toPath(k))
+	case "DELETE":
+		var e entity
+		if err := getDraft(c, k, &e); err != nil {
+			return err
+		}
+		return deleteDraft(c, k)
+	}
+	return badRequest("unsupported method %v", r.Method)
+}
+
+func apiDefault(c appengine.Context, w http.ResponseWriter, r *http.Request) error {
+	if r.Method != "PUT" {
+		return badRequest("unsupported method %v", r.Method)
+	}
+	d, err := readBody(c, r, 1<<10)
+	if err != nil {
+		return err
+	}
+	k := datastore.NewKey(c, "$Pages", strings.TrimSpace(string(d)), 0, nil)
+	var p Page
+	if err := datastore.Get(c, k, &p); err == datastore.ErrNoSuchEntity {
+		return badRequest("page %q is not published", k.StringID())
+	} else if err != nil {
+		return err
+	}
+	c.Infof("new default page: %v", k)
+	if _, err := datastore.Put(c, datastore.NewKey(c, "$Config", "config", 0, nil), &Config{k}); err != nil {
+		return err
+	}
+	invalidate(c)
+	return nil
+}
+
+// templateError is an error of templates of a page.
+type templateError struct {
+	Page  string
+	Error string
+}
+
+// apiValidate parses templates of all pages with drafts and lists errors.
+func apiValidate(c appengine.Context, w http.ResponseWriter) error {
+	ctx := &Context{ctx: c, draft: true}
+	cur, err := ctx.Get("$Pages", "Name", "", 0, 0)
+	if err != nil {
+		return err
+	}
+	out := make([]templateError, 0)
+	for _, v := range cur {
+		var p Page
+		if err := getDraft(c, v.Key, &p); err != nil {
+			return err
+		}
+		if _, err := parsePage(c, p, true); err != nil {
+			out = append(out, templateError{p.Name, err.Error()})
+		}
+	}
+	return apiJSON(w, out)
+}
+
+// apiImport imports the archive in the body of r. The changes are committed
+// at once, a dry import only lists them.
+func apiImport(c appengine.Context, w http.ResponseWriter, r *http.Request) error {
+	if r.Method != "POST" {
+		return badRequest("unsupported method %v", r.Method)
+	}
+	d, err := readBody(c, r, getLimits(c).Total)
+	if err != nil {
+		return err
+	}
+	section := r.FormValue("section")
+	if len(section) == 0 {
+		section = "all"
+	}
+	// the body is read by the same code as an archive staged by the editor
+	f := &File{Name: "api"}
+	f.setData(d)
+	s, rejected, err := openSite(c, f, section)
+	if err != nil {
+		return badRequest("invalid import of section %q: %v", section, err)
+	}
+	mode, err := parseMode(r)
+	if err != nil {
+		return badRequest("%v", err)
+	}
+	changes, err := s.changes(c, mode)
+	if err != nil {
+		return err
+	}
+	if len(r.FormValue("dry")) == 0 && len(changes) != 0 {
+		if err := commitChanges(c, "api", changes, s.remap); err != nil {
+			return err
+		}
+		invalidate(c)
+	}
+	return apiJSON(w, struct {
+		Changes  []*Change
+		Rejected []rejection
+	}{changes, rejected})
+}
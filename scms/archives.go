@@ -0,0 +1,255 @@
+// Copyright (c) 2012 Alexander Sychev. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package scms
+
+import (
+	"appengine"
+	"appengine/datastore"
+	"archive/zip"
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Limits are limits of imported archives, they are kept in "$Config" named "limits".
+type Limits struct {
+	Total   int64
+	Entry   int64
+	Ratio   int64
+	Entries int64
+}
+
+var defaultLimits = Limits{
+	Total:   256 << 20,
+	Entry:   32 << 20,
+	Ratio:   100,
+	Entries: 10000,
+}
+
+func (this Limits) TotalMB() int64 {
+	return this.Total >> 20
+}
+
+func (this Limits) EntryMB() int64 {
+	return this.Entry >> 20
+}
+
+// the compression ratio is not checked for entries smaller than minRatioSize,
+// small JSON and text files are often compressed very well.
+const minRatioSize = 1 << 20
+
+func limitsKey(c appengine.Context) *datastore.Key {
+	return datastore.NewKey(c, "$Config", "limits", 0, nil)
+}
+
+// getLimits returns the configured limits, unset limits have default values.
+func getLimits(c appengine.Context) Limits {
+	var l Limits
+	if err := datastore.Get(c, limitsKey(c), &l); err != nil && err != datastore.ErrNoSuchEntity {
+		c.Errorf("can't get limits of import: %v", err)
+	}
+	if l.Total <= 0 {
+		l.Total = defaultLimits.Total
+	}
+	if l.Entry <= 0 {
+		l.Entry = defaultLimits.Entry
+	}
+	if l.Ratio <= 0 {
+		l.Ratio = defaultLimits.Ratio
+	}
+	if l.Entries <= 0 {
+		l.Entries = defaultLimits.Entries
+	}
+	return l
+}
+
+// setLimits stores limits from the form of the editor, sizes are in megabytes.
+func setLimits(c appengine.Context, r *http.Request) error {
+	var l Limits
+	for _, v := range []struct {
+		name  string
+		val   *int64
+		scale int64
+	}{{"total", &l.Total, 1 << 20}, {"entry", &l.Entry, 1 << 20}, {"ratio", &l.Ratio, 1}, {"entries", &l.Entries, 1}} {
+		s := strings.TrimSpace(r.FormValue(v.name))
+		if len(s) == 0 {
+			continue
+		}
+		n, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return err
+		}
+		if n < 0 {
+			return fmt.Errorf("limit %q must not be negative", v.name)
+		}
+		*v.val = n * v.scale
+	}
+	_, err := datastore.Put(c, limitsKey(c), &l)
+	return err
+}
+
+func (this *Context) GetLimits() (Limits, error) {
+	if this.ctx == nil {
+		return Limits{}, &scmsError{"invalid context"}
+	}
+	return getLimits(this.ctx), nil
+}
+
+func (this *Value) GetLimits() (Limits, error) {
+	return this.ctx.GetLimits()
+}
+
+// rejection is an entry of an archive that was not imported.
+type rejection struct {
+	Name   string
+	Reason string
+}
+
+// archive is an imported zip archive. Its entries are checked once when it
+// is opened: only entries with safe names and sizes within the limits are
+// kept in files, all others are reported as rejected. Nested archives share
+// the limits, the total size and the rejections with the outer one.
+type archive struct {
+	c        appengine.Context
+	name     string
+	files    []*zip.File
+	limits   Limits
+	total    *int64
+	count    *int64
+	rejected *[]rejection
+}
+
+func openArchive(c appengine.Context, file io.ReaderAt, size int64) (*archive, error) {
+	var total, count int64
+	a := &archive{
+		c:        c,
+		limits:   getLimits(c),
+		total:    &total,
+		count:    &count,
+		rejected: new([]rejection),
+	}
+	return a, a.open(file, size)
+}
+
+func (this *archive) open(file io.ReaderAt, size int64) error {
+	r, err := zip.NewReader(file, size)
+	if err != nil {
+		return err
+	}
+	for _, v := range r.File {
+		if strings.HasSuffix(v.Name, "/") || v.FileInfo().IsDir() {
+			continue
+		}
+		if reason := this.check(v); len(reason) != 0 {
+			this.reject(v.Name, reason)
+			continue
+		}
+		this.files = append(this.files, v)
+	}
+	return nil
+}
+
+// check returns a reason to reject the entry f or an empty string.
+func (this *archive) check(f *zip.File) string {
+	if reason := checkName(f.Name); len(reason) != 0 {
+		return reason
+	}
+	size, packed := int64(f.UncompressedSize), int64(f.CompressedSize)
+	if *this.count+1 > this.limits.Entries {
+		return fmt.Sprintf("too many entries, the limit is %v", this.limits.Entries)
+	}
+	if size > this.limits.Entry {
+		return fmt.Sprintf("size %v exceeds the limit %v", size, this.limits.Entry)
+	}
+	if *this.total+size > this.limits.Total {
+		return fmt.Sprintf("total size exceeds the limit %v", this.limits.Total)
+	}
+	if f.Method != zip.Store && size != 0 && packed == 0 {
+		return "invalid compressed size"
+	}
+	if size >= minRatioSize && packed != 0 && size/packed > this.limits.Ratio {
+		return fmt.Sprintf("compression ratio %v exceeds the limit %v", size/packed, this.limits.Ratio)
+	}
+	*this.count++
+	*this.total += size
+	return ""
+}
+
+// checkName returns a reason to reject an entry named n or an empty string.
+func checkName(n string) string {
+	switch {
+	case len(n) == 0:
+		return "empty name"
+	case strings.ContainsRune(n, 0):
+		return "name contains NUL"
+	case strings.HasPrefix(n, "/") || strings.HasPrefix(n, "\\"):
+		return "absolute name"
+	case len(n) > 1 && n[1] == ':':
+		return "name with a drive letter"
+	}
+	for _, v := range strings.Split(strings.Replace(n, "\\", "/", -1), "/") {
+		if v == ".." {
+			return "name refers to a parent folder"
+		}
+	}
+	return ""
+}
+
+func (this *archive) reject(name string, reason string) {
+	if len(this.name) != 0 {
+		name = this.name + "/" + name
+	}
+	this.c.Errorf("entry %q of archive is rejected: %v", name, reason)
+	*this.rejected = append(*this.rejected, rejection{name, reason})
+}
+
+// isZip reports whether r starts as a zip archive.
+func isZip(r io.ReaderAt) bool {
+	b := make([]byte, 2)
+	n, _ := r.ReadAt(b, 0)
+	return n == len(b) && string(b) == "PK"
+}
+
+// readEntry returns the content of the entry f, no more than its declared size is read.
+func readEntry(f *zip.File) ([]byte, error) {
+	d := make([]byte, f.UncompressedSize)
+	rc, err := f.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	if _, err := io.ReadFull(rc, d); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// nested opens the entry f as an archive. Archives are not allowed to be
+// nested deeper than one level, nil is returned for rejected ones. The
+// nested archive is not imported as an entry, so its size is replaced in the
+// total by sizes of its entries.
+func (this *archive) nested(f *zip.File) (*archive, error) {
+	if len(this.name) != 0 {
+		this.reject(f.Name, "archive is nested too deep")
+		return nil, nil
+	}
+	d, err := readEntry(f)
+	if err != nil {
+		return nil, err
+	}
+	*this.total -= int64(f.UncompressedSize)
+	*this.count--
+	a := *this
+	a.name = f.Name
+	a.files = nil
+	if err := a.open(bytes.NewReader(d), int64(len(d))); err != nil {
+		this.reject(f.Name, err.Error())
+		return nil, nil
+	}
+	return &a, nil
+}
@@ -0,0 +1,129 @@
+// Copyright (c) 2012 Alexander Sychev. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package scms
+
+import (
+	"archive/zip"
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestCheckName(t *testing.T) {
+	for _, v := range []struct {
+		name   string
+		reason string
+	}{
+		{"", "empty name"},
+		{"index.html", ""},
+		{"images/a.png", ""},
+		{"a..b/c", ""},
+		{"a\x00b", "name contains NUL"},
+		{"/etc/passwd", "absolute name"},
+		{"\\windows", "absolute name"},
+		{"c:/windows", "name with a drive letter"},
+		{"C:file", "name with a drive letter"},
+		{"../a", "name refers to a parent folder"},
+		{"a/../../b", "name refers to a parent folder"},
+		{"a\\..\\b", "name refers to a parent folder"},
+		{"a/..", "name refers to a parent folder"},
+	} {
+		if r := checkName(v.name); r != v.reason {
+			t.Errorf("checkName(%q) = %q, want %q", v.name, r, v.reason)
+		}
+	}
+}
+
+// testZip returns a zip archive with entries of the given names and contents.
+func testZip(t *testing.T, entries ...string) []byte {
+	b := bytes.NewBuffer(nil)
+	z := zip.NewWriter(b)
+	for i := 0; i+1 < len(entries); i += 2 {
+		w, err := z.Create(entries[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write([]byte(entries[i+1])); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := z.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return b.Bytes()
+}
+
+func testArchive(l Limits) *archive {
+	var total, count int64
+	return &archive{limits: l, total: &total, count: &count, rejected: new([]rejection)}
+}
+
+func TestCheck(t *testing.T) {
+	d := testZip(t,
+		"a.txt", "12345",
+		"../b.txt", "1",
+		"big.txt", strings.Repeat("x", 11),
+		"c.txt", "123",
+		"d.txt", "12345",
+		"e.txt", "1",
+		"f.txt", "1",
+	)
+	r, err := zip.NewReader(bytes.NewReader(d), int64(len(d)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := testArchive(Limits{Total: 12, Entry: 10, Ratio: 100, Entries: 3})
+	for i, want := range []string{
+		"",
+		"name refers to a parent folder",
+		"size 11 exceeds the limit 10",
+		"",
+		"total size exceeds the limit 12",
+		"",
+		"too many entries, the limit is 3",
+	} {
+		if reason := a.check(r.File[i]); reason != want {
+			t.Errorf("check(%q) = %q, want %q", r.File[i].Name, reason, want)
+		}
+	}
+	if *a.total != 9 || *a.count != 3 {
+		t.Errorf("total %v and count %v, want 9 and 3", *a.total, *a.count)
+	}
+}
+
+func TestCheckRatio(t *testing.T) {
+	d := testZip(t, "zeros", strings.Repeat("0", minRatioSize))
+	r, err := zip.NewReader(bytes.NewReader(d), int64(len(d)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := testArchive(Limits{Total: 2 * minRatioSize, Entry: minRatioSize, Ratio: 10, Entries: 10})
+	if reason := a.check(r.File[0]); !strings.HasPrefix(reason, "compression ratio") {
+		t.Errorf("check of a compressed entry = %q, want a compression ratio", reason)
+	}
+}
+
+func TestNestedTotal(t *testing.T) {
+	inner := testZip(t, "a.txt", "12345", "b.txt", "12345")
+	d := testZip(t, "files.zip", string(inner))
+	// the total admits the nested archive or its entries, but not both
+	a := testArchive(Limits{Total: int64(len(inner)) + 5, Entry: 1 << 20, Ratio: 100, Entries: 10})
+	if err := a.open(bytes.NewReader(d), int64(len(d))); err != nil {
+		t.Fatal(err)
+	}
+	if len(*a.rejected) != 0 || len(a.files) != 1 {
+		t.Fatalf("outer archive: rejected %v, files %v", *a.rejected, len(a.files))
+	}
+	n, err := a.nested(a.files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n == nil || len(n.files) != 2 || len(*a.rejected) != 0 {
+		t.Fatalf("nested archive is rejected: %v", *a.rejected)
+	}
+	if *a.total != 10 || *a.count != 2 {
+		t.Errorf("total %v and count %v, want 10 and 2", *a.total, *a.count)
+	}
+}
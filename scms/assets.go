@@ -0,0 +1,178 @@
+// Copyright (c) 2012 Alexander Sychev. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package scms
+
+import (
+	"appengine"
+	"appengine/datastore"
+	"bytes"
+	"fmt"
+	"net/http"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// Fingerprinted URLs of files look like /$assets/<hash>/<name>, they are
+// served with immutable caching because the content of such URL never changes.
+const (
+	assetsPrefix = "$assets/"
+	hashLen      = 12
+)
+
+func assetURL(f *File) string {
+	return "/" + assetsPrefix + f.Hash[:hashLen] + "/" + f.Name
+}
+
+// exportAsset serves a fingerprinted file, an outdated fingerprint is redirected to the current one.
+func exportAsset(c appengine.Context, w http.ResponseWriter, r *http.Request, fn string) error {
+	s := strings.SplitN(fn[len(assetsPrefix):], "/", 2)
+	if len(s) != 2 {
+		return datastore.ErrNoSuchEntity
+	}
+	var f File
+	if err := datastore.Get(c, datastore.NewKey(c, "$Files", s[1], 0, nil), &f); err != nil {
+		return err
+	}
+	if len(f.Hash) < hashLen {
+		return datastore.ErrNoSuchEntity
+	}
+	if f.Hash[:hashLen] != s[0] {
+		http.Redirect(w, r, assetURL(&f), http.StatusFound)
+		return nil
+	}
+	ct := f.contentType(c)
+	w.Header().Set("Content-Type", ct)
+	w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	if negotiateGzip(w, r, &f, ct) {
+		w.Header().Set("ETag", `"`+f.Hash+`-gzip"`)
+		return serveGzipped(c, w, r, &f)
+	}
+	w.Header().Set("ETag", `"`+f.Hash+`"`)
+	http.ServeContent(w, r, f.Name, f.Uploaded, f.reader(c))
+	return nil
+}
+
+// GetAsset returns a fingerprinted URL of a file. Drafts are not fingerprinted.
+func (this *Context) GetAsset(n interface{}) (string, error) {
+	if this.ctx == nil {
+		return "", &scmsError{"invalid context"}
+	}
+	name, ok := n.(string)
+	if !ok {
+		return "", fmt.Errorf("GetAsset: unexpected type of 'name': %T, must be string", n)
+	}
+	name = cleanName(name)
+	if this.draft {
+		return "/preview/" + name, nil
+	}
+	var f File
+	if err := datastore.Get(this.ctx, datastore.NewKey(this.ctx, "$Files", name, 0, nil), &f); err != nil {
+		return "", fmt.Errorf("GetAsset: file %q: %v", name, err)
+	}
+	if len(f.Hash) < hashLen {
+		return "/" + name, nil
+	}
+	return assetURL(&f), nil
+}
+
+func (this *Value) GetAsset(name interface{}) (string, error) {
+	return this.ctx.GetAsset(name)
+}
+
+// minify removes comments and redundant white space from CSS and HTML.
+// The transformations are conservative: content of <pre>, <textarea>, <script>
+// and <style> in HTML is not changed. JavaScript is kept as it is, removing of
+// comments and line breaks needs a tokenizer of strings, template literals and
+// regular expressions.
+func minify(name string, d []byte) []byte {
+	switch strings.ToLower(path.Ext(name)) {
+	case ".css":
+		return minifyCSS(d)
+	case ".html", ".htm":
+		return minifyHTML(d)
+	}
+	return d
+}
+
+// minifyCSS removes comments and needless whitespace. Whitespace before ':'
+// is kept, it is a descendant combinator in selectors like "a :hover".
+func minifyCSS(d []byte) []byte {
+	const separators = "{};:,>"
+	const before = "{};,>"
+	out := bytes.NewBuffer(nil)
+	space := false
+	for i := 0; i < len(d); i++ {
+		ch := d[i]
+		switch {
+		case ch == '"' || ch == '\'':
+			if b := out.Bytes(); space && len(b) != 0 && !strings.ContainsRune(separators, rune(b[len(b)-1])) {
+				out.WriteByte(' ')
+			}
+			j := i + 1
+			for ; j < len(d) && d[j] != ch; j++ {
+				if d[j] == '\\' {
+					j++
+				}
+			}
+			if j >= len(d) {
+				j = len(d) - 1
+			}
+			out.Write(d[i : j+1])
+			i = j
+			space = false
+			continue
+		case ch == '/' && i+1 < len(d) && d[i+1] == '*':
+			if j := bytes.Index(d[i+2:], []byte("*/")); j >= 0 {
+				i += j + 3
+			} else {
+				i = len(d)
+			}
+			continue
+		case ch == ' ' || ch == '\t' || ch == '\n' || ch == '\r':
+			space = true
+			continue
+		}
+		if space && out.Len() != 0 && !strings.ContainsRune(before, rune(ch)) {
+			if b := out.Bytes(); !strings.ContainsRune(separators, rune(b[len(b)-1])) {
+				out.WriteByte(' ')
+			}
+		}
+		space = false
+		if ch == '}' && out.Len() != 0 && out.Bytes()[out.Len()-1] == ';' {
+			out.Truncate(out.Len() - 1)
+		}
+		out.WriteByte(ch)
+	}
+	return out.Bytes()
+}
+
+var (
+	htmlRaw     = regexp.MustCompile(`(?is)<(pre|textarea|script|style)\b.*?</(pre|textarea|script|style)\s*>`)
+	htmlComment = regexp.MustCompile(`(?s)<!--[^\[].*?-->`)
+	htmlSpace   = regexp.MustCompile(`\s+`)
+)
+
+func minifyHTML(d []byte) []byte {
+	out := bytes.NewBuffer(nil)
+	last := 0
+	for _, m := range htmlRaw.FindAllIndex(d, -1) {
+		out.Write(minifyHTMLText(d[last:m[0]]))
+		out.Write(d[m[0]:m[1]])
+		last = m[1]
+	}
+	out.Write(minifyHTMLText(d[last:]))
+	return out.Bytes()
+}
+
+func minifyHTMLText(d []byte) []byte {
+	d = htmlComment.ReplaceAll(d, nil)
+	return htmlSpace.ReplaceAllFunc(d, func(s []byte) []byte {
+		if bytes.IndexByte(s, '\n') >= 0 {
+			return []byte("\n")
+		}
+		return []byte(" ")
+	})
+}
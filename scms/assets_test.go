@@ -0,0 +1,29 @@
+// Copyright (c) 2012 Alexander Sychev. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package scms
+
+import (
+	"testing"
+)
+
+func TestMinifyCSS(t *testing.T) {
+	for _, v := range []struct {
+		css  string
+		want string
+	}{
+		{"a {\n  color: red;\n}\n", "a{color:red}"},
+		{"a :hover{x:y}", "a :hover{x:y}"},
+		{"/* comment */a{b:c}", "a{b:c}"},
+		{"a{b:c}/* unterminated", "a{b:c}"},
+		{`a{content:"  x ; y  "}`, `a{content:"  x ; y  "}`},
+		{`a{content: 'it\'s' }`, `a{content:'it\'s'}`},
+		{"a > b , c{}", "a>b,c{}"},
+		{"a { margin: 0 auto }", "a{margin:0 auto}"},
+	} {
+		if s := string(minifyCSS([]byte(v.css))); s != v.want {
+			t.Errorf("minifyCSS(%q) = %q, want %q", v.css, s, v.want)
+		}
+	}
+}
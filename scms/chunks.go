@@ -0,0 +1,404 @@
+// Copyright (c) 2012 Alexander Sychev. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package scms
+
+import (
+	"appengine"
+	"appengine/datastore"
+	"appengine/user"
+	"bytes"
+	"crypto/sha1"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// Content of a file up to chunkSize is kept in the file itself, larger content
+// is split into "$Chunks" named by the hash of the content, so drafts, revisions
+// and published versions of a file share the same chunks.
+const chunkSize = 0xF0000
+
+type chunk struct {
+	Data   []byte
+	Stored time.Time
+}
+
+func chunkKey(c appengine.Context, hash string, i int64) *datastore.Key {
+	return datastore.NewKey(c, "$Chunks", fmt.Sprintf("%s/%d", hash, i), 0, nil)
+}
+
+// putChunk stores d up to chunkSize as the only chunk of content named by its hash.
+func putChunk(c appengine.Context, d []byte) (string, error) {
+	h := sha1.New()
+	h.Write(d)
+	hash := fmt.Sprintf("%x", h.Sum(nil))
+	_, err := datastore.Put(c, chunkKey(c, hash, 0), &chunk{Data: d, Stored: time.Now()})
+	return hash, err
+}
+
+// setContent stores n bytes of content read by open. The content is read twice
+// for large files: to calculate the hash and to store the chunks.
+func (this *File) setContent(c appengine.Context, open func() (io.ReadCloser, error), n int64) error {
+	rc, err := open()
+	if err != nil {
+		return err
+	}
+	if u := user.Current(c); u != nil {
+		this.Uploader = u.Email
+	}
+	if n <= chunkSize {
+		d := make([]byte, n)
+		_, err := io.ReadFull(rc, d)
+		rc.Close()
+		if err != nil {
+			return err
+		}
+		this.setData(d)
+		this.Chunks = 0
+		return nil
+	}
+	h := sha1.New()
+	_, err = io.CopyN(h, rc, n)
+	rc.Close()
+	if err != nil {
+		return err
+	}
+	hash := fmt.Sprintf("%x", h.Sum(nil))
+	if rc, err = open(); err != nil {
+		return err
+	}
+	defer rc.Close()
+	var i int64
+	for ; i*chunkSize < n; i++ {
+		ch := chunk{Data: make([]byte, chunkSize), Stored: time.Now()}
+		if (i+1)*chunkSize > n {
+			ch.Data = ch.Data[:n-i*chunkSize]
+		}
+		if _, err := io.ReadFull(rc, ch.Data); err != nil {
+			return err
+		}
+		if _, err := datastore.Put(c, chunkKey(c, hash, i), &ch); err != nil {
+			return err
+		}
+	}
+	c.Infof("file %q is stored in %v chunks", this.Name, i)
+	this.setData(nil)
+	this.Hash = hash
+	this.Size = n
+	this.Chunks = i
+	return nil
+}
+
+// chunkWriter stores content of a file in chunks while it is written, so
+// the content is not kept in memory. The hash of the content is not known
+// until it is written, so the chunks are named by the unique id and moved
+// to the hash when the content is complete.
+type chunkWriter struct {
+	c      appengine.Context
+	id     string
+	hash   hash.Hash
+	buf    []byte
+	chunks int64
+	size   int64
+}
+
+func newChunkWriter(c appengine.Context, name string) *chunkWriter {
+	h := sha1.New()
+	fmt.Fprintf(h, "%s\n%v", name, time.Now().UnixNano())
+	return &chunkWriter{c: c, id: fmt.Sprintf("%x", h.Sum(nil)), hash: sha1.New()}
+}
+
+func (this *chunkWriter) Write(p []byte) (int, error) {
+	this.hash.Write(p)
+	n := len(p)
+	for len(p) != 0 {
+		l := chunkSize - len(this.buf)
+		if l > len(p) {
+			l = len(p)
+		}
+		this.buf = append(this.buf, p[:l]...)
+		p = p[l:]
+		if len(this.buf) == chunkSize {
+			if err := this.flush(); err != nil {
+				return n - len(p), err
+			}
+		}
+	}
+	this.size += int64(n)
+	return n, nil
+}
+
+func (this *chunkWriter) flush() error {
+	ch := chunk{Data: this.buf, Stored: time.Now()}
+	if _, err := datastore.Put(this.c, chunkKey(this.c, this.id, this.chunks), &ch); err != nil {
+		return err
+	}
+	this.chunks++
+	this.buf = nil
+	return nil
+}
+
+// close sets the written content to f. Content up to chunkSize is kept in
+// f itself like by setContent.
+func (this *chunkWriter) close(f *File) error {
+	if u := user.Current(this.c); u != nil {
+		f.Uploader = u.Email
+	}
+	if this.chunks == 0 {
+		f.setData(this.buf)
+		f.Chunks = 0
+		return nil
+	}
+	if len(this.buf) != 0 {
+		if err := this.flush(); err != nil {
+			return err
+		}
+	}
+	sum := fmt.Sprintf("%x", this.hash.Sum(nil))
+	if err := this.move(sum); err != nil {
+		return err
+	}
+	this.c.Infof("file %q is stored in %v chunks", f.Name, this.chunks)
+	f.setData(nil)
+	f.Hash = sum
+	f.Size = this.size
+	f.Chunks = this.chunks
+	return nil
+}
+
+// move renames the chunks from the id of the writer to the hash of the
+// content one at a time. Chunks which are left by a failure are not referred
+// to by any file, so they are removed by sweepChunks.
+func (this *chunkWriter) move(sum string) error {
+	for i := int64(0); i < this.chunks; i++ {
+		k := chunkKey(this.c, this.id, i)
+		var ch chunk
+		if err := datastore.Get(this.c, k, &ch); err != nil {
+			return err
+		}
+		ch.Stored = time.Now()
+		if _, err := datastore.Put(this.c, chunkKey(this.c, sum, i), &ch); err != nil {
+			return err
+		}
+		if err := datastore.Delete(this.c, k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// reader returns a reader of the content of the file, chunks are loaded on demand.
+func (this *File) reader(c appengine.Context) io.ReadSeeker {
+	if this.Chunks == 0 {
+		return bytes.NewReader(this.Data)
+	}
+	return &chunkReader{c: c, f: this, index: -1}
+}
+
+// content returns the whole content of the file.
+func (this *File) content(c appengine.Context) ([]byte, error) {
+	if this.Chunks == 0 {
+		return this.Data, nil
+	}
+	return ioutil.ReadAll(this.reader(c))
+}
+
+func sectionOpener(r io.ReaderAt, n int64) func() (io.ReadCloser, error) {
+	return func() (io.ReadCloser, error) {
+		return ioutil.NopCloser(io.NewSectionReader(r, 0, n)), nil
+	}
+}
+
+type chunkReader struct {
+	c     appengine.Context
+	f     *File
+	off   int64
+	index int64
+	buf   []byte
+}
+
+func (this *chunkReader) Read(p []byte) (int, error) {
+	if this.off >= this.f.Size {
+		return 0, io.EOF
+	}
+	i := this.off / chunkSize
+	if i != this.index {
+		var ch chunk
+		if err := datastore.Get(this.c, chunkKey(this.c, this.f.Hash, i), &ch); err != nil {
+			return 0, err
+		}
+		this.buf, this.index = ch.Data, i
+	}
+	n := copy(p, this.buf[this.off-i*chunkSize:])
+	if n == 0 {
+		return 0, io.ErrUnexpectedEOF
+	}
+	this.off += int64(n)
+	return n, nil
+}
+
+func (this *chunkReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case os.SEEK_SET:
+	case os.SEEK_CUR:
+		offset += this.off
+	case os.SEEK_END:
+		offset += this.f.Size
+	default:
+		return this.off, &scmsError{"invalid whence"}
+	}
+	if offset < 0 {
+		return this.off, &scmsError{"negative position"}
+	}
+	this.off = offset
+	return offset, nil
+}
+
+// ReadAt makes a chunked file readable by archive/zip.
+func (this *chunkReader) ReadAt(p []byte, off int64) (int, error) {
+	if _, err := this.Seek(off, os.SEEK_SET); err != nil {
+		return 0, err
+	}
+	n, err := io.ReadFull(this, p)
+	if err == io.ErrUnexpectedEOF {
+		err = io.EOF
+	}
+	return n, err
+}
+
+// Chunks are not counted by references, they are swept by cron instead: a
+// chunk is removed if its hash is not referred by files, drafts, snapshots,
+// staged imports, revisions or journals. Chunks stored within sweepGrace are kept as
+// their file may be not written yet. Caches of files are swept the same way.
+const sweepGrace = time.Hour
+
+// chunkHashes adds hashes of content referred by entities of kind to refs.
+func chunkHashes(c appengine.Context, kind string, refs map[string]bool) error {
+	for t := datastore.NewQuery(kind).Run(c); ; {
+		var e entity
+		if _, err := t.Next(&e); err == datastore.Done {
+			break
+		} else if err != nil {
+			return err
+		}
+		for _, n := range []string{"Hash", "DataHash"} {
+			if h, ok := e.data[n].(string); ok {
+				refs[h] = true
+			}
+		}
+		// revisions of large files keep their hashes in the content
+		if d, ok := e.data["Content"].([]byte); ok && kind == "$Revisions" {
+			var m map[string]typedValue
+			if json.Unmarshal(d, &m) == nil && m["Hash"].Type == "string" {
+				refs[m["Hash"].Value] = true
+			}
+		}
+	}
+	return nil
+}
+
+// sweepChunks removes chunks which are not referred anymore, and compressed
+// files and derivatives of images which are not of current files or drafts.
+func sweepChunks(c appengine.Context) error {
+	refs := make(map[string]bool)
+	for _, k := range []string{"$Files", "$Drafts"} {
+		if err := chunkHashes(c, k, refs); err != nil {
+			return err
+		}
+	}
+	if err := sweepCaches(c, refs); err != nil {
+		return err
+	}
+	for _, k := range []string{"$Snapshots", "$Imports", "$Revisions", "$Staged"} {
+		if err := chunkHashes(c, k, refs); err != nil {
+			return err
+		}
+	}
+	keys, err := datastore.NewQuery("$Chunks").KeysOnly().GetAll(c, nil)
+	if err != nil {
+		return err
+	}
+	var unused []*datastore.Key
+	before := time.Now().Add(-sweepGrace)
+	for _, k := range keys {
+		if i := strings.Index(k.StringID(), "/"); i < 0 || refs[k.StringID()[:i]] {
+			continue
+		}
+		var ch chunk
+		if err := datastore.Get(c, k, &ch); err != nil {
+			return err
+		}
+		if ch.Stored.Before(before) {
+			unused = append(unused, k)
+		}
+	}
+	c.Infof("removing %v unused chunks", len(unused))
+	return deleteAll(c, unused)
+}
+
+// sweepCaches removes entities of "$Compressed" and "$Images" which are named
+// by hashes of content not in refs.
+func sweepCaches(c appengine.Context, refs map[string]bool) error {
+	var unused []*datastore.Key
+	for _, kind := range []string{"$Compressed", "$Images"} {
+		keys, err := datastore.NewQuery(kind).KeysOnly().GetAll(c, nil)
+		if err != nil {
+			return err
+		}
+		for _, k := range keys {
+			h := k.StringID()
+			if i := strings.Index(h, "?"); i >= 0 {
+				h = h[:i]
+			}
+			if !refs[h] {
+				unused = append(unused, k)
+			}
+		}
+	}
+	c.Infof("removing %v unused compressed files and derivatives", len(unused))
+	return deleteAll(c, unused)
+}
+
+// deleteAll deletes entities of keys in batches the datastore accepts.
+func deleteAll(c appengine.Context, keys []*datastore.Key) error {
+	for len(keys) != 0 {
+		n := 500
+		if n > len(keys) {
+			n = len(keys)
+		}
+		if err := datastore.DeleteMulti(c, keys[:n]); err != nil {
+			return err
+		}
+		keys = keys[n:]
+	}
+	return nil
+}
+
+// chunksHandler is called by cron to remove expired imports, to finish or
+// remove journals and to sweep unused chunks.
+func chunksHandler(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+	if !cronRequest(c, r) {
+		error404(w, r)
+		return
+	}
+	if err := expireImports(c); err != nil {
+		errorX(c, w, err)
+		return
+	}
+	if err := resumeJournals(c, true); err != nil {
+		errorX(c, w, err)
+		return
+	}
+	if err := sweepChunks(c); err != nil {
+		errorX(c, w, err)
+	}
+}
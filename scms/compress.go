@@ -0,0 +1,148 @@
+// Copyright (c) 2012 Alexander Sychev. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package scms
+
+import (
+	"appengine"
+	"appengine/datastore"
+	"bytes"
+	"compress/gzip"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Pages and text files are compressed by gzip if a client accepts it.
+// Brotli is not offered: there is no encoder of it in the standard library.
+const minCompressSize = 256
+
+// compressed is a cached gzipped content of a file, it is kept in "$Compressed"
+// named by the hash of the file.
+type compressed struct {
+	Data []byte
+}
+
+var compressibleTypes = []string{
+	"text/",
+	"application/json",
+	"application/javascript",
+	"application/x-javascript",
+	"application/xml",
+	"application/rss+xml",
+	"application/atom+xml",
+	"application/xhtml+xml",
+	"image/svg+xml",
+	"image/x-icon",
+	"font/ttf",
+	"font/otf",
+}
+
+// compressible reports whether content of type ct is worth compressing,
+// already compressed formats like images, archives and fonts are not.
+func compressible(ct string) bool {
+	if i := strings.Index(ct, ";"); i >= 0 {
+		ct = ct[:i]
+	}
+	ct = strings.ToLower(strings.TrimSpace(ct))
+	for _, v := range compressibleTypes {
+		if strings.HasPrefix(ct, v) {
+			return true
+		}
+	}
+	return false
+}
+
+// acceptsGzip reports whether gzip is allowed by Accept-Encoding of r.
+func acceptsGzip(r *http.Request) bool {
+	gz, star := -1.0, -1.0
+	for _, v := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		s := strings.Split(v, ";")
+		q := 1.0
+		for _, p := range s[1:] {
+			if p = strings.TrimSpace(p); strings.HasPrefix(p, "q=") {
+				var err error
+				if q, err = strconv.ParseFloat(p[2:], 64); err != nil {
+					q = 0
+				}
+			}
+		}
+		switch strings.ToLower(strings.TrimSpace(s[0])) {
+		case "gzip", "x-gzip":
+			gz = q
+		case "*":
+			star = q
+		}
+	}
+	if gz >= 0 {
+		return gz > 0
+	}
+	return star > 0
+}
+
+type gzipWriter struct {
+	http.ResponseWriter
+	gz *gzip.Writer
+}
+
+func (this *gzipWriter) Write(p []byte) (int, error) {
+	return this.gz.Write(p)
+}
+
+// compressResponse returns a writer compressing a response with content type ct
+// if r accepts it. The returned function must be called to finish the response.
+func compressResponse(w http.ResponseWriter, r *http.Request, ct string) (http.ResponseWriter, func()) {
+	if !compressible(ct) {
+		return w, func() {}
+	}
+	w.Header().Add("Vary", "Accept-Encoding")
+	if !acceptsGzip(r) {
+		return w, func() {}
+	}
+	w.Header().Set("Content-Encoding", "gzip")
+	w.Header().Del("Content-Length")
+	gz := gzip.NewWriter(w)
+	return &gzipWriter{w, gz}, func() {
+		gz.Close()
+	}
+}
+
+// negotiateGzip reports whether f of type ct is to be served gzipped.
+// Files stored in chunks are served as is.
+func negotiateGzip(w http.ResponseWriter, r *http.Request, f *File, ct string) bool {
+	if !compressible(ct) {
+		return false
+	}
+	w.Header().Add("Vary", "Accept-Encoding")
+	return f.Chunks == 0 && f.Size >= minCompressSize && acceptsGzip(r)
+}
+
+// serveGzipped serves the gzipped content of f, it is compressed once per hash of f.
+func serveGzipped(c appengine.Context, w http.ResponseWriter, r *http.Request, f *File) error {
+	var z compressed
+	k := datastore.NewKey(c, "$Compressed", f.Hash, 0, nil)
+	if err := datastore.Get(c, k, &z); err == datastore.ErrNoSuchEntity {
+		c.Infof("compressing file %q", f.Name)
+		b := bytes.NewBuffer(nil)
+		gz, err := gzip.NewWriterLevel(b, gzip.BestCompression)
+		if err != nil {
+			return err
+		}
+		if _, err := gz.Write(f.Data); err != nil {
+			return err
+		}
+		if err := gz.Close(); err != nil {
+			return err
+		}
+		z.Data = b.Bytes()
+		if _, err := datastore.Put(c, k, &z); err != nil {
+			c.Errorf("can't cache compressed file %q: %v", f.Name, err)
+		}
+	} else if err != nil {
+		return err
+	}
+	w.Header().Set("Content-Encoding", "gzip")
+	http.ServeContent(w, r, f.Name, f.Uploaded, bytes.NewReader(z.Data))
+	return nil
+}
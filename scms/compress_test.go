@@ -0,0 +1,39 @@
+// Copyright (c) 2012 Alexander Sychev. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package scms
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestAcceptsGzip(t *testing.T) {
+	for _, v := range []struct {
+		header string
+		want   bool
+	}{
+		{"", false},
+		{"gzip, deflate", true},
+		{"deflate", false},
+		{"GZIP", true},
+		{"x-gzip", true},
+		{"gzip;q=0", false},
+		{"gzip; q=0.5", true},
+		{"gzip;q=bad", false},
+		{"*", true},
+		{"*;q=0", false},
+		{"deflate, *;q=0.5", true},
+		{"gzip;q=0, *", false},
+		{"*;q=0, gzip", true},
+	} {
+		r := &http.Request{Header: http.Header{}}
+		if len(v.header) != 0 {
+			r.Header.Set("Accept-Encoding", v.header)
+		}
+		if ok := acceptsGzip(r); ok != v.want {
+			t.Errorf("acceptsGzip(%q) = %v, want %v", v.header, ok, v.want)
+		}
+	}
+}
@@ -0,0 +1,317 @@
+// Copyright (c) 2012 Alexander Sychev. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package scms
+
+import (
+	"appengine"
+	"appengine/datastore"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Records of a group are exported to CSV for spreadsheets: a row per record,
+// parents before children, a column per field. Headers of fields are
+// annotated by types as "Price:float", the types are the ones of the editor.
+// Columns "$Key" and "$Parent" keep key paths of a record and its parent.
+// Empty cells are fields which are not set.
+const (
+	csvKey    = "$Key"
+	csvParent = "$Parent"
+)
+
+// csvType returns the type of a field value for a header of CSV.
+func csvType(v interface{}) string {
+	switch v.(type) {
+	case string:
+		return "string"
+	case bool:
+		return "bool"
+	case int64:
+		return "integer"
+	case float64:
+		return "float"
+	case time.Time:
+		return "time"
+	case *datastore.Key:
+		return "key"
+	}
+	return ""
+}
+
+// csvValue formats a field value so parseCSVValue parses it back.
+func csvValue(v interface{}) string {
+	switch d := v.(type) {
+	case string:
+		return d
+	case bool:
+		return strconv.FormatBool(d)
+	case int64:
+		return strconv.FormatInt(d, 10)
+	case float64:
+		return strconv.FormatFloat(d, 'g', -1, 64)
+	case time.Time:
+		return d.Format(time.RFC3339Nano)
+	case *datastore.Key:
+		return keyCell(d)
+	case nil:
+		return ""
+	}
+	return fmt.Sprint(v)
+}
+
+func keyCell(k *datastore.Key) string {
+	if k == nil {
+		return ""
+	}
+	j, _ := json.Marshal(toPath(k))
+	return string(j)
+}
+
+// exportCSV writes records of the group g with drafts.
+func exportCSV(c appengine.Context, w io.Writer, g string) error {
+	ctx := &Context{ctx: c, draft: true}
+	tree, err := ctx.GetTree(g)
+	if err != nil {
+		return err
+	}
+	var rows []Value
+	var walk func(Cursor)
+	walk = func(cur Cursor) {
+		for _, v := range cur {
+			rows = append(rows, v)
+			walk(v.Children)
+		}
+	}
+	walk(tree)
+	// a column has one type, so fields which CSV can't keep fail the export
+	types := make(map[string]string)
+	for _, v := range rows {
+		for n, d := range v.Data {
+			if d == nil {
+				continue
+			}
+			t := csvType(d)
+			if len(t) == 0 {
+				return fmt.Errorf("field %q of %v has a value of type %T, it can't be exported to CSV", n, v.Key, d)
+			}
+			if o, ok := types[n]; ok && o != t {
+				return fmt.Errorf("field %q has values of types %v and %v, it can't be exported to CSV", n, o, t)
+			}
+			types[n] = t
+		}
+	}
+	var fields []string
+	for n := range types {
+		fields = append(fields, n)
+	}
+	sort.Strings(fields)
+	cw := csv.NewWriter(w)
+	header := []string{csvKey, csvParent}
+	for _, n := range fields {
+		header = append(header, n+":"+types[n])
+	}
+	if err := cw.Write(header); err != nil {
+		return err
+	}
+	for _, v := range rows {
+		row := []string{keyCell(v.Key), keyCell(v.Key.Parent())}
+		for _, n := range fields {
+			row = append(row, csvValue(v.Data[n]))
+		}
+		if err := cw.Write(row); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+func serveCSV(c appengine.Context, w http.ResponseWriter, g string) {
+	if err := datastore.Get(c, datastore.NewKey(c, "$Groups", g, 0, nil), &Group{}); err != nil {
+		errorX(c, w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", `attachment; filename="`+strings.Replace(g, `"`, "", -1)+`.csv"`)
+	ew := &exportWriter{ResponseWriter: w}
+	if err := exportCSV(c, ew, g); err != nil {
+		if !ew.written {
+			w.Header().Del("Content-Disposition")
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			errorX(c, w, err)
+			return
+		}
+		c.Errorf("export of group %q to CSV has failed: %v", g, err)
+	}
+}
+
+// parseCSVValue converts a cell to a value of a field like the editor does,
+// keys are also accepted as key paths.
+func parseCSVValue(c appengine.Context, typ string, val string) (interface{}, error) {
+	if typ == "key" && strings.HasPrefix(val, "[") {
+		return decodeKey(c, json.RawMessage(val))
+	}
+	return parseValue(typ, val)
+}
+
+func isFieldType(t string) bool {
+	switch t {
+	case "string", "bool", "integer", "float", "time", "key":
+		return true
+	}
+	return false
+}
+
+// flatRecord is a record of a flat list like rows of CSV, source names it in reports.
+type flatRecord struct {
+	Value
+	source   string
+	parent   *datastore.Key
+	children []*flatRecord
+}
+
+// nestRecords returns a tree of flat records nested by their parents,
+// a parent must be in the same list.
+func nestRecords(recs []*flatRecord) (Cursor, []rejection) {
+	var rejected []rejection
+	keys := make(map[string]*flatRecord)
+	var valid []*flatRecord
+	for _, v := range recs {
+		if v.Key != nil {
+			if keys[v.Key.Encode()] != nil {
+				rejected = append(rejected, rejection{v.source, "key is duplicated"})
+				continue
+			}
+			keys[v.Key.Encode()] = v
+		}
+		valid = append(valid, v)
+	}
+	var roots []*flatRecord
+	for _, v := range valid {
+		if v.parent == nil {
+			roots = append(roots, v)
+		} else if p := keys[v.parent.Encode()]; p != nil {
+			p.children = append(p.children, v)
+		} else {
+			rejected = append(rejected, rejection{v.source, "parent " + keyCell(v.parent) + " is not found"})
+		}
+	}
+	var cursor func([]*flatRecord) Cursor
+	cursor = func(recs []*flatRecord) Cursor {
+		var out Cursor
+		for _, v := range recs {
+			val := v.Value
+			val.Children = cursor(v.children)
+			out = append(out, val)
+		}
+		return out
+	}
+	return cursor(roots), rejected
+}
+
+// parseCSV adds records of the group g from CSV to the site s. Rows with
+// errors are skipped and reported as rejected.
+func parseCSV(c appengine.Context, r io.Reader, g string, s *site) ([]rejection, error) {
+	if strings.HasPrefix(g, "$") || strings.ContainsAny(g, "/\\") || len(g) == 0 {
+		return nil, fmt.Errorf("invalid name of group %q", g)
+	}
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+	header, err := cr.Read()
+	if err == io.EOF {
+		return nil, &scmsError{"CSV is empty"}
+	} else if err != nil {
+		return nil, err
+	}
+	names := make([]string, len(header))
+	types := make([]string, len(header))
+	seen := make(map[string]bool)
+	for i, h := range header {
+		h = strings.TrimSpace(h)
+		names[i], types[i] = h, "string"
+		if j := strings.LastIndex(h, ":"); j >= 0 && h != csvKey && h != csvParent {
+			names[i], types[i] = h[:j], h[j+1:]
+		}
+		if len(names[i]) == 0 {
+			return nil, fmt.Errorf("column %v has no name", i+1)
+		}
+		if !isFieldType(types[i]) {
+			return nil, fmt.Errorf("column %q has invalid type %q", names[i], types[i])
+		}
+		if seen[names[i]] {
+			return nil, fmt.Errorf("column %q is duplicated", names[i])
+		}
+		seen[names[i]] = true
+	}
+	var rejected []rejection
+	var rows []*flatRecord
+	for line := 2; ; line++ {
+		cells, err := cr.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		row, err := parseCSVRow(c, g, names, types, cells)
+		if err == nil && len(cells) > len(names) {
+			err = fmt.Errorf("%v cells, the header has %v", len(cells), len(names))
+		}
+		if err != nil {
+			rejected = append(rejected, rejection{fmt.Sprintf("row %v", line), err.Error()})
+			continue
+		}
+		row.source = fmt.Sprintf("row %v", line)
+		rows = append(rows, row)
+	}
+	cur, nested := nestRecords(rows)
+	s.groups = append(s.groups, importedGroup{name: g, records: cur})
+	rejected = append(rejected, nested...)
+	s.partial = s.partial || len(rejected) != 0
+	return rejected, nil
+}
+
+func parseCSVRow(c appengine.Context, g string, names []string, types []string, cells []string) (*flatRecord, error) {
+	row := &flatRecord{Value: Value{Data: make(Values)}}
+	for i, cell := range cells {
+		if len(cell) == 0 || i >= len(names) {
+			continue
+		}
+		switch names[i] {
+		case csvKey, csvParent:
+			k, err := decodeKey(c, json.RawMessage(cell))
+			if err != nil {
+				return nil, fmt.Errorf("column %q: %v", names[i], err)
+			}
+			if k.Kind() != g {
+				return nil, fmt.Errorf("column %q: %v is not a key of group %q", names[i], cell, g)
+			}
+			if names[i] == csvKey {
+				row.Key = k
+			} else {
+				row.parent = k
+			}
+			continue
+		}
+		v, err := parseCSVValue(c, types[i], cell)
+		if err != nil {
+			return nil, fmt.Errorf("column %q: %v", names[i], err)
+		}
+		row.Data[names[i]] = v
+	}
+	if row.Key != nil {
+		if row.parent != nil && !row.parent.Equal(row.Key.Parent()) {
+			return nil, fmt.Errorf("key %v is not a key of a child of %v", keyCell(row.Key), keyCell(row.parent))
+		}
+		row.parent = row.Key.Parent()
+	}
+	return row, nil
+}
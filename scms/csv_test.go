@@ -0,0 +1,85 @@
+// Copyright (c) 2012 Alexander Sychev. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package scms
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseCSV(t *testing.T) {
+	s := newSite()
+	rejected, err := parseCSV(nil, strings.NewReader("Title,Count:integer,Price:float\na,1,\nb,x,2\nc,3,1.5,extra\n"), "Posts", s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rejected) != 2 || rejected[0].Name != "row 3" || rejected[1].Name != "row 4" {
+		t.Errorf("rejected %v, want rows 3 and 4", rejected)
+	}
+	if len(s.groups) != 1 || s.groups[0].name != "Posts" || len(s.groups[0].records) != 1 {
+		t.Fatalf("groups %v, want Posts with one record", s.groups)
+	}
+	if d, want := s.groups[0].records[0].Data, (Values{"Title": "a", "Count": int64(1)}); !reflect.DeepEqual(d, want) {
+		t.Errorf("record %v, want %v", d, want)
+	}
+	if _, err := s.changes(nil, importMode{Name: "replace"}); err == nil {
+		t.Errorf("replace mode is allowed with rejected rows")
+	}
+}
+
+func TestParseCSVHeader(t *testing.T) {
+	for _, v := range []struct {
+		group string
+		csv   string
+	}{
+		{"Posts", ""},
+		{"$Pages", "Title\n"},
+		{"a/b", "Title\n"},
+		{"Posts", "Title:blob\n"},
+		{"Posts", "Title,Title:string\n"},
+		{"Posts", ":integer\n"},
+	} {
+		if _, err := parseCSV(nil, strings.NewReader(v.csv), v.group, newSite()); err == nil {
+			t.Errorf("parseCSV of %q to %q has no error", v.csv, v.group)
+		}
+	}
+}
+
+func TestParseCSVRow(t *testing.T) {
+	names := []string{"Title", "Count", "Done"}
+	types := []string{"string", "integer", "bool"}
+	for _, v := range []struct {
+		cells []string
+		want  Values
+	}{
+		{[]string{"a", "2", "true"}, Values{"Title": "a", "Count": int64(2), "Done": true}},
+		{[]string{"", "", "false"}, Values{"Done": false}},
+		{[]string{"a"}, Values{"Title": "a"}},
+	} {
+		row, err := parseCSVRow(nil, "Posts", names, types, v.cells)
+		if err != nil {
+			t.Errorf("parseCSVRow(%q): %v", v.cells, err)
+			continue
+		}
+		if !reflect.DeepEqual(row.Data, v.want) {
+			t.Errorf("parseCSVRow(%q) = %v, want %v", v.cells, row.Data, v.want)
+		}
+	}
+	if _, err := parseCSVRow(nil, "Posts", names, types, []string{"a", "two"}); err == nil {
+		t.Errorf("parseCSVRow accepts an invalid integer")
+	}
+}
+
+func TestNestRecords(t *testing.T) {
+	recs := []*flatRecord{
+		{Value: Value{Data: Values{"Title": "a"}}, source: "row 2"},
+		{Value: Value{Data: Values{"Title": "b"}}, source: "row 3"},
+	}
+	cur, rejected := nestRecords(recs)
+	if len(rejected) != 0 || len(cur) != 2 || cur[0].Data["Title"] != "a" || cur[1].Data["Title"] != "b" {
+		t.Errorf("nestRecords = %v, %v", cur, rejected)
+	}
+}
@@ -0,0 +1,242 @@
+// Copyright (c) 2012 Alexander Sychev. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package scms
+
+import (
+	"appengine"
+	"appengine/datastore"
+	"appengine/user"
+	"net/http"
+	"time"
+)
+
+// Drafts of pages, files and records are kept in "$Drafts" with the encoded
+// key of the published entity as a name, so the published version stays intact
+// until the drafts are published. Entities to be deleted on publishing are
+// marked in "$Deletions" the same way.
+
+type deletion struct {
+	Time time.Time
+}
+
+func draftKey(c appengine.Context, k *datastore.Key) *datastore.Key {
+	return datastore.NewKey(c, "$Drafts", k.Encode(), 0, nil)
+}
+
+func deletionKey(c appengine.Context, k *datastore.Key) *datastore.Key {
+	return datastore.NewKey(c, "$Deletions", k.Encode(), 0, nil)
+}
+
+// getDraft loads the draft of k or the published entity if there is no draft.
+func getDraft(c appengine.Context, k *datastore.Key, dst interface{}) error {
+	var d deletion
+	if err := datastore.Get(c, deletionKey(c, k), &d); err == nil {
+		return datastore.ErrNoSuchEntity
+	} else if err != datastore.ErrNoSuchEntity {
+		return err
+	}
+	if err := datastore.Get(c, draftKey(c, k), dst); err != datastore.ErrNoSuchEntity {
+		return err
+	}
+	return datastore.Get(c, k, dst)
+}
+
+// getEntity loads the draft state of k if draft is set or the published one otherwise.
+func getEntity(c appengine.Context, k *datastore.Key, dst interface{}, draft bool) error {
+	if draft {
+		return getDraft(c, k, dst)
+	}
+	return datastore.Get(c, k, dst)
+}
+
+// putDraft saves src as the draft of k and keeps it in the history of k. The
+// draft and the revision are written in one transaction, so there is no change
+// without a revision.
+func putDraft(c appengine.Context, k *datastore.Key, src interface{}) error {
+	c.Infof("saving draft of %v", k)
+	rev, err := newRevision(c, k, src)
+	if err != nil {
+		return err
+	}
+	return datastore.RunInTransaction(c, func(c appengine.Context) error {
+		if err := datastore.Delete(c, deletionKey(c, k)); err != nil && err != datastore.ErrNoSuchEntity {
+			return err
+		}
+		if _, err := datastore.Put(c, draftKey(c, k), src); err != nil {
+			return err
+		}
+		_, err := datastore.Put(c, datastore.NewIncompleteKey(c, "$Revisions", nil), rev)
+		return err
+	}, &datastore.TransactionOptions{XG: true})
+}
+
+// deleteDraft marks k to be deleted on publishing.
+func deleteDraft(c appengine.Context, k *datastore.Key) error {
+	c.Infof("deleting draft of %v", k)
+	if err := datastore.Delete(c, draftKey(c, k)); err != nil && err != datastore.ErrNoSuchEntity {
+		return err
+	}
+	_, err := datastore.Put(c, deletionKey(c, k), &deletion{time.Now()})
+	return err
+}
+
+// discardDrafts removes drafts and marks of deletion of keys when they are
+// published, or when an import replaces published entities and the editor
+// would publish stale drafts over them.
+func discardDrafts(c appengine.Context, keys []*datastore.Key) error {
+	var marks []*datastore.Key
+	for _, k := range keys {
+		marks = append(marks, draftKey(c, k), deletionKey(c, k))
+	}
+	for len(marks) != 0 {
+		n := 500
+		if n > len(marks) {
+			n = len(marks)
+		}
+		if err := datastore.DeleteMulti(c, marks[:n]); err != nil {
+			return err
+		}
+		marks = marks[n:]
+	}
+	return nil
+}
+
+// markedKeys returns keys of entities of kind with parent marked in "$Drafts" or "$Deletions"
+// along with keys of the marks.
+func markedKeys(c appengine.Context, mark string, kind string, parent *datastore.Key) ([]*datastore.Key, []*datastore.Key, error) {
+	mk, err := datastore.NewQuery(mark).KeysOnly().GetAll(c, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	var keys, targets []*datastore.Key
+	for _, v := range mk {
+		k, err := datastore.DecodeKey(v.StringID())
+		if err != nil {
+			return nil, nil, err
+		}
+		if k.Kind() != kind || !k.Parent().Equal(parent) {
+			continue
+		}
+		keys = append(keys, v)
+		targets = append(targets, k)
+	}
+	return keys, targets, nil
+}
+
+// drafts returns keys of published entities and drafts of kind with parent
+// and keys of entities to be deleted.
+func drafts(c appengine.Context, kind string, parent *datastore.Key) ([]*datastore.Key, []entity, []*datastore.Key, error) {
+	keys, targets, err := markedKeys(c, "$Drafts", kind, parent)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	d := make([]entity, len(keys))
+	if len(keys) != 0 {
+		if err := datastore.GetMulti(c, keys, d); err != nil {
+			return nil, nil, nil, err
+		}
+	}
+	_, removed, err := markedKeys(c, "$Deletions", kind, parent)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return targets, d, removed, nil
+}
+
+// publish promotes all drafts to published versions. The drafts and marks
+// of deletions are copied to a journal which is switched on at once, see
+// journal.go, so publishing which fails publishes nothing.
+func publish(c appengine.Context) error {
+	keys, err := datastore.NewQuery("$Drafts").KeysOnly().GetAll(c, nil)
+	if err != nil {
+		return err
+	}
+	dk, err := datastore.NewQuery("$Deletions").KeysOnly().GetAll(c, nil)
+	if err != nil {
+		return err
+	}
+	c.Infof("publishing %v drafts and %v deletions", len(keys), len(dk))
+	j, err := newJournal(c, "publishing", false)
+	if err != nil {
+		return err
+	}
+	if err := stageDrafts(c, j, keys, dk); err != nil {
+		c.Errorf("publishing has failed: %v", err)
+		j.discard()
+		return err
+	}
+	return j.commit()
+}
+
+// stageDrafts adds the drafts keys and deletions marked by dk to the journal
+// j, drafts are loaded by batches of the journal.
+func stageDrafts(c appengine.Context, j *journalWriter, keys []*datastore.Key, dk []*datastore.Key) error {
+	for len(keys) != 0 {
+		n := journalBatchSize
+		if n > len(keys) {
+			n = len(keys)
+		}
+		d := make([]entity, n)
+		if err := datastore.GetMulti(c, keys[:n], d); err != nil {
+			return err
+		}
+		for i, v := range keys[:n] {
+			k, err := datastore.DecodeKey(v.StringID())
+			if err != nil {
+				return err
+			}
+			if err := j.add(k, &d[i]); err != nil {
+				return err
+			}
+		}
+		keys = keys[n:]
+	}
+	for _, v := range dk {
+		k, err := datastore.DecodeKey(v.StringID())
+		if err != nil {
+			return err
+		}
+		if err := j.add(k, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func previewHandler(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+	if u := user.Current(c); u == nil {
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return
+	}
+	if r.Method != "GET" {
+		error404(w, r)
+		return
+	}
+	name := cleanName(r.URL.Path[len("/preview/"):])
+	if len(name) == 0 {
+		var config Config
+		datastore.Get(c, datastore.NewKey(c, "$Config", "config", 0, nil), &config)
+		if config.Default == nil {
+			errorX(c, w, &scmsError{"no default page is specified"})
+			return
+		}
+		http.Redirect(w, r, "/preview/"+config.Default.StringID(), http.StatusFound)
+		return
+	}
+	var p Page
+	if err := getDraft(c, datastore.NewKey(c, "$Pages", name, 0, nil), &p); err != nil {
+		if err := exportFile(c, w, r, name, true); err != nil {
+			error404(w, r)
+		}
+		return
+	}
+	tpl, err := parsePage(c, p, true)
+	if err != nil {
+		errorX(c, w, err)
+		return
+	}
+	executePage(c, w, r, tpl, p, true)
+}
@@ -5,12 +5,11 @@
 package scms
 
 import (
-	"os"
 	"io"
 	"fmt"
 	"net/http"
-	"bytes"
 	"archive/zip"
+	"encoding/json"
 	"html/template"
 	"appengine"
 	"appengine/user"
@@ -24,21 +23,69 @@ var editorTemplate = template.Must(template.New("editor").Parse(
 <body>
 <a href="/">Main</a><br>
 <a href="/editor/files">Files</a><br>
+<a href="/editor/media">Media library</a><br>
 <a href="/editor/pages">Pages</a><br>
 <a href="/editor/groups">Groups</a><br>
+<a href="/preview/">Preview drafts</a><br>
 <br>
+<form action="/editor/?action=publish" method="post">
+	<fieldset>
+		<legend>Drafts</legend>
+		<input type="submit" value="Publish">
+	</fieldset>
+</form>
 <form action="/editor/?action=upload" method="post" enctype="multipart/form-data">
 	<fieldset>
 		<a href=/editor/all.zip>Download entire the site</a><br>
+		<a href=/editor/tree.zip>Download entire the site as a tree for version control</a><br>
 		<label>Upload entire the site: <input type="file" name="file" value=""></label><br>
+		{{template "importMode"}}
+		<input type="submit" value="Submit">
+	</fieldset>
+</form>
+<form action="/editor/?action=wxr" method="post" enctype="multipart/form-data">
+	<fieldset>
+		<legend>Import of a WordPress site</legend>
+		<label>Export file of WordPress or a zip archive with it and the uploaded files: <input type="file" name="file" value=""></label><br>
+		<input type="hidden" name="mode" value="merge">
+		<input type="submit" value="Submit">
+	</fieldset>
+</form>
+{{with .GetSnapshots}}
+<fieldset>
+	<legend>Snapshots taken before imports</legend>
+	{{range .}}
+	<form action="/editor/snapshot?id={{.Data.Name}}" method="post">
+		<a href="/editor/snapshot?id={{.Data.Name}}">{{.Data.Name}}</a> {{.Data.Caption}}
+		<input type="submit" value="Restore">
+	</form>
+	{{end}}
+</fieldset>
+{{end}}
+{{with .GetLimits}}
+<form action="/editor/?action=limits" method="post">
+	<fieldset>
+		<legend>Limits of imported archives</legend>
+		<label>Total size, MB: <input type="text" name="total" value="{{.TotalMB}}"></label><br>
+		<label>Size of an entry, MB: <input type="text" name="entry" value="{{.EntryMB}}"></label><br>
+		<label>Compression ratio: <input type="text" name="ratio" value="{{.Ratio}}"></label><br>
+		<label>Number of entries: <input type="text" name="entries" value="{{.Entries}}"></label><br>
 		<input type="submit" value="Submit">
 	</fieldset>
 </form>
+{{end}}
+<form action="/editor/?action=token" method="post">
+	<fieldset>
+		<legend>Token of API for scmsctl</legend>
+		{{with .GetToken}}<input type="text" value="{{.}}" size=44 readonly><br>{{else}}API is disabled<br>{{end}}
+		<input type="submit" value="Generate">
+	</fieldset>
+</form>
 <br>
 <a href="/logout">Logout</a><br>	
 </body>
 </html>
-`))
+` + importModeTemplate))
 
 func editorHandler(w http.ResponseWriter, r *http.Request) {
 	c := appengine.NewContext(r)
@@ -47,34 +94,37 @@ func editorHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	if r.Method == "GET" {
-		w.Header().Set("Content-Type", "multipart/form-data; charset=utf-8")
 		switch r.URL.Path {
 		case "/editor/files.zip":
-			exportFiles(c, w)
+			serveExport(c, w, "files", exportFiles)
 			return
 		case "/editor/pages.zip":
-			if err := exportPages(c, w); err != nil {
-				errorX(c, w, err)
-			}
+			serveExport(c, w, "pages", exportPages)
 			return
 		case "/editor/groups.zip":
-			if err := exportGroups(c, w); err != nil {
-				errorX(c, w, err)
-			}
+			serveExport(c, w, "groups", exportGroups)
 			return
 		case "/editor/all.zip":
-			if err := exportAll(c, w); err != nil {
-				errorX(c, w, err)
-			}
+			serveExport(c, w, "all", exportAll)
+			return
+		case "/editor/tree.zip":
+			serveExport(c, w, "tree", exportTree)
+			return
+		case "/editor/groups.csv":
+			serveCSV(c, w, r.FormValue("group"))
+			return
+		case "/editor/markdown.zip":
+			serveMarkdown(c, w, r.FormValue("group"))
 			return
 		default:
-			if err := exportFile(c, w, r.URL.Path[1:]); err == nil {
+			if err := exportFile(c, w, r, r.URL.Path[1:], false); err == nil {
 				return
 			}
 		}
 
 		var data Context
 		data.ctx = c
+		data.draft = true
 		w.Header().Set("Content-Type", "text/html; charset=utf-8")
 		if err := editorTemplate.Execute(w, &data); err != nil {
 			errorX(c, w, err)
@@ -84,17 +134,29 @@ func editorHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != "POST" {
 		error404(w, r)
 	}
-	if r.FormValue("action") == "upload" {
-		file, _, err := r.FormFile("file")
-		if err != nil {
+	if r.FormValue("action") == "publish" {
+		if err := publish(c); err != nil {
 			errorX(c, w, err)
-			c.Errorf("can't get an archive with imported site: %q", err)
 			return
 		}
-		if n, err := file.Seek(0, os.SEEK_END); err != nil {
+		invalidate(c)
+	} else if r.FormValue("action") == "upload" {
+		if err := previewImport(c, w, r, "all", "/editor"); err != nil {
+			errorX(c, w, err)
+		}
+		return
+	} else if r.FormValue("action") == "wxr" {
+		if err := previewImport(c, w, r, "wxr", "/editor"); err != nil {
+			errorX(c, w, err)
+		}
+		return
+	} else if r.FormValue("action") == "limits" {
+		if err := setLimits(c, r); err != nil {
 			errorX(c, w, err)
 			return
-		} else if err := importAll(c, file, n); err != nil {
+		}
+	} else if r.FormValue("action") == "token" {
+		if err := newToken(c); err != nil {
 			errorX(c, w, err)
 			return
 		}
@@ -102,7 +164,30 @@ func editorHandler(w http.ResponseWriter, r *http.Request) {
 	http.Redirect(w, r, "/editor", http.StatusFound)
 }
 
-var funcMap = template.FuncMap{"Type": isType, "EqualString": equalString}
+var funcMap = template.FuncMap{
+	"Type":        isType,
+	"EqualString": equalString,
+	"FormatTime":  formatTime,
+	"FormatSize":  formatSize,
+	"ImageURL":    imageURL,
+}
+
+func formatSize(n int64) string {
+	switch {
+	case n >= 1<<20:
+		return fmt.Sprintf("%.1f MB", float64(n)/(1<<20))
+	case n >= 1<<10:
+		return fmt.Sprintf("%.1f KB", float64(n)/(1<<10))
+	}
+	return fmt.Sprintf("%d bytes", n)
+}
+
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.Format("2006-01-02 15:04:05")
+}
 
 func equalString(i1 interface{}, i2 interface{}) (bool, error) {
 	s1, ok := i1.(string)
@@ -135,77 +220,117 @@ func isType(t interface{}, s string) (bool, error) {
 }
 
 func exportAll(c appengine.Context, w io.Writer) error {
-	b := bytes.NewBuffer(nil)
-	z := zip.NewWriter(b)
-	if wz, err := z.Create("files.zip"); err != nil {
+	m, err := newManifest(c)
+	if err != nil {
 		return err
-	} else {
-		exportFiles(c, wz)
 	}
-	if wz, err := z.Create("pages.zip"); err != nil {
+	z := zip.NewWriter(w)
+	for _, v := range []struct {
+		name   string
+		kind   string
+		export func(appengine.Context, io.Writer) error
+	}{{"files.zip", "$Files", exportFiles}, {"pages.zip", "$Pages", exportPages}, {"groups.zip", "$Groups", func(c appengine.Context, w io.Writer) error {
+		return writeGroups(c, w, m.Groups)
+	}}} {
+		n, err := datastore.NewQuery(v.kind).KeysOnly().Count(c)
+		if err != nil {
+			return err
+		}
+		wz, err := z.Create(v.name)
+		if err != nil {
+			return err
+		}
+		s := newSectionWriter(wz)
+		if err := v.export(c, s); err != nil {
+			return err
+		}
+		m.section(v.name, s, n)
+	}
+	if j, err := json.MarshalIndent(m, "", "\t"); err != nil {
+		return err
+	} else if wz, err := z.Create("manifest.json"); err != nil {
+		return err
+	} else if _, err := wz.Write(j); err != nil {
 		return err
-	} else {
-		exportPages(c, wz)
 	}
-	if wz, err := z.Create("groups.zip"); err != nil {
+	return z.Close()
+}
+
+// parseConfig sets the default page of the site s from "config" entry f of
+// archives made before manifests.
+func parseConfig(c appengine.Context, f *zip.File, s *site) error {
+	d, err := readEntry(f)
+	if err != nil {
 		return err
-	} else {
-		exportGroups(c, wz)
 	}
-	z.Close()
-	if _, err := w.Write(b.Bytes()); err != nil {
+	var cfg config
+	if err := json.Unmarshal(d, &cfg); err != nil {
+		c.Errorf("json can't unmarshal: %q", err)
 		return err
 	}
+	s.config = new(Config)
+	if len(cfg.Default) != 0 {
+		if s.config.Default, err = cfg.Default.key(c); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
-func importAll(c appengine.Context, file io.ReaderAt, size int64) error {
-	r, err := zip.NewReader(file, size)
+// parseAll adds all sections of an archive of the entire site to the site s.
+func parseAll(c appengine.Context, a *archive, s *site) error {
+	if t := a.unwrap(); t != nil && isTree(t) {
+		a = t
+	}
+	m, err := readManifest(a)
 	if err != nil {
 		return err
 	}
-	for _, v := range r.File {
+	s.manifest = m
+	if isTree(a) {
+		if err := parseTree(c, a, s); err != nil {
+			return err
+		}
+		return m.verifyCounts(a, s)
+	}
+	for _, v := range a.files {
 		if v.UncompressedSize == 0 {
 			continue
 		}
-		c.Infof("importing %q", v.Name)
-		d := make(customReaderAt, v.UncompressedSize)
-		if rc, err := v.Open(); err != nil {
-			return err
-		} else if _, err := io.ReadFull(rc, d); err != nil {
-			c.Errorf("reading of file has failed: %q", err)
-			return err
-		} else {
-			rc.Close()
-		}
+		var parse func(appengine.Context, *archive, *site) error
 		switch v.Name {
-		case "files.zip":
-			if err := importFiles(c, d, int64(len(d))); err != nil {
+		case "manifest.json":
+			continue
+		case "config":
+			if err := parseConfig(c, v, s); err != nil {
 				return err
 			}
+			continue
+		case "files.zip":
+			parse = parseFiles
 		case "pages.zip":
-			if err := importPages(c, d, int64(len(d))); err != nil {
-				return err
-			}
+			parse = parsePages
 		case "groups.zip":
-			if err := importGroups(c, d, int64(len(d))); err != nil {
-				return err
-			}
+			parse = parseGroups
+		default:
+			a.reject(v.Name, "unknown entry")
+			continue
+		}
+		if err := m.verifySection(v); err != nil {
+			return err
+		}
+		c.Infof("parsing %q", v.Name)
+		n, err := a.nested(v)
+		if err != nil {
+			c.Errorf("reading of file has failed: %q", err)
+			return err
+		}
+		if n == nil {
+			continue
+		}
+		if err := parse(c, n, s); err != nil {
+			return err
 		}
-
-	}
-	return nil
-}
-
-type customReaderAt []byte
-
-func (this customReaderAt) ReadAt(p []byte, off int64) (n int, err error) {
-	if off > int64(len(this)) {
-		return 0, io.EOF
-	}
-	n = copy(p, this[off:])
-	if n < len(p) {
-		return n, io.EOF
 	}
-	return n, nil
+	return m.verifyCounts(a, s)
 }
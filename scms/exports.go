@@ -0,0 +1,60 @@
+// Copyright (c) 2012 Alexander Sychev. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package scms
+
+import (
+	"appengine"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Archives are streamed to a client as they are made. An error found before
+// anything is written is reported as usual, after that the archive is left
+// without its central directory, so the client sees a broken archive rather
+// than a valid truncated one.
+
+// exportWriter is a response writer that knows if anything is written.
+type exportWriter struct {
+	http.ResponseWriter
+	written bool
+}
+
+func (this *exportWriter) Write(p []byte) (int, error) {
+	if len(p) != 0 {
+		this.written = true
+	}
+	return this.ResponseWriter.Write(p)
+}
+
+// exportName returns a file name of an exported section, e.g. "app-pages-20121231.zip".
+func exportName(c appengine.Context, section string) string {
+	app := strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_' {
+			return r
+		}
+		return '-'
+	}, appengine.AppID(c))
+	return app + "-" + section + "-" + time.Now().UTC().Format("20060102") + ".zip"
+}
+
+// serveExport streams an archive of section made by export.
+func serveExport(c appengine.Context, w http.ResponseWriter, section string, export func(appengine.Context, io.Writer) error) {
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", `attachment; filename="`+exportName(c, section)+`"`)
+	w.Header().Set("Cache-Control", "no-cache")
+	ew := &exportWriter{ResponseWriter: w}
+	c.Infof("exporting %q", section)
+	if err := export(c, ew); err != nil {
+		if !ew.written {
+			w.Header().Del("Content-Disposition")
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			errorX(c, w, err)
+			return
+		}
+		c.Errorf("export of %q has failed: %v", section, err)
+	}
+}
@@ -9,8 +9,14 @@ import (
 	"html/template"
 	"os"
 	"io"
-	"bytes"
 	"fmt"
+	"encoding/json"
+	"mime"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+	"crypto/sha1"
 	"archive/zip"
 	"appengine"
 	"appengine/datastore"
@@ -18,50 +24,126 @@ import (
 )
 
 type File struct {
-	Name string
-	Data []byte
+	Name        string
+	Data        []byte
+	ContentType string
+	Hash        string
+	Uploaded    time.Time
+	Size        int64
+	Chunks      int64
+	Uploader    string
+	Alt         string
+	Caption     string `datastore:",noindex"`
+	Credit      string
 }
 
-var filesTemplate = template.Must(template.New("files").Parse(
+// fileInfo is metadata of a file kept in "$Files" entry of files.zip.
+type fileInfo struct {
+	Name        string
+	ContentType string `json:",omitempty"`
+	Hash        string
+	Size        int64
+	Uploaded    time.Time
+	Uploader    string `json:",omitempty"`
+	Alt         string `json:",omitempty"`
+	Caption     string `json:",omitempty"`
+	Credit      string `json:",omitempty"`
+}
+
+// setData sets the content of the file along with its hash and upload time.
+func (this *File) setData(d []byte) {
+	h := sha1.New()
+	h.Write(d)
+	this.Data = d
+	this.Hash = fmt.Sprintf("%x", h.Sum(nil))
+	this.Size = int64(len(d))
+	this.Uploaded = time.Now()
+}
+
+var filesTemplate = template.Must(template.New("files").Funcs(funcMap).Parse(
 	`
 <html>
 <body>
 <a href="/">Main</a><br>
 <a href="/editor">Editor</a><br>
+<a href="/editor/media">Media library</a><br>
 <a href="/logout">Logout</a><br>
-{{$cursor :=.Get "$Files" "Name" "" 0 0}}
+{{$sort := .GetOrder "Name"}}
+{{$path := .GetValue "folder"}}
+{{$folder := .GetFolder $path $sort}}
 <form action="/editor/files" method="post" enctype="multipart/form-data">
 	<fieldset>
 		<legend>New file</legend>
-		<label>Name of file:<br><input type="text" name="name" value=""></label><br>
+		<input type="hidden" name="folder" value="{{$folder.Path}}">
+		<label>Name of file in folder "/{{$folder.Path}}":<br><input type="text" name="name" value=""></label><br>
+		<label>Content type (detected if empty):<br><input type="text" name="type" value=""></label><br>
+		<label><input type="checkbox" name="minify" value="true"> Minify CSS or HTML</label><br>
 		<label>New file:<br><input type="file" name="file" value=""></label><br>
 		<input type="submit" value="Submit">
 	</fieldset>
 </form>
 <form action="/editor/files?action=upload" method="post" enctype="multipart/form-data">
 	<fieldset>
-	{{if $cursor.Len}}
+	{{if $folder.Total}}
 		<a href=/editor/files.zip>Download all files</a><br>
 	{{end}}
 		<label>Upload files: <input type="file" name="file" value=""></label><br>
+		{{template "importMode"}}
 		<input type="submit" value="Submit">
 	</fieldset>
 </form>
-{{range $cursor}}
+<fieldset>
+	<legend>Folder "/{{$folder.Path}}"</legend>
+	<a href="/editor/files?sort={{$sort}}">/</a>
+	{{range $folder.Parents}}<a href="/editor/files?folder={{.Path}}&sort={{$sort}}">{{.Name}}</a>/{{end}}
+	{{if $folder.Path}}{{$folder.Name}}{{end}}<br>
+	{{range $folder.Folders}}
+		<a href="/editor/files?folder={{.Path}}&sort={{$sort}}">{{.Name}}/</a><br>
+	{{end}}
+	{{if $folder.Path}}
+	<form action="/editor/files?action=move" method="post">
+		<input type="hidden" name="folder" value="{{$folder.Path}}">
+		<label>Move or rename the folder to: <input type="text" name="newname" value="{{$folder.Path}}" size=60></label>
+		<input type="submit" value="Move">
+	</form>
+	{{end}}
+</fieldset>
+Sort by:
+<a href="/editor/files?folder={{$folder.Path}}&sort=Name">name</a>
+<a href="/editor/files?folder={{$folder.Path}}&sort=-Size">size</a>
+<a href="/editor/files?folder={{$folder.Path}}&sort=-Uploaded">upload time</a>
+<a href="/editor/files?folder={{$folder.Path}}&sort=Uploader">uploader</a>
+<a href="/editor/files?folder={{$folder.Path}}&sort=ContentType">content type</a>
+<br>
+{{range $folder.Files}}
 <form action="/editor/files?id={{.Key.Encode}}" method="post" enctype="multipart/form-data">
 	<fieldset>
 		<legend>File "{{.Data.Name}}"</legend>
+		<input type="hidden" name="folder" value="{{$folder.Path}}">
 		<a href=/{{.Data.Name}}>Download file '{{.Data.Name}}'</a><br>
+		<a href="/editor/history?id={{.Key.Encode}}">History</a><br>
+		{{with .Data.Size}}Size: {{FormatSize .}}<br>{{end}}
+		{{with .Data.Uploaded}}Uploaded: {{FormatTime .}}<br>{{end}}
+		{{with .Data.Uploader}}Uploader: {{.}}<br>{{end}}
+		{{with .Data.Hash}}SHA-1: {{.}}<br>{{end}}
+		{{with .Data.Alt}}Alt text: {{.}}<br>{{end}}
 		<label>Upload new file "{{.Data.Name}}": <input type="file" name="file" value=""></label><br>
+		<label>Content type (detected if empty): <input type="text" name="type" value="{{with .Data.ContentType}}{{.}}{{end}}"></label><br>
+		<label><input type="checkbox" name="minify" value="true"> Minify CSS or HTML</label><br>
 	<input type="submit" value="Submit">
 	<input type="reset" value="Reset">
 	<input type="button" value="Delete">
 	</fieldset>
 </form>
+<form action="/editor/files?id={{.Key.Encode}}&action=rename" method="post">
+	<input type="hidden" name="folder" value="{{$folder.Path}}">
+	<label>Move or rename "{{.Data.Name}}" to: <input type="text" name="newname" value="{{.Data.Name}}" size=60></label>
+	<input type="submit" value="Move">
+</form>
 {{end}}
 </body>
 </html>
-`))
+` + importModeTemplate))
 
 func filesHandler(w http.ResponseWriter, r *http.Request) {
 	c := appengine.NewContext(r)
@@ -81,6 +163,7 @@ func filesHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method == "GET" {
 		var data Context
 		data.ctx = c
+		data.draft = true
 		w.Header().Set("Content-Type", "text/html; charset=utf-8")
 		if err := filesTemplate.Execute(w, &data); err != nil {
 			errorX(c, w, err)
@@ -91,19 +174,21 @@ func filesHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	if r.FormValue("action") == "upload" {
-		file, _, err := r.FormFile("file")
-		if err != nil {
+		if err := previewImport(c, w, r, "files", r.URL.Path); err != nil {
 			errorX(c, w, err)
-			c.Errorf("can't get an archive with imported files: %q", err)
-			return
 		}
-		if n, err := file.Seek(0, os.SEEK_END); err != nil {
+		return
+	} else if r.FormValue("action") == "rename" && key != nil {
+		if err := renameFile(c, key, r.FormValue("newname")); err != nil {
 			errorX(c, w, err)
 			return
-		} else if err := importFiles(c, file, n); err != nil {
+		}
+	} else if r.FormValue("action") == "move" {
+		if err := moveFolder(c, r.FormValue("folder"), r.FormValue("newname")); err != nil {
 			errorX(c, w, err)
 			return
 		}
+		r.Form.Set("folder", r.FormValue("newname"))
 	} else if def := r.FormValue("default"); len(def) != 0 {
 		if err := setDefault(c, r, def); err != nil {
 			errorX(c, w, err)
@@ -120,135 +205,243 @@ func filesHandler(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 	}
-	createHandlers(c)
+	invalidate(c)
+	if folder := cleanName(r.FormValue("folder")); len(folder) != 0 {
+		http.Redirect(w, r, r.URL.Path+"?folder="+url.QueryEscape(folder), http.StatusFound)
+		return
+	}
 	http.Redirect(w, r, r.URL.Path, http.StatusFound)
 }
 
+// checkFileName returns an error if name can't be a name of a file. "$Files"
+// is reserved for metadata of files in files.zip.
+func checkFileName(name string) error {
+	if len(name) == 0 {
+		return &scmsError{"field 'Name' must not be empty"}
+	}
+	if name == "$Files" {
+		return &scmsError{"name '$Files' is reserved"}
+	}
+	return nil
+}
+
 func newFile(c appengine.Context, r *http.Request) error {
 	c.Infof("newFile: %#v", r)
-	name := r.FormValue("name")
+	name := cleanName(r.FormValue("name"))
 	if len(name) == 0 {
 		return &scmsError{"field 'Name' must not be empty"}
 	}
+	name = path.Join(cleanName(r.FormValue("folder")), name)
+	if err := checkFileName(name); err != nil {
+		return err
+	}
 	file, _, err := r.FormFile("file")
 	if err != nil {
 		c.Errorf("can't get template file: %q", err)
 		return err
 	}
 	f := File{
-		Name: name,
+		Name:        name,
+		ContentType: r.FormValue("type"),
 	}
 	if n, err := file.Seek(0, os.SEEK_END); err != nil {
 		return err
-	} else if n >= 0x100000 {
-		return &scmsError{"file is too long"}
-	} else {
-		f.Data = make([]byte, n)
-	}
-	if _, err = file.ReadAt(f.Data, 0); err != nil {
+	} else if err := f.setContent(c, sectionOpener(file, n), n); err != nil {
 		return err
 	}
+	if len(r.FormValue("minify")) != 0 && f.Chunks == 0 {
+		u := f.Uploader
+		f.setData(minify(f.Name, f.Data))
+		f.Uploader = u
+	}
 	key := datastore.NewKey(c, "$Files", f.Name, 0, nil)
 	c.Infof("new key: %#v", key)
-	if _, err := datastore.Put(c, key, &f); err != nil {
-		return err
-	}
-	return nil
+	return putDraft(c, key, &f)
 }
 
 func editFile(c appengine.Context, r *http.Request, k *datastore.Key) error {
-	file, _, err := r.FormFile("file")
-	if err != nil {
-		return nil
-	}
 	var f File
-	if err := datastore.Get(c, k, &f); err != nil {
+	if err := getDraft(c, k, &f); err != nil {
 		return err
 	}
+	f.ContentType = r.FormValue("type")
+	file, _, err := r.FormFile("file")
+	if err != nil {
+		return putDraft(c, k, &f)
+	}
 	if n, err := file.Seek(0, os.SEEK_END); err != nil {
 		return err
-	} else if n >= 0x100000 {
-		return &scmsError{"file is too long"}
-	} else {
-		f.Data = make([]byte, n)
-	}
-	_, err = file.ReadAt(f.Data, 0)
-	if err != nil {
+	} else if err := f.setContent(c, sectionOpener(file, n), n); err != nil {
 		return err
 	}
-	if _, err := datastore.Put(c, k, &f); err != nil {
-		return err
+	if len(r.FormValue("minify")) != 0 && f.Chunks == 0 {
+		u := f.Uploader
+		f.setData(minify(f.Name, f.Data))
+		f.Uploader = u
 	}
-	return nil
+	return putDraft(c, k, &f)
 }
 
-func exportFile(c appengine.Context, w http.ResponseWriter, fn string) error {
+// contentType returns the content type of the file specified by the editor
+// or detected by its extension and content.
+func (this *File) contentType(c appengine.Context) string {
+	if len(this.ContentType) != 0 {
+		return this.ContentType
+	}
+	if t := mime.TypeByExtension(path.Ext(this.Name)); len(t) != 0 {
+		return t
+	}
+	b := make([]byte, 512)
+	n, _ := io.ReadFull(this.reader(c), b)
+	return http.DetectContentType(b[:n])
+}
+
+func exportFile(c appengine.Context, w http.ResponseWriter, r *http.Request, fn string, draft bool) error {
+	if !draft && strings.HasPrefix(fn, assetsPrefix) {
+		return exportAsset(c, w, r, fn)
+	}
 	var f File
 	c.Infof("exporting file %q", fn)
-	if err := datastore.Get(c, datastore.NewKey(c, "$Files", fn, 0, nil), &f); err != nil {
+	if err := getEntity(c, datastore.NewKey(c, "$Files", fn, 0, nil), &f, draft); err != nil {
 		c.Errorf("file %q not found: %q", fn, err)
 		return err
 	}
-	w.Header().Set("Content-Type", "multipart/form-data; charset=utf-8")
-	if _, err := w.Write(f.Data); err != nil {
-		return err
+	if len(f.Hash) == 0 {
+		u := f.Uploaded
+		f.setData(f.Data)
+		f.Uploaded = u
+	}
+	ct := f.contentType(c)
+	if strings.HasPrefix(ct, "image/") {
+		if p, ok, err := parseImageParams(r.URL.Query()); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return nil
+		} else if ok {
+			if err := serveImage(c, w, r, &f, p, draft || user.IsAdmin(c) || signed(c, r, fn, p)); err != nil {
+				c.Errorf("can't serve image %q: %v", fn, err)
+				if _, bad := err.(*badImage); bad {
+					http.Error(w, err.Error(), http.StatusBadRequest)
+				} else {
+					http.Error(w, err.Error(), http.StatusInternalServerError)
+				}
+			}
+			return nil
+		}
+	}
+	h := w.Header()
+	h.Set("Content-Type", ct)
+	gz := negotiateGzip(w, r, &f, ct)
+	etag := `"` + f.Hash + `"`
+	if gz {
+		etag = `"` + f.Hash + `-gzip"`
+	}
+	h.Set("ETag", etag)
+	if draft {
+		h.Set("Cache-Control", "no-cache")
+	} else {
+		h.Set("Cache-Control", "public, max-age=60")
+	}
+	if m := r.Header.Get("If-None-Match"); len(m) != 0 {
+		for _, v := range strings.Split(m, ",") {
+			if v = strings.TrimSpace(v); v == etag || v == "*" {
+				w.WriteHeader(http.StatusNotModified)
+				return nil
+			}
+		}
+	}
+	if gz {
+		return serveGzipped(c, w, r, &f)
 	}
+	http.ServeContent(w, r, f.Name, f.Uploaded, f.reader(c))
 	return nil
 }
 
 func exportFiles(c appengine.Context, w io.Writer) error {
-	q := datastore.NewQuery("$Files")
-	var f []File
-	if _, err := q.GetAll(c, &f); err != nil {
-		return err
-	}
-	b := bytes.NewBuffer(nil)
-	z := zip.NewWriter(b)
-	for _, v := range f {
+	z := zip.NewWriter(w)
+	var info []fileInfo
+	dirs := make(map[string]bool)
+	for t := datastore.NewQuery("$Files").Run(c); ; {
+		var v File
+		if _, err := t.Next(&v); err == datastore.Done {
+			break
+		} else if err != nil {
+			return err
+		}
 		//c.Infof("packing file: %q", v)
-		if zw, err := z.Create(v.Name); err != nil {
+		if err := checkFileName(v.Name); err != nil {
+			return fmt.Errorf("file %q must be renamed before export: %v", v.Name, err)
+		}
+		for _, d := range parentFolders(v.Name) {
+			if dirs[d] {
+				continue
+			}
+			dirs[d] = true
+			if _, err := z.Create(d + "/"); err != nil {
+				return err
+			}
+		}
+		fh := &zip.FileHeader{
+			Name:   v.Name,
+			Method: zip.Deflate,
+		}
+		fh.SetModTime(v.Uploaded)
+		if zw, err := z.CreateHeader(fh); err != nil {
 			return err
-		} else if _, err := zw.Write(v.Data); err != nil {
+		} else if _, err := io.Copy(zw, v.reader(c)); err != nil {
 			return err
 		}
+		info = append(info, fileInfo{v.Name, v.ContentType, v.Hash, v.Size, v.Uploaded, v.Uploader, v.Alt, v.Caption, v.Credit})
 	}
-	z.Close()
-	if _, err := w.Write(b.Bytes()); err != nil {
+	j, err := json.MarshalIndent(info, "", "\t")
+	if err != nil {
 		return err
 	}
-	return nil
-}
-
-func importFiles(c appengine.Context, file io.ReaderAt, size int64) error {
-	r, err := zip.NewReader(file, size)
-	if err != nil {
+	if zw, err := z.Create("$Files"); err != nil {
+		return err
+	} else if _, err := zw.Write(j); err != nil {
 		return err
 	}
-	for _, v := range r.File {
-		if v.UncompressedSize == 0 {
+	return z.Close()
+}
+
+// parseFiles adds files of an archive to the site s.
+func parseFiles(c appengine.Context, a *archive, s *site) error {
+	s.sections["$Files"] = true
+	info := make(map[string]fileInfo)
+	for _, v := range a.files {
+		if v.Name != "$Files" {
 			continue
 		}
-		if v.UncompressedSize >= 0x100000 {
-			return fmt.Errorf("file '%q' is too long", v.Name)
-		}
-		f := File{
-			Name: v.Name,
-			Data: make([]byte, v.UncompressedSize),
-		}
-		if rc, err := v.Open(); err != nil {
+		d, err := readEntry(v)
+		if err != nil {
 			return err
-		} else if _, err := io.ReadFull(rc, f.Data); err != nil {
-			c.Errorf("reading of file has failed: %q", err)
+		}
+		var fi []fileInfo
+		if err := json.Unmarshal(d, &fi); err != nil {
+			c.Errorf("json can't unmarshal: %q", err)
 			return err
-		} else {
-			rc.Close()
 		}
-
-		key := datastore.NewKey(c, "$Files", f.Name, 0, nil)
-		if _, err := datastore.Put(c, key, &f); err != nil {
+		for _, i := range fi {
+			info[cleanName(i.Name)] = i
+		}
+	}
+	for _, v := range a.files {
+		if v.Name == "$Files" {
+			continue
+		}
+		name := cleanName(v.Name)
+		if len(name) == 0 {
+			continue
+		}
+		i := info[name]
+		i.Name = name
+		i.Size = int64(v.UncompressedSize)
+		var err error
+		if i.Hash, err = entryHash(v); err != nil {
+			c.Errorf("reading of file has failed: %q", err)
 			return err
 		}
+		s.files = append(s.files, importedFile{i, v})
 	}
-
 	return nil
 }
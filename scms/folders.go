@@ -0,0 +1,193 @@
+// Copyright (c) 2012 Alexander Sychev. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package scms
+
+import (
+	"appengine"
+	"appengine/datastore"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+)
+
+// Folder is a level of the hierarchy of "$Files" formed by slashes in names of files.
+type Folder struct {
+	Path    string
+	Name    string
+	Parents []Folder
+	Folders []Folder
+	Files   Cursor
+	Total   int
+}
+
+type folders []Folder
+
+func (this folders) Len() int {
+	return len(this)
+}
+
+func (this folders) Swap(i, j int) {
+	this[i], this[j] = this[j], this[i]
+}
+
+func (this folders) Less(i, j int) bool {
+	return this[i].Name < this[j].Name
+}
+
+// cleanName returns a name of a file without leading, trailing and repeated slashes
+// and without "." and ".." elements.
+func cleanName(n string) string {
+	return path.Clean("/" + strings.Replace(n, "\\", "/", -1))[1:]
+}
+
+// parentFolders returns all folders containing the file n, the outer first.
+func parentFolders(n string) []string {
+	var out []string
+	for d := path.Dir(n); d != "." && d != "/"; d = path.Dir(d) {
+		out = append([]string{d}, out...)
+	}
+	return out
+}
+
+func (this *Context) GetFolder(p interface{}, o interface{}) (Folder, error) {
+	var out Folder
+	if this.ctx == nil {
+		return out, &scmsError{"invalid context"}
+	}
+	dir, ok := p.(string)
+	if !ok {
+		return out, fmt.Errorf("GetFolder: unexpected type of 'path': %T, must be string", p)
+	}
+	order, ok := o.(string)
+	if !ok {
+		return out, fmt.Errorf("GetFolder: unexpected type of 'order': %T, must be string", o)
+	}
+	dir = cleanName(dir)
+	// files stored before their attributes were added lack the ordered
+	// fields, so they are sorted here rather than by the datastore
+	cur, err := this.Get("$Files", "", "", 0, 0)
+	if err != nil {
+		return out, err
+	}
+	if len(order) != 0 {
+		sort.Sort(byField{cur, order})
+	}
+	out.Path = dir
+	out.Name = path.Base(dir)
+	out.Total = len(cur)
+	prefix := ""
+	if len(dir) != 0 {
+		prefix = dir + "/"
+		for _, v := range parentFolders(prefix) {
+			out.Parents = append(out.Parents, Folder{Path: v, Name: path.Base(v)})
+		}
+	}
+	seen := make(map[string]bool)
+	for _, v := range cur {
+		name, _ := v.Data["Name"].(string)
+		if !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		rest := name[len(prefix):]
+		if i := strings.Index(rest, "/"); i >= 0 {
+			if sub := rest[:i]; !seen[sub] {
+				seen[sub] = true
+				out.Folders = append(out.Folders, Folder{Path: prefix + sub, Name: sub})
+			}
+			continue
+		}
+		out.Files = append(out.Files, v)
+	}
+	sort.Sort(folders(out.Folders))
+	return out, nil
+}
+
+func (this *Value) GetFolder(p interface{}, order interface{}) (Folder, error) {
+	return this.ctx.GetFolder(p, order)
+}
+
+// renameFile moves the draft of a file to a new name and updates pages using the file.
+func renameFile(c appengine.Context, k *datastore.Key, name string) error {
+	name = cleanName(name)
+	if err := checkFileName(name); err != nil {
+		return err
+	}
+	old := k.StringID()
+	if name == old {
+		return nil
+	}
+	var f File
+	nk := datastore.NewKey(c, "$Files", name, 0, nil)
+	if err := getDraft(c, nk, &f); err == nil {
+		return fmt.Errorf("file %q already exists", name)
+	} else if err != datastore.ErrNoSuchEntity {
+		return err
+	}
+	if err := getDraft(c, k, &f); err != nil {
+		return err
+	}
+	c.Infof("renaming file %q to %q", old, name)
+	f.Name = name
+	if err := putDraft(c, nk, &f); err != nil {
+		return err
+	}
+	if err := deleteDraft(c, k); err != nil {
+		return err
+	}
+	ctx := Context{ctx: c, draft: true}
+	cur, err := ctx.Get("$Pages", "", "", 0, 0)
+	if err != nil {
+		return err
+	}
+	for _, v := range cur {
+		if v.Data["Base"] != old && v.Data["Template"] != old {
+			continue
+		}
+		var p Page
+		if err := getDraft(c, v.Key, &p); err != nil {
+			return err
+		}
+		if p.Base == old {
+			p.Base = name
+		}
+		if p.Template == old {
+			p.Template = name
+		}
+		if err := putDraft(c, v.Key, &p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// moveFolder renames all files of folder from to be in folder to.
+func moveFolder(c appengine.Context, from string, to string) error {
+	from, to = cleanName(from), cleanName(to)
+	if len(from) == 0 || len(to) == 0 {
+		return &scmsError{"folder must not be empty"}
+	}
+	if from == to {
+		return nil
+	}
+	if strings.HasPrefix(to+"/", from+"/") {
+		return fmt.Errorf("folder %q can't be moved into itself", from)
+	}
+	ctx := Context{ctx: c, draft: true}
+	cur, err := ctx.Get("$Files", "", "", 0, 0)
+	if err != nil {
+		return err
+	}
+	for _, v := range cur {
+		name, _ := v.Data["Name"].(string)
+		if !strings.HasPrefix(name, from+"/") {
+			continue
+		}
+		if err := renameFile(c, v.Key, to+name[len(from):]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -6,8 +6,11 @@ package scms
 
 import (
 	"fmt"
+	"sort"
 	"strconv"
+	"strings"
 	"net/http"
+	"time"
 	"appengine"
 	"appengine/datastore"
 )
@@ -19,7 +22,12 @@ type entity struct {
 }
 
 type Context struct {
-	ctx appengine.Context
+	ctx   appengine.Context
+	meta  *Meta
+	draft bool
+	// public contexts show records within their schedules only, exports and
+	// counts read all of them
+	public bool
 }
 
 type Value struct {
@@ -31,6 +39,54 @@ type Value struct {
 
 type Cursor []Value
 
+type byField struct {
+	c     Cursor
+	order string
+}
+
+func (this byField) Len() int {
+	return len(this.c)
+}
+
+func (this byField) Swap(i, j int) {
+	this.c[i], this.c[j] = this.c[j], this.c[i]
+}
+
+func (this byField) Less(i, j int) bool {
+	name := this.order
+	desc := len(name) != 0 && name[0] == '-'
+	if desc {
+		name = name[1:]
+	}
+	a, b := this.c[i].Data[name], this.c[j].Data[name]
+	if desc {
+		a, b = b, a
+	}
+	// records without the field, like files stored before it was added, go
+	// first
+	if a == nil {
+		return b != nil
+	}
+	switch a.(type) {
+	case string:
+		s, ok := b.(string)
+		return ok && a.(string) < s
+	case int64:
+		n, ok := b.(int64)
+		return ok && a.(int64) < n
+	case float64:
+		f, ok := b.(float64)
+		return ok && a.(float64) < f
+	case time.Time:
+		t, ok := b.(time.Time)
+		return ok && a.(time.Time).Before(t)
+	case bool:
+		v, ok := b.(bool)
+		return ok && !a.(bool) && v
+	}
+	return false
+}
+
 type Paging struct {
 	Number string
 	Query  string
@@ -115,23 +171,45 @@ func (this *Context) Get(k interface{}, o interface{}, p interface{}, off interf
 		parent = p.(*datastore.Key)
 	}
 	this.ctx.Infof("kind: %q; order: %q; parent %q; offset: %q; limit: %q", k, order, p, offset, limit)
+	if !this.draft {
+		return this.query(kind, order, parent, offset, limit)
+	}
 	q := datastore.NewQuery(kind)
 	if parent != nil {
 		q.Ancestor(parent)
 	}
 
-	q.Offset(offset)
-	if limit != 0 {
-		q.Limit(limit)
-	}
-	if len(order) != 0 {
-		q.Order(order)
-	}
+	// drafts are merged with the published records, so they are sorted and
+	// paged in memory
 	var d []entity
 	keys, err := q.GetAll(this.ctx, &d)
 	if err != nil {
 		return out, err
 	}
+	dk, dd, removed, err := drafts(this.ctx, kind, parent)
+	if err != nil {
+		return out, err
+	}
+	for _, k := range removed {
+		for j, v := range keys {
+			if v.Equal(k) {
+				keys = append(keys[:j], keys[j+1:]...)
+				d = append(d[:j], d[j+1:]...)
+				break
+			}
+		}
+	}
+loop:
+	for i, k := range dk {
+		for j, v := range keys {
+			if v.Equal(k) {
+				d[j] = dd[i]
+				continue loop
+			}
+		}
+		keys = append(keys, k)
+		d = append(d, dd[i])
+	}
 	for i, v := range d {
 		if !keys[i].Parent().Equal(parent) {
 			continue
@@ -140,12 +218,79 @@ func (this *Context) Get(k interface{}, o interface{}, p interface{}, off interf
 			Key:  keys[i],
 			Data: v.data,
 		}
-		val.ctx.ctx = this.ctx
+		val.ctx = *this
+		out = append(out, val)
+	}
+	if len(order) != 0 {
+		sort.Sort(byField{out, order})
+	}
+	return out.page(offset, limit), nil
+}
+
+// query returns published records of kind which are children of parent. The
+// datastore sorts them, so records without the ordered property are skipped.
+// Records of groups are nested and public contexts skip records out of their
+// schedules, so such records are paged while they are read, other kinds are
+// paged by the datastore.
+func (this *Context) query(kind string, order string, parent *datastore.Key, offset int, limit int) (Cursor, error) {
+	var out Cursor
+	q := datastore.NewQuery(kind)
+	if parent != nil {
+		q.Ancestor(parent)
+	}
+	if len(order) != 0 {
+		q.Order(order)
+	}
+	if parent == nil && !this.public && strings.HasPrefix(kind, "$") {
+		q.Offset(offset)
+		if limit > 0 {
+			q.Limit(limit)
+		}
+		offset = 0
+	}
+	now := time.Now()
+	for t := q.Run(this.ctx); ; {
+		var e entity
+		k, err := t.Next(&e)
+		if err == datastore.Done {
+			break
+		} else if err != nil {
+			return out, err
+		}
+		if !k.Parent().Equal(parent) || (this.public && !visible(e.data, now)) {
+			continue
+		}
+		if offset > 0 {
+			offset--
+			continue
+		}
+		val := Value{
+			Key:  k,
+			Data: e.data,
+		}
+		val.ctx = *this
 		out = append(out, val)
+		if limit > 0 && len(out) == limit {
+			break
+		}
 	}
 	return out, nil
 }
 
+// page returns records of the cursor from offset, no more than limit if it is not 0.
+func (this Cursor) page(offset int, limit int) Cursor {
+	if offset >= len(this) {
+		return nil
+	}
+	if offset > 0 {
+		this = this[offset:]
+	}
+	if limit > 0 && limit < len(this) {
+		this = this[:limit]
+	}
+	return this
+}
+
 func (this *Context) GetByKey(k interface{}) (Value, error) {
 	var out Value
 	if this.ctx == nil {
@@ -165,16 +310,19 @@ func (this *Context) GetByKey(k interface{}) (Value, error) {
 		return out, fmt.Errorf("invalid key: %q", k)
 	}
 	var d entity
-	err := datastore.Get(this.ctx, key, &d)
+	err := getEntity(this.ctx, key, &d, this.draft)
 	if err != nil {
 		if err != datastore.ErrNoSuchEntity {
 			return out, err
 		}
 		return out, nil
 	}
+	if this.public && !visible(d.data, time.Now()) {
+		return out, nil
+	}
 	out.Key = key
 	out.Data = d.data
-	out.ctx.ctx = this.ctx
+	out.ctx = *this
 	return out, nil
 }
 
@@ -241,9 +389,7 @@ func (this *Context) GetPages(k interface{}, l interface{}) ([]Paging, error) {
 		default:
 			return nil, fmt.Errorf("unexpected type of 'limit': %T, must ben string or int", l)
 	}
-	q := datastore.NewQuery(kind)
-	q.Run(this.ctx)
-	c, err := q.Count(this.ctx)
+	c, err := this.count(kind)
 	this.ctx.Infof("GetPages: count for %q = %v", kind, c)
 	c /= limit
 	c++
@@ -259,6 +405,56 @@ func (this *Context) GetPages(k interface{}, l interface{}) ([]Paging, error) {
 	return out, nil
 }
 
+// count returns the number of top-level records of kind returned by Get.
+// Records are counted by their keys, public contexts subtract records which
+// are not published at the moment.
+func (this *Context) count(kind string) (int, error) {
+	if this.draft {
+		cur, err := this.Get(kind, "", "", 0, 0)
+		return len(cur), err
+	}
+	q := datastore.NewQuery(kind).KeysOnly()
+	var n int
+	if strings.HasPrefix(kind, "$") {
+		var err error
+		if n, err = q.Count(this.ctx); err != nil {
+			return 0, err
+		}
+	} else {
+		for t := q.Run(this.ctx); ; {
+			k, err := t.Next(nil)
+			if err == datastore.Done {
+				break
+			} else if err != nil {
+				return 0, err
+			}
+			if k.Parent() == nil {
+				n++
+			}
+		}
+	}
+	if !this.public {
+		return n, nil
+	}
+	now := time.Now()
+	hidden := make(map[string]bool)
+	for _, q := range []*datastore.Query{
+		datastore.NewQuery(kind).Filter(publishAt+" >", now).KeysOnly(),
+		datastore.NewQuery(kind).Filter(unpublishAt+" >", time.Time{}).Filter(unpublishAt+" <=", now).KeysOnly(),
+	} {
+		keys, err := q.GetAll(this.ctx, nil)
+		if err != nil {
+			return 0, err
+		}
+		for _, k := range keys {
+			if k.Parent() == nil {
+				hidden[k.Encode()] = true
+			}
+		}
+	}
+	return n - len(hidden), nil
+}
+
 func (this *Context) GetPrev() (string, error) {
 	if this.ctx == nil {
 		return "", &scmsError{"invalid context"}
@@ -315,8 +511,7 @@ func (this *Context) GetNext(k interface{}) (string, error) {
 	if len(lim) == 0 {
 		return "", fmt.Errorf("'limit' not found")
 	}
-	q := datastore.NewQuery(kind)
-	c, err := q.Count(this.ctx)
+	c, err := this.count(kind)
 	if err != nil {
 		return "", err
 	}
@@ -390,10 +585,17 @@ func (this *entity) Load(c <-chan datastore.Property) error {
 
 func (this *entity) Save(c chan<- datastore.Property) error {
 	for k, v := range this.data {
-		c <- datastore.Property{
+		p := datastore.Property{
 			Name:  k,
 			Value: v,
 		}
+		switch v.(type) {
+		case []byte:
+			p.NoIndex = true
+		case string:
+			p.NoIndex = len(v.(string)) > 500
+		}
+		c <- p
 	}
 	close(c)
 	return nil
@@ -443,5 +645,47 @@ func (this *Value) save(c appengine.Context, kind string, parent *datastore.Key)
 		return err
 	}
 	c.Infof("new key: %q", this.Key)
+	if err := updateSlug(c, this.Key, this.Data); err != nil {
+		return err
+	}
 	return this.Children.save(c, kind, this.Key)
 }
+
+// GetOrder returns an order specified by "sort" parameter of the request or d.
+func (this *Context) GetOrder(d interface{}) (string, error) {
+	if this.ctx == nil {
+		return "", &scmsError{"invalid context"}
+	}
+	def, ok := d.(string)
+	if !ok {
+		return "", fmt.Errorf("GetOrder: unexpected type of 'default': %T, must be string", d)
+	}
+	r, ok := this.ctx.Request().(*http.Request)
+	if !ok {
+		return "", &scmsError{"invalid request"}
+	}
+	if s := r.URL.Query().Get("sort"); len(s) != 0 {
+		return s, nil
+	}
+	return def, nil
+}
+
+func (this *Value) GetOrder(d interface{}) (string, error) {
+	return this.ctx.GetOrder(d)
+}
+
+// GetFile returns a file from "$Files" with its metadata.
+func (this *Context) GetFile(n interface{}) (Value, error) {
+	if this.ctx == nil {
+		return Value{}, &scmsError{"invalid context"}
+	}
+	name, ok := n.(string)
+	if !ok {
+		return Value{}, fmt.Errorf("GetFile: unexpected type of 'name': %T, must be string", n)
+	}
+	return this.GetByKey(datastore.NewKey(this.ctx, "$Files", name, 0, nil))
+}
+
+func (this *Value) GetFile(name interface{}) (Value, error) {
+	return this.ctx.GetFile(name)
+}
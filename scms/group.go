@@ -23,6 +23,7 @@ var groupSet = template.Must(template.Must(template.New("groupSet").Funcs(funcMa
 		<form action="/editor/group?gid={{.GetValue "gid"}}&id={{.Key.Encode}}" method="post">
 			<fieldset>
 				<legend>Record ID: {{.Key.Encode}}</legend>
+					<a href="/editor/history?id={{.Key.Encode}}">History</a><br>
 					<fieldset>
 						<legend>New field</legend>
 						<select name="name">
@@ -201,6 +202,7 @@ func groupHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method == "GET" {
 		var data Context
 		data.ctx = c
+		data.draft = true
 		w.Header().Set("Content-Type", "text/html; charset=utf-8")
 		if err := groupSet.Execute(w, &data); err != nil {
 			errorX(c, w, err)
@@ -243,6 +245,25 @@ func groupHandler(w http.ResponseWriter, r *http.Request) {
 	http.Redirect(w, r, r.URL.RawQuery, http.StatusFound)
 }
 
+// parseValue converts val to a value of a field of the type typ.
+func parseValue(typ string, val string) (interface{}, error) {
+	switch typ {
+	case "string":
+		return val, nil
+	case "bool":
+		return strconv.ParseBool(val)
+	case "integer":
+		return strconv.ParseInt(val,10,64)
+	case "float":
+		return strconv.ParseFloat(val,64)
+	case "time":
+		return parseTime(val)
+	case "key":
+		return datastore.DecodeKey(val)
+	}
+	return nil, fmt.Errorf("invalid field type %q for value %q", typ, val)
+}
+
 func newRecord(c appengine.Context, r *http.Request, g string, k *datastore.Key) error {
 	name := template.HTMLEscapeString(r.FormValue("name"))
 	c.Infof("newRecord: %v, %q", k, name)
@@ -254,24 +275,7 @@ func newRecord(c appengine.Context, r *http.Request, g string, k *datastore.Key)
 		return &scmsError{"field 'Name' must not be empty"}
 	}
 	val := template.HTMLEscapeString(r.FormValue("value"))
-	var v interface{}
-	var err error
-	switch r.FormValue("type") {
-	case "string":
-		v = val
-	case "bool":
-		v, err = strconv.ParseBool(val)
-	case "integer":
-		v, err = strconv.ParseInt(val,10,64)
-	case "float":
-		v, err = strconv.ParseFloat(val,64)
-	case "time":
-		v = time.Now()
-	case "key":
-		v, err = datastore.DecodeKey(val)
-	default:
-		err = fmt.Errorf("invalid field type %q for value %q", r.FormValue("type"), val)
-	}
+	v, err := parseValue(r.FormValue("type"), val)
 	c.Infof("type of field:%q, val:%q, v:%q", r.FormValue("type"), val, v)
 	if err != nil {
 		return err
@@ -279,13 +283,13 @@ func newRecord(c appengine.Context, r *http.Request, g string, k *datastore.Key)
 	var e entity
 	e.data = Values{name: v}
 	c.Infof("new Value:%v", e)
-	nk := datastore.NewIncompleteKey(c, g, k)
-	c.Infof("new key:%v", nk)
-	if _, err := datastore.Put(c, nk, &e); err != nil {
-		c.Infof("here?")
+	id, _, err := datastore.AllocateIDs(c, g, k, 1)
+	if err != nil {
 		return err
 	}
-	return nil
+	nk := datastore.NewKey(c, g, "", id, k)
+	c.Infof("new key:%v", nk)
+	return putDraft(c, nk, &e)
 }
 
 func editRecord(c appengine.Context, r *http.Request, k *datastore.Key) error {
@@ -297,29 +301,14 @@ func editRecord(c appengine.Context, r *http.Request, k *datastore.Key) error {
 	if name == "NewName" {
 		name = template.HTMLEscapeString(r.FormValue("newname"))
 		if len(name) != 0 {
-			switch r.FormValue("type") {
-			case "string":
-				v = val
-			case "bool":
-				v, err = strconv.ParseBool(val)
-			case "integer":
-				v, err = strconv.ParseInt(val,10,64)
-			case "float":
-				v, err = strconv.ParseFloat(val,64)
-			case "time":
-				v = time.Now()
-			case "key":
-				v, err = datastore.DecodeKey(val)
-			default:
-				err = &scmsError{"invalid field type"}
-			}
+			v, err = parseValue(r.FormValue("type"), val)
 			if err != nil {
 				return err
 			}
 			c.Infof("type of field: %q, val:%q, v:%q", r.FormValue("type"), val, v)
 		}
 	} else {
-		var ctx = Context{ctx: c}
+		var ctx = Context{ctx: c, draft: true}
 		cursor, err := ctx.Get(k.Kind(), "", k.Parent(), 0, 0)
 		if err != nil {
 			return err
@@ -346,7 +335,7 @@ func editRecord(c appengine.Context, r *http.Request, k *datastore.Key) error {
 		case float64:
 			v, err = strconv.ParseFloat(val,64)
 		case time.Time:
-			v = time.Now()
+			v, err = parseTime(val)
 		case datastore.Key:
 			v, err = datastore.DecodeKey(val)
 		default:
@@ -358,7 +347,7 @@ func editRecord(c appengine.Context, r *http.Request, k *datastore.Key) error {
 		c.Infof("type of field: %T, val:%q, v:%q", v, val, v)
 	}
 	var e entity
-	if err := datastore.Get(c, k, &e); err != nil {
+	if err := getDraft(c, k, &e); err != nil {
 		return err
 	}
 	c.Infof("new Value:%v", e)
@@ -374,7 +363,7 @@ func editRecord(c appengine.Context, r *http.Request, k *datastore.Key) error {
 		case "float":
 			e.data[k], err = strconv.ParseFloat(val,64)
 		case "time":
-			e.data[k] = time.Now()
+			e.data[k], err = parseTime(val)
 		case "key":
 			e.data[k], err = datastore.DecodeKey(val)
 		default:
@@ -388,8 +377,5 @@ func editRecord(c appengine.Context, r *http.Request, k *datastore.Key) error {
 	if len(name) != 0 {
 		e.data[name] = v
 	}
-	if _, err := datastore.Put(c, k, &e); err != nil {
-		return err
-	}
-	return nil
+	return putDraft(c, k, &e)
 }
@@ -7,10 +7,9 @@ package scms
 import (
 	"net/http"
 	"html/template"
-	"os"
 	"io"
 	"encoding/json"
-	"bytes"
+	"strings"
 	"archive/zip"
 	"appengine"
 	"appengine/datastore"
@@ -19,6 +18,7 @@ import (
 
 type Group struct {
 	Name string
+	Slug string
 }
 
 var groupsTemplate = template.Must(template.New("groups").Parse(
@@ -42,6 +42,7 @@ var groupsTemplate = template.Must(template.New("groups").Parse(
 		<a href=/editor/groups.zip>Download all groups</a><br>
 	{{end}}
 		<label>Upload groups: <input type="file" name="file" value=""></label><br>
+		{{template "importMode"}}
 		<input type="submit" value="Submit">
 	</fieldset>
 </form>
@@ -50,14 +51,30 @@ var groupsTemplate = template.Must(template.New("groups").Parse(
 	<fieldset>
 		<legend>Group "{{.Data.Name}}"</legend>
 		<label>ID: <input type="text" name="name" value="{{.Key.Encode}}" size=60></label><br>
+		<label>Field for slugs: <input type="text" name="slug" value="{{with .Data.Slug}}{{.}}{{end}}"></label><br>
 		<a href="/editor/group?gid={{.Key.Encode}}">Records</a><br>
+		<a href="/editor/groups.csv?group={{.Data.Name}}">Download records as CSV</a><br>
+		<a href="/editor/markdown.zip?group={{.Data.Name}}">Download records as Markdown files</a><br>
+		<input type="submit" value="Submit">
 		<input type="button" value="Delete">
 	</fieldset>
 </form>
+<form action="/editor/groups?action=records&amp;group={{.Data.Name}}" method="post" enctype="multipart/form-data">
+	<fieldset>
+		<legend>Upload records of group "{{.Data.Name}}"</legend>
+		<label>File: <input type="file" name="file" value=""></label><br>
+		<label>Format: <select name="format">
+			<option value="csv">CSV</option>
+			<option value="markdown">zip of Markdown files with front matter</option>
+		</select></label><br>
+		{{template "importMode"}}
+		<input type="submit" value="Submit">
+	</fieldset>
+</form>
 {{end}}
 </body>
 </html>
-`))
+` + importModeTemplate))
 
 func groupsHandler(w http.ResponseWriter, r *http.Request) {
 	c := appengine.NewContext(r)
@@ -78,19 +95,19 @@ func groupsHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	if r.FormValue("action") == "upload" {
-		file, _, err := r.FormFile("file")
-		if err != nil {
+		if err := previewImport(c, w, r, "groups", r.URL.Path); err != nil {
 			errorX(c, w, err)
-			c.Errorf("can't get an archive with imported groups: %q", err)
-			return
 		}
-		if n, err := file.Seek(0, os.SEEK_END); err != nil {
-			errorX(c, w, err)
-			return
-		} else if err := importGroups(c, file, n); err != nil {
+		return
+	} else if r.FormValue("action") == "records" {
+		format := r.FormValue("format")
+		if format != "markdown" {
+			format = "csv"
+		}
+		if err := previewImport(c, w, r, format+"/"+r.FormValue("group"), r.URL.Path); err != nil {
 			errorX(c, w, err)
-			return
 		}
+		return
 	} else if id := r.URL.Query().Get("id"); len(id) == 0 {
 		var err error
 		err = newGroup(c, r)
@@ -98,13 +115,14 @@ func groupsHandler(w http.ResponseWriter, r *http.Request) {
 			errorX(c, w, err)
 			return
 		}
-	} else if _, err := datastore.DecodeKey(id); err != nil {
+	} else if k, err := datastore.DecodeKey(id); err != nil {
+		errorX(c, w, err)
+		return
+	} else if err := editGroup(c, r, k); err != nil {
 		errorX(c, w, err)
 		return
-	} else {
-		// TODO: delete group?
 	}
-	createHandlers(c)
+	invalidate(c)
 	http.Redirect(w, r, r.URL.Path, http.StatusFound)
 }
 
@@ -148,66 +166,158 @@ func newGroup(c appengine.Context, r *http.Request) error {
 	return nil
 }
 
+func editGroup(c appengine.Context, r *http.Request, k *datastore.Key) error {
+	var g Group
+	if err := datastore.Get(c, k, &g); err != nil {
+		return err
+	}
+	slug := r.FormValue("slug")
+	if slug == g.Slug {
+		return nil
+	}
+	g.Slug = slug
+	c.Infof("changed group %#v", g)
+	if _, err := datastore.Put(c, k, &g); err != nil {
+		return err
+	}
+	return updateSlugs(c, g.Name)
+}
+
 func exportGroups(c appengine.Context, w io.Writer) error {
+	return writeGroups(c, w, nil)
+}
+
+// writeGroups writes groups as a zip archive to w, schemas of the groups are
+// added to schemas if it is not nil. Settings of the groups are kept in
+// "$Groups" entry.
+func writeGroups(c appengine.Context, w io.Writer, schemas map[string]groupSchema) error {
 	q := datastore.NewQuery("$Groups")
 	var g []Group
 	if _, err := q.GetAll(c, &g); err != nil {
 		return err
 	}
-	b := bytes.NewBuffer(nil)
-	z := zip.NewWriter(b)
+	z := zip.NewWriter(w)
 	for _, v := range g {
-		ctx := &Context{
-			ctx: c,
-		}
-		cur, err := ctx.GetTree(v.Name)
+		zw, err := z.Create(v.Name)
 		if err != nil {
 			return err
 		}
-		j, err := json.MarshalIndent(cur, "", "\t")
-		if err != nil {
+		s := groupSchema{Fields: make(map[string]string)}
+		rw := newRecordWriter(zw)
+		if err := walkGroup(c, v.Name, func(r Value) error {
+			s.add(Cursor{r})
+			return rw.write(r, false)
+		}); err != nil {
 			return err
 		}
-		if zw, err := z.Create(v.Name); err != nil {
-			return err
-		} else if _, err := zw.Write(j); err != nil {
+		if err := rw.close(); err != nil {
 			return err
 		}
+		if schemas != nil {
+			s.Slug = v.Slug
+			schemas[v.Name] = s
+		}
 	}
-	z.Close()
-	if _, err := w.Write(b.Bytes()); err != nil {
+	j, err := json.MarshalIndent(g, "", "\t")
+	if err != nil {
 		return err
 	}
-	return nil
+	if zw, err := z.Create("$Groups"); err != nil {
+		return err
+	} else if _, err := zw.Write(j); err != nil {
+		return err
+	}
+	return z.Close()
 }
 
-func importGroups(c appengine.Context, file io.ReaderAt, size int64) error {
-	r, err := zip.NewReader(file, size)
-	if err != nil {
-		return err
+// walkGroup calls f for every top-level record of the group name with its
+// children. The datastore returns records in the order of their keys, where
+// children follow their parents, so one top-level record at a time is kept
+// in memory.
+func walkGroup(c appengine.Context, name string, f func(v Value) error) error {
+	ctx := Context{ctx: c}
+	var root *Value
+	var stack []*Value
+	for t := datastore.NewQuery(name).Order("__key__").Run(c); ; {
+		var e entity
+		k, err := t.Next(&e)
+		if err == datastore.Done {
+			break
+		} else if err != nil {
+			return err
+		}
+		v := Value{Key: k, Data: e.data, ctx: ctx}
+		if k.Parent() == nil {
+			if root != nil {
+				if err := f(*root); err != nil {
+					return err
+				}
+			}
+			root = &v
+			stack = []*Value{root}
+			continue
+		}
+		for len(stack) != 0 && !stack[len(stack)-1].Key.Equal(k.Parent()) {
+			stack = stack[:len(stack)-1]
+		}
+		if len(stack) == 0 {
+			// the parent is deleted, GetTree doesn't return such records
+			continue
+		}
+		p := stack[len(stack)-1]
+		p.Children = append(p.Children, v)
+		stack = append(stack, &p.Children[len(p.Children)-1])
+	}
+	if root == nil {
+		return nil
 	}
-	for _, v := range r.File {
-		d := make([]byte, v.UncompressedSize)
-		if rc, err := v.Open(); err != nil {
+	return f(*root)
+}
+
+// parseGroups adds groups of an archive to the site s.
+func parseGroups(c appengine.Context, a *archive, s *site) error {
+	s.sections["$Groups"] = true
+	settings := make(map[string]*Group)
+	for _, v := range a.files {
+		if v.Name != "$Groups" {
+			continue
+		}
+		d, err := readEntry(v)
+		if err != nil {
 			return err
-		} else if _, err := io.ReadFull(rc, d); err != nil {
+		}
+		var g []Group
+		if err := json.Unmarshal(d, &g); err != nil {
+			c.Errorf("json can't unmarshal: %q", err)
+			return err
+		}
+		for i := range g {
+			settings[g[i].Name] = &g[i]
+		}
+	}
+	for _, v := range a.files {
+		if v.Name == "$Groups" {
+			continue
+		}
+		if strings.HasPrefix(v.Name, "$") || strings.ContainsAny(v.Name, "/\\") {
+			a.reject(v.Name, "invalid name of group")
+			continue
+		}
+		d, err := readEntry(v)
+		if err != nil {
 			c.Errorf("reading of file has failed: %q", err)
 			return err
-		} else {
-			rc.Close()
 		}
-		var cur Cursor
-		if err := json.Unmarshal(d, &cur); err != nil {
+		var recs []record
+		if err := json.Unmarshal(d, &recs); err != nil {
 			c.Errorf("json can't unmarshal: %q", err)
 			return err
 		}
-		g := Group{Name: v.Name}
-		key := datastore.NewKey(c, "$Groups", g.Name, 0, nil)
-		if _, err := datastore.Put(c, key, &g); err != nil {
+		cur, err := importRecords(c, recs)
+		if err != nil {
 			return err
 		}
-		cur.save(c, g.Name, nil)
+		s.groups = append(s.groups, importedGroup{v.Name, cur, settings[v.Name]})
 	}
-
 	return nil
 }
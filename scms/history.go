@@ -0,0 +1,409 @@
+// Copyright (c) 2012 Alexander Sychev. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package scms
+
+import (
+	"appengine"
+	"appengine/datastore"
+	"appengine/user"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Revision is a saved state of a page, a file or a record. Properties of the
+// entity are kept in Content as indented JSON, so they can be compared as text,
+// a binary property (the content of a file) is kept in a chunk named by
+// DataHash, so a revision of a file of any size fits into an entity. Older
+// revisions keep the binary property in Data.
+type Revision struct {
+	Target   *datastore.Key
+	Time     time.Time
+	User     string
+	Content  []byte `datastore:",noindex"`
+	Data     []byte
+	DataHash string
+}
+
+type typedValue struct {
+	Type  string `json:"type"`
+	Value string `json:"value,omitempty"`
+}
+
+// revisions sorts revisions from newest to oldest along with their keys.
+type revisions struct {
+	keys []*datastore.Key
+	revs []Revision
+}
+
+func (this revisions) Len() int {
+	return len(this.revs)
+}
+
+func (this revisions) Swap(i, j int) {
+	this.keys[i], this.keys[j] = this.keys[j], this.keys[i]
+	this.revs[i], this.revs[j] = this.revs[j], this.revs[i]
+}
+
+func (this revisions) Less(i, j int) bool {
+	return this.revs[i].Time.After(this.revs[j].Time)
+}
+
+func encodeRevision(e entity) ([]byte, []byte, error) {
+	m := make(map[string]typedValue)
+	var data []byte
+	for k, v := range e.data {
+		var t typedValue
+		switch v.(type) {
+		case string:
+			t = typedValue{"string", v.(string)}
+		case bool:
+			t = typedValue{"bool", strconv.FormatBool(v.(bool))}
+		case int64:
+			t = typedValue{"integer", strconv.FormatInt(v.(int64), 10)}
+		case float64:
+			t = typedValue{"float", strconv.FormatFloat(v.(float64), 'g', -1, 64)}
+		case time.Time:
+			t = typedValue{"time", v.(time.Time).Format(time.RFC3339Nano)}
+		case *datastore.Key:
+			if v.(*datastore.Key) != nil {
+				t = typedValue{"key", v.(*datastore.Key).Encode()}
+			} else {
+				t = typedValue{"key", ""}
+			}
+		case []byte:
+			t = typedValue{Type: "bytes"}
+			data = v.([]byte)
+		default:
+			return nil, nil, fmt.Errorf("type %T of property %q is unsupported", v, k)
+		}
+		m[k] = t
+	}
+	j, err := json.MarshalIndent(m, "", "\t")
+	return j, data, err
+}
+
+func decodeRevision(content []byte, data []byte) (entity, error) {
+	var m map[string]typedValue
+	e := entity{data: make(Values)}
+	if err := json.Unmarshal(content, &m); err != nil {
+		return e, err
+	}
+	for k, t := range m {
+		var v interface{}
+		var err error
+		switch t.Type {
+		case "string":
+			v = t.Value
+		case "bool":
+			v, err = strconv.ParseBool(t.Value)
+		case "integer":
+			v, err = strconv.ParseInt(t.Value, 10, 64)
+		case "float":
+			v, err = strconv.ParseFloat(t.Value, 64)
+		case "time":
+			v, err = time.Parse(time.RFC3339Nano, t.Value)
+		case "key":
+			var key *datastore.Key
+			if len(t.Value) != 0 {
+				key, err = datastore.DecodeKey(t.Value)
+			}
+			v = key
+		case "bytes":
+			v = data
+		default:
+			err = fmt.Errorf("type %q of property %q is unsupported", t.Type, k)
+		}
+		if err != nil {
+			return e, err
+		}
+		e.data[k] = v
+	}
+	return e, nil
+}
+
+// entityOf returns properties of src, an entity or a struct stored in the datastore.
+func entityOf(src interface{}) (entity, error) {
+	if e, ok := src.(*entity); ok {
+		return *e, nil
+	}
+	v := reflect.Indirect(reflect.ValueOf(src))
+	if v.Kind() != reflect.Struct {
+		return entity{}, fmt.Errorf("type %T is unsupported", src)
+	}
+	e := entity{data: make(Values)}
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		if len(t.Field(i).PkgPath) == 0 {
+			e.data[t.Field(i).Name] = v.Field(i).Interface()
+		}
+	}
+	return e, nil
+}
+
+// newRevision returns a revision of src which is a new state of k.
+func newRevision(c appengine.Context, k *datastore.Key, src interface{}) (*Revision, error) {
+	e, err := entityOf(src)
+	if err != nil {
+		return nil, err
+	}
+	content, data, err := encodeRevision(e)
+	if err != nil {
+		return nil, err
+	}
+	rev := &Revision{
+		Target:  k,
+		Time:    time.Now(),
+		Content: content,
+	}
+	if data != nil {
+		if rev.DataHash, err = putChunk(c, data); err != nil {
+			return nil, err
+		}
+	}
+	if u := user.Current(c); u != nil {
+		rev.User = u.Email
+	}
+	return rev, nil
+}
+
+// saveRevision keeps src as a new revision of k.
+func saveRevision(c appengine.Context, k *datastore.Key, src interface{}) error {
+	rev, err := newRevision(c, k, src)
+	if err != nil {
+		return err
+	}
+	_, err = datastore.Put(c, datastore.NewIncompleteKey(c, "$Revisions", nil), rev)
+	return err
+}
+
+// data returns the binary property of the revision.
+func (this *Revision) data(c appengine.Context) ([]byte, error) {
+	if len(this.DataHash) == 0 {
+		return this.Data, nil
+	}
+	var ch chunk
+	if err := datastore.Get(c, chunkKey(c, this.DataHash, 0), &ch); err != nil {
+		return nil, err
+	}
+	return ch.Data, nil
+}
+
+func getRevisions(c appengine.Context, k *datastore.Key) ([]*datastore.Key, []Revision, error) {
+	var revs revisions
+	var err error
+	revs.keys, err = datastore.NewQuery("$Revisions").Filter("Target =", k).GetAll(c, &revs.revs)
+	if err != nil {
+		return nil, nil, err
+	}
+	sort.Sort(revs)
+	return revs.keys, revs.revs, nil
+}
+
+type diffLine struct {
+	Op   string
+	Text string
+}
+
+// diffLines returns a line diff of a and b based on the longest common subsequence.
+func diffLines(a, b string) []diffLine {
+	x := strings.Split(a, "\n")
+	y := strings.Split(b, "\n")
+	if len(x)*len(y) > 4000000 {
+		return []diffLine{{"!", "the content is too large for comparison"}}
+	}
+	l := make([][]int, len(x)+1)
+	for i := range l {
+		l[i] = make([]int, len(y)+1)
+	}
+	for i := len(x) - 1; i >= 0; i-- {
+		for j := len(y) - 1; j >= 0; j-- {
+			if x[i] == y[j] {
+				l[i][j] = l[i+1][j+1] + 1
+			} else if l[i+1][j] >= l[i][j+1] {
+				l[i][j] = l[i+1][j]
+			} else {
+				l[i][j] = l[i][j+1]
+			}
+		}
+	}
+	var out []diffLine
+	i, j := 0, 0
+	for i < len(x) && j < len(y) {
+		switch {
+		case x[i] == y[j]:
+			out = append(out, diffLine{" ", x[i]})
+			i++
+			j++
+		case l[i+1][j] >= l[i][j+1]:
+			out = append(out, diffLine{"-", x[i]})
+			i++
+		default:
+			out = append(out, diffLine{"+", y[j]})
+			j++
+		}
+	}
+	for ; i < len(x); i++ {
+		out = append(out, diffLine{"-", x[i]})
+	}
+	for ; j < len(y); j++ {
+		out = append(out, diffLine{"+", y[j]})
+	}
+	return out
+}
+
+type revisionView struct {
+	Key  string
+	Time time.Time
+	User string
+}
+
+type historyData struct {
+	Key       string
+	Revisions []revisionView
+	Diff      []diffLine
+	Current   string
+}
+
+var historyTemplate = template.Must(template.New("history").Parse(
+	`
+<html>
+<body>
+<a href="/">Main</a><br>
+<a href="/editor">Editor</a><br>
+<a href="/logout">Logout</a><br>
+<fieldset>
+	<legend>History of {{.Key}}</legend>
+	{{range .Revisions}}
+	<form action="/editor/history?rid={{.Key}}" method="post">
+		<a href="/editor/history?rid={{.Key}}">{{.Time}}</a> {{.User}}
+		<input type="submit" value="Restore">
+	</form>
+	{{end}}
+</fieldset>
+{{if .Current}}
+<fieldset>
+	<legend>Changes of revision {{.Current}}</legend>
+<pre>
+{{range .Diff}}{{.Op}} {{.Text}}
+{{end}}
+</pre>
+</fieldset>
+{{end}}
+</body>
+</html>
+`))
+
+func historyHandler(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+	if u := user.Current(c); u == nil {
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return
+	}
+	var rev Revision
+	var rk *datastore.Key
+	if rid := r.URL.Query().Get("rid"); len(rid) != 0 {
+		var err error
+		if rk, err = datastore.DecodeKey(rid); err != nil {
+			errorX(c, w, err)
+			return
+		}
+		if err := datastore.Get(c, rk, &rev); err != nil {
+			errorX(c, w, err)
+			return
+		}
+	}
+	if r.Method == "POST" {
+		if rk == nil {
+			error404(w, r)
+			return
+		}
+		if err := restoreRevision(c, rev); err != nil {
+			errorX(c, w, err)
+			return
+		}
+		http.Redirect(w, r, "/editor/history?id="+rev.Target.Encode(), http.StatusFound)
+		return
+	} else if r.Method != "GET" {
+		error404(w, r)
+		return
+	}
+	k := rev.Target
+	if k == nil {
+		var err error
+		if k, err = datastore.DecodeKey(r.URL.Query().Get("id")); err != nil {
+			errorX(c, w, err)
+			return
+		}
+	}
+	keys, revs, err := getRevisions(c, k)
+	if err != nil {
+		errorX(c, w, err)
+		return
+	}
+	data := historyData{Key: k.String()}
+	for i, v := range revs {
+		data.Revisions = append(data.Revisions, revisionView{keys[i].Encode(), v.Time, v.User})
+		if rk == nil || !keys[i].Equal(rk) {
+			continue
+		}
+		data.Current = v.Time.String()
+		var prev Revision
+		if i+1 < len(revs) {
+			prev = revs[i+1]
+		}
+		if data.Diff, err = diffRevisions(c, prev, v); err != nil {
+			errorX(c, w, err)
+			return
+		}
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := historyTemplate.Execute(w, &data); err != nil {
+		errorX(c, w, err)
+	}
+}
+
+func diffRevisions(c appengine.Context, a, b Revision) ([]diffLine, error) {
+	out := diffLines(string(a.Content), string(b.Content))
+	ad, err := a.data(c)
+	if err != nil {
+		return nil, err
+	}
+	bd, err := b.data(c)
+	if err != nil {
+		return nil, err
+	}
+	if len(ad) == 0 && len(bd) == 0 {
+		return out, nil
+	}
+	if !utf8.Valid(ad) || !utf8.Valid(bd) {
+		if string(ad) != string(bd) {
+			out = append(out, diffLine{"!", "binary content has been changed"})
+		}
+		return out, nil
+	}
+	return append(out, diffLines(string(ad), string(bd))...), nil
+}
+
+// restoreRevision makes a revision the draft state of its entity.
+func restoreRevision(c appengine.Context, rev Revision) error {
+	d, err := rev.data(c)
+	if err != nil {
+		return err
+	}
+	e, err := decodeRevision(rev.Content, d)
+	if err != nil {
+		return err
+	}
+	c.Infof("restoring %v from %v", rev.Target, rev.Time)
+	return putDraft(c, rev.Target, &e)
+}
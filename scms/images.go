@@ -0,0 +1,359 @@
+// Copyright (c) 2012 Alexander Sychev. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package scms
+
+import (
+	"appengine"
+	"appengine/datastore"
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"fmt"
+	"hash/crc32"
+	"image"
+	"image/color"
+	_ "image/gif"
+	"image/jpeg"
+	"image/png"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+)
+
+const (
+	maxImageSide = 4096
+	// maxImagePixels limits images which are decoded to make derivatives,
+	// a small compressed file can be decoded to a huge image.
+	maxImagePixels = 4096 * 4096
+)
+
+// badImage is an error of an image which can't be used for derivatives.
+type badImage struct {
+	s string
+}
+
+func (this *badImage) Error() string {
+	return this.s
+}
+
+// imageParams are parameters of a derivative of an image requested by
+// "w", "h", "fit", "format" and "q" parameters of a file URL.
+type imageParams struct {
+	Width   int
+	Height  int
+	Fit     string
+	Format  string
+	Quality int
+}
+
+// derivative is a cached derivative of an image, it is kept in "$Images"
+// named by the hash of the original and the parameters.
+type derivative struct {
+	ContentType string
+	Data        []byte
+}
+
+// Derivatives take time to make and they are cached, so new derivatives are
+// made only by URLs signed by imageURL or for administrators, cached ones are
+// served to everybody. The signing key is made once and kept in "$Config".
+type imageConfig struct {
+	Key []byte
+}
+
+func imageKey(c appengine.Context) *datastore.Key {
+	return datastore.NewKey(c, "$Config", "images", 0, nil)
+}
+
+var (
+	signingLock sync.RWMutex
+	signingKey  []byte
+)
+
+// loadSigningKey returns the key signing URLs of derivatives, it is made on
+// the first call.
+func loadSigningKey(c appengine.Context) ([]byte, error) {
+	signingLock.RLock()
+	key := signingKey
+	signingLock.RUnlock()
+	if key != nil {
+		return key, nil
+	}
+	var cfg imageConfig
+	err := datastore.RunInTransaction(c, func(c appengine.Context) error {
+		if err := datastore.Get(c, imageKey(c), &cfg); err != datastore.ErrNoSuchEntity {
+			return err
+		}
+		cfg.Key = make([]byte, sha1.Size)
+		if _, err := rand.Read(cfg.Key); err != nil {
+			return err
+		}
+		_, err := datastore.Put(c, imageKey(c), &cfg)
+		return err
+	}, nil)
+	if err != nil {
+		return nil, err
+	}
+	signingLock.Lock()
+	signingKey = cfg.Key
+	signingLock.Unlock()
+	return cfg.Key, nil
+}
+
+// sign returns a signature of the parameters of a derivative of the image n.
+func (this imageParams) sign(key []byte, n string) string {
+	m := hmac.New(sha1.New, key)
+	fmt.Fprintf(m, "%s?%s", n, this)
+	return fmt.Sprintf("%x", m.Sum(nil))[:16]
+}
+
+// signed reports whether the request r of a derivative of the image n with
+// parameters p is signed.
+func signed(c appengine.Context, r *http.Request, n string, p imageParams) bool {
+	key, err := loadSigningKey(c)
+	if err != nil {
+		c.Errorf("can't load the key of derivatives: %v", err)
+		return false
+	}
+	s := r.URL.Query().Get("sig")
+	return subtle.ConstantTimeCompare([]byte(s), []byte(p.sign(key, n))) == 1
+}
+
+func parseImageParams(q url.Values) (imageParams, bool, error) {
+	p := imageParams{Fit: q.Get("fit"), Format: q.Get("format"), Quality: jpeg.DefaultQuality}
+	if len(q.Get("w")) == 0 && len(q.Get("h")) == 0 && len(p.Format) == 0 && len(q.Get("q")) == 0 {
+		return p, false, nil
+	}
+	var err error
+	for _, v := range []struct {
+		name string
+		val  *int
+		max  int
+	}{{"w", &p.Width, maxImageSide}, {"h", &p.Height, maxImageSide}, {"q", &p.Quality, 100}} {
+		s := q.Get(v.name)
+		if len(s) == 0 {
+			continue
+		}
+		if *v.val, err = strconv.Atoi(s); err != nil {
+			return p, false, err
+		}
+		if *v.val <= 0 || *v.val > v.max {
+			return p, false, fmt.Errorf("parameter %q must be in range 1..%v", v.name, v.max)
+		}
+	}
+	switch p.Fit {
+	case "":
+		p.Fit = "fit"
+	case "fit", "crop", "fill":
+	default:
+		return p, false, fmt.Errorf("unknown fit %q, must be fit, crop or fill", p.Fit)
+	}
+	switch p.Format {
+	case "", "png":
+	case "jpeg", "jpg":
+		p.Format = "jpeg"
+	default:
+		return p, false, fmt.Errorf("unknown format %q, must be jpeg or png", p.Format)
+	}
+	return p, true, nil
+}
+
+func (this imageParams) String() string {
+	return fmt.Sprintf("w=%v&h=%v&fit=%v&format=%v&q=%v", this.Width, this.Height, this.Fit, this.Format, this.Quality)
+}
+
+// size returns a size of the scaled image and a size of the image cropped from it.
+// Images are not enlarged, the requested size is reduced to the size of the
+// original keeping its proportions.
+func (this imageParams) size(b image.Rectangle) (int, int, int, int) {
+	sw, sh := b.Dx(), b.Dy()
+	w, h := this.Width, this.Height
+	if w > sw {
+		if h != 0 {
+			h = maxInt(1, h*sw/w)
+		}
+		w = sw
+	}
+	if h > sh {
+		if w != 0 {
+			w = maxInt(1, w*sh/h)
+		}
+		h = sh
+	}
+	switch {
+	case w == 0 && h == 0:
+		return sw, sh, sw, sh
+	case w == 0:
+		w = maxInt(1, sw*h/sh)
+		return w, h, w, h
+	case h == 0:
+		h = maxInt(1, sh*w/sw)
+		return w, h, w, h
+	}
+	switch this.Fit {
+	case "fill":
+		return w, h, w, h
+	case "crop":
+		if sw*h > sh*w {
+			return maxInt(1, sw*h/sh), h, w, h
+		}
+		return w, maxInt(1, sh*w/sw), w, h
+	}
+	if sw*h > sh*w {
+		h = maxInt(1, sh*w/sw)
+	} else {
+		w = maxInt(1, sw*h/sh)
+	}
+	return w, h, w, h
+}
+
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+// scale resizes src to w x h averaging source pixels covered by every pixel of the result.
+func scale(src image.Image, w, h int) *image.RGBA {
+	b := src.Bounds()
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		y0 := b.Min.Y + y*b.Dy()/h
+		y1 := maxInt(y0+1, b.Min.Y+(y+1)*b.Dy()/h)
+		for x := 0; x < w; x++ {
+			x0 := b.Min.X + x*b.Dx()/w
+			x1 := maxInt(x0+1, b.Min.X+(x+1)*b.Dx()/w)
+			var r, g, bl, a, n uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					cr, cg, cb, ca := src.At(sx, sy).RGBA()
+					r, g, bl, a = r+uint64(cr), g+uint64(cg), bl+uint64(cb), a+uint64(ca)
+					n++
+				}
+			}
+			dst.SetRGBA(x, y, color.RGBA{uint8(r / n >> 8), uint8(g / n >> 8), uint8(bl / n >> 8), uint8(a / n >> 8)})
+		}
+	}
+	return dst
+}
+
+func makeDerivative(c appengine.Context, f *File, p imageParams) (derivative, error) {
+	var out derivative
+	cfg, _, err := image.DecodeConfig(f.reader(c))
+	if err != nil {
+		return out, &badImage{fmt.Sprintf("can't decode image %q: %v", f.Name, err)}
+	}
+	if cfg.Width <= 0 || cfg.Height <= 0 || cfg.Width > maxImagePixels/cfg.Height {
+		return out, &badImage{fmt.Sprintf("image %q is %vx%v, more than %v pixels", f.Name, cfg.Width, cfg.Height, maxImagePixels)}
+	}
+	src, _, err := image.Decode(f.reader(c))
+	if err != nil {
+		return out, &badImage{fmt.Sprintf("can't decode image %q: %v", f.Name, err)}
+	}
+	w, h, cw, ch := p.size(src.Bounds())
+	dst := scale(src, w, h)
+	var img image.Image = dst
+	if cw != w || ch != h {
+		x, y := (w-cw)/2, (h-ch)/2
+		img = dst.SubImage(image.Rect(x, y, x+cw, y+ch))
+	}
+	b := bytes.NewBuffer(nil)
+	if p.Format == "jpeg" {
+		out.ContentType = "image/jpeg"
+		err = jpeg.Encode(b, img, &jpeg.Options{Quality: p.Quality})
+	} else {
+		out.ContentType = "image/png"
+		err = png.Encode(b, img)
+	}
+	out.Data = b.Bytes()
+	return out, err
+}
+
+// serveImage serves a derivative of the image f, derivatives are cached by
+// the hash of f. A derivative which is not cached yet is made only if create
+// is true.
+func serveImage(c appengine.Context, w http.ResponseWriter, r *http.Request, f *File, p imageParams, create bool) error {
+	var d derivative
+	// the format is known before the derivative is made, so the quality
+	// which doesn't matter for PNG doesn't make another derivative
+	if len(p.Format) == 0 {
+		p.Format = "png"
+		if f.contentType(c) == "image/jpeg" {
+			p.Format = "jpeg"
+		}
+	}
+	if p.Format == "png" {
+		p.Quality = 0
+	}
+	id := f.Hash + "?" + p.String()
+	k := datastore.NewKey(c, "$Images", id, 0, nil)
+	if err := datastore.Get(c, k, &d); err == datastore.ErrNoSuchEntity {
+		if !create {
+			http.Error(w, "the URL of the derivative is not signed", http.StatusForbidden)
+			return nil
+		}
+		c.Infof("making derivative %q of %q", id, f.Name)
+		if d, err = makeDerivative(c, f, p); err != nil {
+			return err
+		}
+		if len(d.Data) < chunkSize {
+			if _, err := datastore.Put(c, k, &d); err != nil {
+				c.Errorf("can't cache derivative %q: %v", id, err)
+			}
+		}
+	} else if err != nil {
+		return err
+	}
+	w.Header().Set("Content-Type", d.ContentType)
+	w.Header().Set("ETag", fmt.Sprintf(`"%s-%08x"`, f.Hash, crc32.ChecksumIEEE([]byte(p.String()))))
+	http.ServeContent(w, r, f.Name, f.Uploaded, bytes.NewReader(d.Data))
+	return nil
+}
+
+// imageURL returns URL of a derivative of the image n with width w, height h
+// and optional fit, format and quality. The URL is signed if the signing key
+// is loaded, as it is for pages, GetImage and GetMedia.
+func imageURL(n string, w int, h int, opts ...string) (string, error) {
+	signingLock.RLock()
+	key := signingKey
+	signingLock.RUnlock()
+	return signedImageURL(key, n, w, h, opts...)
+}
+
+func signedImageURL(key []byte, n string, w int, h int, opts ...string) (string, error) {
+	q := make(url.Values)
+	if w != 0 {
+		q.Set("w", strconv.Itoa(w))
+	}
+	if h != 0 {
+		q.Set("h", strconv.Itoa(h))
+	}
+	for i, v := range opts {
+		switch {
+		case len(v) == 0:
+		case i == 0:
+			q.Set("fit", v)
+		case i == 1:
+			q.Set("format", v)
+		case i == 2:
+			q.Set("q", v)
+		default:
+			return "", fmt.Errorf("ImageURL: too many options: %q", opts)
+		}
+	}
+	n = cleanName(n)
+	if key != nil {
+		p, _, err := parseImageParams(q)
+		if err != nil {
+			return "", fmt.Errorf("ImageURL: %v", err)
+		}
+		q.Set("sig", p.sign(key, n))
+	}
+	u := url.URL{Path: "/" + n, RawQuery: q.Encode()}
+	return u.String(), nil
+}
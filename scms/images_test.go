@@ -0,0 +1,62 @@
+// Copyright (c) 2012 Alexander Sychev. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package scms
+
+import (
+	"image"
+	"net/url"
+	"testing"
+)
+
+func TestImageSize(t *testing.T) {
+	for _, v := range []struct {
+		p            imageParams
+		sw, sh       int
+		w, h, cw, ch int
+	}{
+		{imageParams{}, 400, 200, 400, 200, 400, 200},
+		{imageParams{Width: 100}, 400, 200, 100, 50, 100, 50},
+		{imageParams{Height: 100}, 400, 200, 200, 100, 200, 100},
+		{imageParams{Width: 100, Height: 100, Fit: "fit"}, 400, 200, 100, 50, 100, 50},
+		{imageParams{Width: 100, Height: 100, Fit: "fill"}, 400, 200, 100, 100, 100, 100},
+		{imageParams{Width: 100, Height: 100, Fit: "crop"}, 400, 200, 200, 100, 100, 100},
+		{imageParams{Width: 100, Height: 100, Fit: "crop"}, 200, 400, 100, 200, 100, 100},
+		// images are not enlarged
+		{imageParams{Width: 800}, 400, 200, 400, 200, 400, 200},
+		{imageParams{Width: 800, Height: 800, Fit: "fill"}, 400, 200, 200, 200, 200, 200},
+		// sizes are never zero
+		{imageParams{Width: 1}, 400, 1, 1, 1, 1, 1},
+	} {
+		w, h, cw, ch := v.p.size(image.Rect(0, 0, v.sw, v.sh))
+		if w != v.w || h != v.h || cw != v.cw || ch != v.ch {
+			t.Errorf("%v of %vx%v: size is %vx%v cropped to %vx%v, want %vx%v cropped to %vx%v", v.p, v.sw, v.sh, w, h, cw, ch, v.w, v.h, v.cw, v.ch)
+		}
+	}
+}
+
+func TestSignedImageURL(t *testing.T) {
+	key := []byte("key")
+	u, err := signedImageURL(key, "a/b.png", 100, 0, "crop")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pu, err := url.Parse(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, ok, err := parseImageParams(pu.Query())
+	if err != nil || !ok {
+		t.Fatalf("parameters of %q: %v, %v", u, ok, err)
+	}
+	if s := pu.Query().Get("sig"); s != p.sign(key, "a/b.png") {
+		t.Errorf("signature of %q is %q, want %q", u, s, p.sign(key, "a/b.png"))
+	}
+	if p.sign(key, "a/c.png") == p.sign(key, "a/b.png") || p.sign([]byte("other"), "a/b.png") == p.sign(key, "a/b.png") {
+		t.Errorf("signatures of other images or keys are the same")
+	}
+	if u, _ := signedImageURL(nil, "a/b.png", 100, 0); u != "/a/b.png?w=100" {
+		t.Errorf("URL without a key is %q", u)
+	}
+}
@@ -0,0 +1,835 @@
+// Copyright (c) 2012 Alexander Sychev. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package scms
+
+import (
+	"appengine"
+	"appengine/datastore"
+	"appengine/user"
+	"archive/zip"
+	"crypto/sha1"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"reflect"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// An import is done in two steps. An uploaded archive is kept in "$Imports"
+// named by its hash and parsed to a site, the site is compared with the
+// current content and the changes are shown to the editor. When the editor
+// confirms, the same archive is parsed and compared again and the changes
+// are applied only if they are the same as the previewed ones. See
+// commitChanges for what is guaranteed when applying fails. Drafts and marks of deletion of
+// entities changed by an import are discarded. Staged archives which are
+// neither applied nor cancelled are removed by cron after importExpiry.
+
+// site is a content of an imported archive. Only sections present in the
+// archive are compared with the current content.
+type site struct {
+	sections map[string]bool
+	files    []importedFile
+	pages    []Page
+	groups   []importedGroup
+	config   *Config
+	manifest *manifest
+	// remap maps keys of unchanged entities of the archive to other existing keys
+	remap map[string]*datastore.Key
+	// keyed is set if records refer to each other by keys, they are kept only by merging
+	keyed bool
+	// partial is set if records of a group are rejected or the archive
+	// doesn't match its manifest, replacing would delete the current
+	// versions of the missing entities
+	partial bool
+}
+
+type importedFile struct {
+	info  fileInfo
+	entry *zip.File
+}
+
+type importedGroup struct {
+	name    string
+	records Cursor
+	// settings of the group if the archive has them
+	settings *Group
+}
+
+func newSite() *site {
+	return &site{sections: make(map[string]bool), remap: make(map[string]*datastore.Key)}
+}
+
+// Change is a creation, a modification or a deletion of an entity made by an
+// import. value is nil for a deletion, prepare completes key and value.
+// from is the key of the entity in the archive if it differs from key.
+type Change struct {
+	Action  string
+	Kind    string
+	Name    string
+	Diff    []diffLine
+	sum     string
+	key     *datastore.Key
+	from    *datastore.Key
+	value   interface{}
+	prepare func(c appengine.Context) error
+}
+
+// parseSite parses the archive a uploaded as section "all", "files", "pages",
+// "groups", "wxr" or "markdown/<group>".
+func parseSite(c appengine.Context, a *archive, section string) (*site, error) {
+	s := newSite()
+	if strings.HasPrefix(section, "markdown/") {
+		return s, parseMarkdown(c, a, section[len("markdown/"):], s)
+	}
+	var err error
+	switch section {
+	case "all":
+		err = parseAll(c, a, s)
+	case "files":
+		err = parseFiles(c, a, s)
+	case "pages":
+		err = parsePages(c, a, s)
+	case "groups":
+		err = parseGroups(c, a, s)
+	case "wxr":
+		err = parseWXRArchive(c, a, s)
+	default:
+		err = fmt.Errorf("unknown section of import %q", section)
+	}
+	return s, err
+}
+
+// textDiff returns a diff of a and b if both are texts.
+func textDiff(a, b []byte) []diffLine {
+	if len(a) > chunkSize || len(b) > chunkSize || !utf8.Valid(a) || !utf8.Valid(b) {
+		return nil
+	}
+	return diffLines(string(a), string(b))
+}
+
+func jsonDiff(a, b interface{}) []diffLine {
+	x, _ := json.MarshalIndent(a, "", "\t")
+	y, _ := json.MarshalIndent(b, "", "\t")
+	return textDiff(x, y)
+}
+
+func digest(v interface{}) string {
+	d, _ := json.Marshal(v)
+	h := sha1.New()
+	h.Write(d)
+	return fmt.Sprintf("%x", h.Sum(nil))
+}
+
+// importMode is a way imported entities are combined with the existing ones:
+// "merge" updates entities with the same keys, "replace" also deletes entities
+// missing in the archive, "field" updates entities with the same value of Field
+// and "append" always adds new entities.
+type importMode struct {
+	Name  string
+	Field string
+}
+
+var replaceMode = importMode{Name: "replace"}
+
+func parseMode(r *http.Request) (importMode, error) {
+	m := importMode{Name: r.FormValue("mode"), Field: strings.TrimSpace(r.FormValue("field"))}
+	switch m.Name {
+	case "":
+		m.Name = "merge"
+		m.Field = ""
+	case "merge", "replace", "append":
+		m.Field = ""
+	case "field":
+		if len(m.Field) == 0 {
+			return m, &scmsError{"field for merging must not be empty"}
+		}
+	default:
+		return m, fmt.Errorf("unknown mode of import %q", m.Name)
+	}
+	return m, nil
+}
+
+// key returns a key an entity v named name is matched by.
+func (this importMode) key(name string, v interface{}) (string, bool) {
+	switch this.Name {
+	case "merge", "replace":
+		return name, true
+	case "field":
+		return fieldValue(v, this.Field)
+	}
+	return "", false
+}
+
+// match returns an index of the existing entity the imported entity v named name is combined with.
+func (this importMode) match(index map[string]int, name string, v interface{}) (int, bool) {
+	k, ok := this.key(name, v)
+	if !ok {
+		return -1, false
+	}
+	i, ok := index[k]
+	return i, ok
+}
+
+// fieldValue returns a value of the field name of a struct or of Values as a string.
+func fieldValue(v interface{}, name string) (string, bool) {
+	if m, ok := v.(Values); ok {
+		d, ok := m[name]
+		if !ok {
+			return "", false
+		}
+		return fmt.Sprint(d), true
+	}
+	f := reflect.Indirect(reflect.ValueOf(v)).FieldByName(name)
+	if !f.IsValid() {
+		return "", false
+	}
+	return fmt.Sprint(f.Interface()), true
+}
+
+// uniqueName returns name or name with a numeric suffix before its extension
+// that is not taken yet.
+func uniqueName(name string, taken map[string]bool) string {
+	if !taken[name] {
+		return name
+	}
+	ext := path.Ext(name)
+	base := name[:len(name)-len(ext)]
+	i := 2
+	for taken[fmt.Sprintf("%s-%d%s", base, i, ext)] {
+		i++
+	}
+	return fmt.Sprintf("%s-%d%s", base, i, ext)
+}
+
+// changes compares the site with the current content.
+func (this *site) changes(c appengine.Context, mode importMode) ([]*Change, error) {
+	if this.keyed && mode.Name != "merge" {
+		return nil, fmt.Errorf("records of the archive are bound by keys, mode %q is not supported", mode.Name)
+	}
+	if this.partial && mode.Name == "replace" {
+		return nil, &scmsError{"some entities are rejected or missing, replacing would delete them, fix them or use another mode"}
+	}
+	var out []*Change
+	if this.sections["$Files"] {
+		ch, err := this.fileChanges(c, mode)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, ch...)
+	}
+	if this.sections["$Pages"] {
+		ch, err := this.pageChanges(c, mode)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, ch...)
+	}
+	for _, g := range this.groups {
+		ch, err := g.changes(c, mode, this.remap)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, ch...)
+	}
+	if this.sections["$Groups"] && mode.Name == "replace" {
+		ch, err := this.absentGroups(c)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, ch...)
+	}
+	if this.config != nil {
+		var cfg Config
+		k := datastore.NewKey(c, "$Config", "config", 0, nil)
+		if err := datastore.Get(c, k, &cfg); err != nil && err != datastore.ErrNoSuchEntity {
+			return nil, err
+		}
+		if !cfg.Default.Equal(this.config.Default) {
+			ch := &Change{Action: "change", Kind: "$Config", Name: "config", key: k, value: this.config}
+			ch.sum = digest(toPath(cfg.Default)) + ">" + digest(toPath(this.config.Default))
+			ch.Diff = jsonDiff(config{toPath(cfg.Default)}, config{toPath(this.config.Default)})
+			out = append(out, ch)
+		}
+	}
+	return out, nil
+}
+
+// absentGroups returns deletions of groups which are not in the site and of
+// their records.
+func (this *site) absentGroups(c appengine.Context) ([]*Change, error) {
+	var out []*Change
+	imported := make(map[string]bool)
+	for _, g := range this.groups {
+		imported[g.name] = true
+	}
+	keys, err := datastore.NewQuery("$Groups").KeysOnly().GetAll(c, nil)
+	if err != nil {
+		return nil, err
+	}
+	for _, gk := range keys {
+		name := gk.StringID()
+		if imported[name] {
+			continue
+		}
+		var d []entity
+		rk, err := datastore.NewQuery(name).GetAll(c, &d)
+		if err != nil {
+			return nil, err
+		}
+		for i, k := range rk {
+			out = append(out, &Change{Action: "delete", Kind: name, Name: k.String(), sum: digest(d[i].data), key: k})
+		}
+		out = append(out, &Change{Action: "delete", Kind: "$Groups", Name: name, sum: name, key: gk})
+	}
+	return out, nil
+}
+
+func fileDigest(i fileInfo) string {
+	return strings.Join([]string{i.Hash, i.ContentType, i.Alt, i.Caption, i.Credit}, "|")
+}
+
+func (this *site) fileChanges(c appengine.Context, mode importMode) ([]*Change, error) {
+	var out []*Change
+	var current []*File
+	for t := datastore.NewQuery("$Files").Run(c); ; {
+		f := new(File)
+		if _, err := t.Next(f); err == datastore.Done {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		if len(f.Hash) == 0 {
+			f.setData(f.Data)
+		}
+		current = append(current, f)
+	}
+	taken := make(map[string]bool)
+	index := make(map[string]int)
+	for i, f := range current {
+		taken[f.Name] = true
+		if k, ok := mode.key(f.Name, f); ok {
+			index[k] = i
+		}
+	}
+	matched := make(map[int]bool)
+	for _, v := range this.files {
+		v := v
+		ch := &Change{Action: "create", Kind: "$Files", Name: v.info.Name, sum: fileDigest(v.info)}
+		if i, ok := mode.match(index, v.info.Name, v.info); ok {
+			old := current[i]
+			matched[i] = true
+			ch.Name = old.Name
+			oi := fileInfo{Hash: old.Hash, ContentType: old.ContentType, Alt: old.Alt, Caption: old.Caption, Credit: old.Credit}
+			if fileDigest(oi) == ch.sum {
+				continue
+			}
+			ch.Action = "change"
+			ch.sum = fileDigest(oi) + ">" + ch.sum
+			if old.Hash != v.info.Hash && compressible(old.contentType(c)) && v.entry.UncompressedSize <= chunkSize {
+				a, err := old.content(c)
+				if err != nil {
+					return nil, err
+				}
+				b, err := readEntry(v.entry)
+				if err != nil {
+					return nil, err
+				}
+				ch.Diff = textDiff(a, b)
+			}
+		} else {
+			ch.Name = uniqueName(v.info.Name, taken)
+			taken[ch.Name] = true
+		}
+		f := &File{Name: ch.Name}
+		ch.key = datastore.NewKey(c, "$Files", f.Name, 0, nil)
+		ch.value = f
+		ch.prepare = func(c appengine.Context) error {
+			return v.prepare(c, ch.key, f)
+		}
+		out = append(out, ch)
+	}
+	if mode.Name == "replace" {
+		for i, f := range current {
+			if matched[i] {
+				continue
+			}
+			k := datastore.NewKey(c, "$Files", f.Name, 0, nil)
+			out = append(out, &Change{Action: "delete", Kind: "$Files", Name: f.Name, sum: f.Hash, key: k})
+		}
+	}
+	return out, nil
+}
+
+// prepare stores the content of the imported file in f, large files are stored
+// in chunks which are not visible until f is stored.
+func (this importedFile) prepare(c appengine.Context, key *datastore.Key, f *File) error {
+	if err := datastore.Get(c, key, f); err != nil && err != datastore.ErrNoSuchEntity {
+		return err
+	}
+	if err := f.setContent(c, this.entry.Open, int64(this.entry.UncompressedSize)); err != nil {
+		c.Errorf("reading of file has failed: %q", err)
+		return err
+	}
+	f.ContentType = this.info.ContentType
+	f.Alt, f.Caption, f.Credit = this.info.Alt, this.info.Caption, this.info.Credit
+	if len(this.info.Uploader) != 0 {
+		f.Uploader = this.info.Uploader
+	}
+	if !this.info.Uploaded.IsZero() {
+		f.Uploaded = this.info.Uploaded
+	}
+	return nil
+}
+
+func (this *site) pageChanges(c appengine.Context, mode importMode) ([]*Change, error) {
+	var out []*Change
+	var p []Page
+	keys, err := datastore.NewQuery("$Pages").GetAll(c, &p)
+	if err != nil {
+		return nil, err
+	}
+	taken := make(map[string]bool)
+	index := make(map[string]int)
+	for i, k := range keys {
+		taken[k.StringID()] = true
+		if s, ok := mode.key(k.StringID(), &p[i]); ok {
+			index[s] = i
+		}
+	}
+	matched := make(map[int]bool)
+	for _, v := range this.pages {
+		v := v
+		from := datastore.NewKey(c, "$Pages", v.Name, 0, nil)
+		if i, ok := mode.match(index, v.Name, &v); ok {
+			matched[i] = true
+			v.Name = keys[i].StringID()
+			if digest(p[i]) == digest(v) {
+				if !from.Equal(keys[i]) {
+					this.remap[from.Encode()] = keys[i]
+				}
+				continue
+			}
+			ch := &Change{Action: "change", Kind: "$Pages", Name: v.Name, sum: digest(p[i]) + ">" + digest(v)}
+			ch.Diff = jsonDiff(p[i], v)
+			ch.key, ch.from, ch.value = keys[i], from, &v
+			out = append(out, ch)
+			continue
+		}
+		v.Name = uniqueName(v.Name, taken)
+		taken[v.Name] = true
+		ch := &Change{Action: "create", Kind: "$Pages", Name: v.Name, sum: digest(v)}
+		ch.key, ch.from, ch.value = datastore.NewKey(c, "$Pages", v.Name, 0, nil), from, &v
+		out = append(out, ch)
+	}
+	if mode.Name == "replace" {
+		for i, k := range keys {
+			if !matched[i] {
+				out = append(out, &Change{Action: "delete", Kind: "$Pages", Name: k.StringID(), sum: digest(p[i]), key: k})
+			}
+		}
+	}
+	return out, nil
+}
+
+func parentID(k *datastore.Key) string {
+	if k == nil {
+		return ""
+	}
+	return k.Encode()
+}
+
+func (this importedGroup) changes(c appengine.Context, mode importMode, remap map[string]*datastore.Key) ([]*Change, error) {
+	var out []*Change
+	gk := datastore.NewKey(c, "$Groups", this.name, 0, nil)
+	ng := &Group{Name: this.name}
+	if this.settings != nil {
+		ng.Slug = this.settings.Slug
+	}
+	var g Group
+	if err := datastore.Get(c, gk, &g); err == datastore.ErrNoSuchEntity {
+		out = append(out, &Change{Action: "create", Kind: "$Groups", Name: this.name, sum: this.name + "\n" + ng.Slug, key: gk, value: ng})
+	} else if err != nil {
+		return nil, err
+	} else if this.settings != nil && g.Slug != ng.Slug {
+		out = append(out, &Change{Action: "change", Kind: "$Groups", Name: this.name, sum: this.name + "\n" + g.Slug + ">" + ng.Slug, key: gk, value: ng})
+	}
+	var d []entity
+	keys, err := datastore.NewQuery(this.name).GetAll(c, &d)
+	if err != nil {
+		return nil, err
+	}
+	// records are matched by their keys or by a value of the field among
+	// records with the same parent
+	index := make(map[string]int)
+	for i, k := range keys {
+		if mode.Name == "field" {
+			if s, ok := fieldValue(d[i].data, mode.Field); ok {
+				index[parentID(k.Parent())+"\n"+s] = i
+			}
+		} else {
+			index[k.Encode()] = i
+		}
+	}
+	matched := make(map[int]bool)
+	var walk func(cur Cursor, parent *Value)
+	walk = func(cur Cursor, parent *Value) {
+		for i := range cur {
+			v := &cur[i]
+			from := v.Key
+			j, found := -1, false
+			switch mode.Name {
+			case "merge", "replace":
+				if v.Key != nil {
+					j, found = index[v.Key.Encode()]
+				}
+			case "field":
+				v.Key = nil
+				if parent == nil || parent.Key != nil {
+					var pk *datastore.Key
+					if parent != nil {
+						pk = parent.Key
+					}
+					if s, ok := fieldValue(v.Data, mode.Field); ok {
+						if j, found = index[parentID(pk)+"\n"+s]; found {
+							v.Key = keys[j]
+						}
+					}
+				}
+			default:
+				v.Key = nil
+			}
+			ch := &Change{Action: "create", Kind: this.name, Name: "new record", sum: digest(v.Data)}
+			if v.Key != nil {
+				ch.Name = v.Key.String()
+			}
+			if found {
+				matched[j] = true
+				if digest(d[j].data) == ch.sum {
+					if from != nil && !from.Equal(v.Key) {
+						remap[from.Encode()] = v.Key
+					}
+					walk(v.Children, v)
+					continue
+				}
+				ch.Action = "change"
+				ch.sum = digest(d[j].data) + ">" + ch.sum
+				ch.Diff = jsonDiff(d[j].data, v.Data)
+			}
+			ch.value = &entity{data: v.Data}
+			ch.from = from
+			ch.prepare = recordKey(this.name, v, parent, ch)
+			out = append(out, ch)
+			walk(v.Children, v)
+		}
+	}
+	walk(this.records, nil)
+	if mode.Name == "replace" {
+		for i, k := range keys {
+			if !matched[i] {
+				out = append(out, &Change{Action: "delete", Kind: this.name, Name: k.String(), sum: digest(d[i].data), key: k})
+			}
+		}
+	}
+	return out, nil
+}
+
+// recordKey returns a function setting the key of the change ch of the record v.
+// A new record gets an allocated key, so its children have to be prepared after it.
+func recordKey(kind string, v *Value, parent *Value, ch *Change) func(c appengine.Context) error {
+	return func(c appengine.Context) error {
+		if v.Key == nil {
+			var p *datastore.Key
+			if parent != nil {
+				p = parent.Key
+			}
+			id, _, err := datastore.AllocateIDs(c, kind, p, 1)
+			if err != nil {
+				return err
+			}
+			v.Key = datastore.NewKey(c, kind, "", id, p)
+		}
+		ch.key = v.Key
+		return nil
+	}
+}
+
+// planSum returns a digest of changes, it is used to check that changes
+// being applied are the previewed ones.
+func planSum(changes []*Change) string {
+	h := sha1.New()
+	for _, v := range changes {
+		fmt.Fprintf(h, "%s\n%s\n%s\n%s\n", v.Action, v.Kind, v.Name, v.sum)
+	}
+	return fmt.Sprintf("%x", h.Sum(nil))
+}
+
+// commitChanges applies changes. Everything that can fail without changing
+// the site is done first: the archive is read, chunks are stored and keys are
+// allocated. Then a snapshot of the site is taken and the changes are written
+// to a journal which is switched on at once, see journal.go: an import which
+// fails before that changes nothing.
+func commitChanges(c appengine.Context, name string, changes []*Change, remap map[string]*datastore.Key) error {
+	for _, v := range changes {
+		if v.prepare == nil {
+			continue
+		}
+		if err := v.prepare(c); err != nil {
+			return err
+		}
+	}
+	remapKeys(changes, remap)
+	if err := takeSnapshot(c, "before import of "+name); err != nil {
+		return err
+	}
+	j, err := newJournal(c, "import of "+name, true)
+	if err != nil {
+		return err
+	}
+	for _, v := range changes {
+		c.Infof("import: %s %s %q", v.Action, v.Kind, v.Name)
+		if err := j.add(v.key, v.value); err != nil {
+			c.Errorf("import has failed: %v", err)
+			j.discard()
+			return err
+		}
+	}
+	return j.commit()
+}
+
+func entryHash(f *zip.File) (string, error) {
+	rc, err := f.Open()
+	if err != nil {
+		return "", err
+	}
+	defer rc.Close()
+	h := sha1.New()
+	if _, err := io.CopyN(h, rc, int64(f.UncompressedSize)); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
+
+// stageImport keeps an uploaded archive in "$Imports".
+func stageImport(c appengine.Context, r *http.Request) (*File, error) {
+	file, h, err := r.FormFile("file")
+	if err != nil {
+		c.Errorf("can't get an imported archive: %q", err)
+		return nil, err
+	}
+	n, err := file.Seek(0, os.SEEK_END)
+	if err != nil {
+		return nil, err
+	}
+	f := &File{Name: path.Base(h.Filename)}
+	if err := f.setContent(c, sectionOpener(file, n), n); err != nil {
+		return nil, err
+	}
+	return f, stage(c, f)
+}
+
+func stage(c appengine.Context, f *File) error {
+	_, err := datastore.Put(c, datastore.NewKey(c, "$Imports", f.Hash, 0, nil), f)
+	return err
+}
+
+// importExpiry is how long a staged import is kept.
+const importExpiry = 24 * time.Hour
+
+// expireImports removes staged imports older than importExpiry, their
+// chunks are removed by sweepChunks.
+func expireImports(c appengine.Context) error {
+	keys, err := datastore.NewQuery("$Imports").Filter("Uploaded <", time.Now().Add(-importExpiry)).KeysOnly().GetAll(c, nil)
+	if err != nil {
+		return err
+	}
+	c.Infof("removing %v expired imports", len(keys))
+	return datastore.DeleteMulti(c, keys)
+}
+
+// loadImport returns the import kept in "$Imports" with the hash id.
+func loadImport(c appengine.Context, id string) (*File, error) {
+	var f File
+	if err := datastore.Get(c, datastore.NewKey(c, "$Imports", id, 0, nil), &f); err != nil {
+		return nil, err
+	}
+	return &f, nil
+}
+
+// openSite parses the staged import f of section, it is either an archive,
+// CSV of a group for sections "csv/<group>" or an export of WordPress
+// without files for section "wxr".
+func openSite(c appengine.Context, f *File, section string) (*site, []rejection, error) {
+	if strings.HasPrefix(section, "csv/") {
+		s := newSite()
+		rejected, err := parseCSV(c, f.reader(c), section[len("csv/"):], s)
+		return s, rejected, err
+	}
+	if section == "wxr" && !isZip(f.reader(c).(io.ReaderAt)) {
+		return openWXR(c, f.reader(c))
+	}
+	a, err := openArchive(c, f.reader(c).(io.ReaderAt), f.Size)
+	if err != nil {
+		return nil, nil, err
+	}
+	s, err := parseSite(c, a, section)
+	return s, *a.rejected, err
+}
+
+type importData struct {
+	Id       string
+	Name     string
+	Section  string
+	Mode     importMode
+	Back     string
+	Sum      string
+	Changes  []*Change
+	Rejected []rejection
+	Manifest *manifest
+}
+
+var importTemplate = template.Must(template.New("import").Parse(
+	`
+<html>
+<body>
+<a href="/">Main</a><br>
+<a href="/editor">Editor</a><br>
+<a href="/logout">Logout</a><br>
+<fieldset>
+	<legend>Import of "{{.Name}}", mode "{{.Mode.Name}}"{{with .Mode.Field}} by field "{{.}}"{{end}}</legend>
+	{{with .Manifest}}Archive: {{.Describe}}<br>{{end}}
+	{{if .Rejected}}
+	Rejected entries:<br>
+	{{range .Rejected}}&nbsp;&nbsp;{{.Name}}: {{.Reason}}<br>{{end}}
+	{{end}}
+	{{if .Changes}}
+	{{range .Changes}}
+	{{.Action}} {{.Kind}} "{{.Name}}"<br>
+	{{if .Diff}}
+<pre>
+{{range .Diff}}{{.Op}} {{.Text}}
+{{end}}
+</pre>
+	{{end}}
+	{{end}}
+	{{else}}
+	There are no changes.<br>
+	{{end}}
+	<form action="/editor/import" method="post">
+		<input type="hidden" name="id" value="{{.Id}}">
+		<input type="hidden" name="section" value="{{.Section}}">
+		<input type="hidden" name="back" value="{{.Back}}">
+		<input type="hidden" name="sum" value="{{.Sum}}">
+		<input type="hidden" name="mode" value="{{.Mode.Name}}">
+		<input type="hidden" name="field" value="{{.Mode.Field}}">
+		{{if .Changes}}<input type="submit" name="action" value="Apply">{{end}}
+		<input type="submit" name="action" value="Cancel">
+	</form>
+</fieldset>
+</body>
+</html>
+`))
+
+// importModeTemplate defines "importMode" with fields of a mode of import
+// for forms of uploading, it is added to templates of the editor.
+const importModeTemplate = `{{define "importMode"}}<label>Mode: <select name="mode">
+			<option value="merge">merge by key</option>
+			<option value="field">merge by field</option>
+			<option value="replace">replace</option>
+			<option value="append">append</option>
+		</select></label>
+		<label>Field: <input type="text" name="field" value=""></label><br>{{end}}`
+
+// previewImport stages an uploaded archive of section and shows changes it makes.
+func previewImport(c appengine.Context, w http.ResponseWriter, r *http.Request, section string, back string) error {
+	f, err := stageImport(c, r)
+	if err != nil {
+		return err
+	}
+	mode, err := parseMode(r)
+	if err != nil {
+		return err
+	}
+	return previewStaged(c, w, f, section, mode, back)
+}
+
+func previewStaged(c appengine.Context, w http.ResponseWriter, f *File, section string, mode importMode, back string) error {
+	s, rejected, err := openSite(c, f, section)
+	if err != nil {
+		return err
+	}
+	data := importData{
+		Id:       f.Hash,
+		Name:     f.Name,
+		Section:  section,
+		Mode:     mode,
+		Back:     back,
+		Rejected: rejected,
+		Manifest: s.manifest,
+	}
+	if data.Changes, err = s.changes(c, data.Mode); err != nil {
+		return err
+	}
+	data.Sum = planSum(data.Changes)
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	return importTemplate.Execute(w, &data)
+}
+
+func importHandler(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+	if u := user.Current(c); u == nil {
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return
+	}
+	if r.Method != "POST" {
+		error404(w, r)
+		return
+	}
+	id := r.FormValue("id")
+	back := r.FormValue("back")
+	if !strings.HasPrefix(back, "/editor") {
+		back = "/editor"
+	}
+	if r.FormValue("action") == "Apply" {
+		f, err := loadImport(c, id)
+		if err != nil {
+			errorX(c, w, err)
+			return
+		}
+		s, _, err := openSite(c, f, r.FormValue("section"))
+		if err != nil {
+			errorX(c, w, err)
+			return
+		}
+		mode, err := parseMode(r)
+		if err != nil {
+			errorX(c, w, err)
+			return
+		}
+		changes, err := s.changes(c, mode)
+		if err != nil {
+			errorX(c, w, err)
+			return
+		}
+		if planSum(changes) != r.FormValue("sum") {
+			errorX(c, w, &scmsError{"the site has been changed after the preview of the import, upload the archive again"})
+			return
+		}
+		if err := commitChanges(c, f.Name, changes, s.remap); err != nil {
+			errorX(c, w, err)
+			return
+		}
+		invalidate(c)
+	}
+	if err := datastore.Delete(c, datastore.NewKey(c, "$Imports", id, 0, nil)); err != nil && err != datastore.ErrNoSuchEntity {
+		c.Errorf("can't remove the staged import %q: %v", id, err)
+	}
+	http.Redirect(w, r, back, http.StatusFound)
+}
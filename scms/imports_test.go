@@ -0,0 +1,34 @@
+// Copyright (c) 2012 Alexander Sychev. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package scms
+
+import (
+	"testing"
+)
+
+func TestImportModeMatch(t *testing.T) {
+	index := map[string]int{"a": 0, "5": 1}
+	for _, v := range []struct {
+		mode  importMode
+		name  string
+		v     interface{}
+		i     int
+		found bool
+	}{
+		{importMode{Name: "merge"}, "a", nil, 0, true},
+		{importMode{Name: "replace"}, "5", nil, 1, true},
+		{importMode{Name: "merge"}, "b", nil, 0, false},
+		{importMode{Name: "append"}, "a", nil, -1, false},
+		{importMode{Name: "field", Field: "Title"}, "x", Values{"Title": int64(5)}, 1, true},
+		{importMode{Name: "field", Field: "Title"}, "a", Values{"Name": "a"}, -1, false},
+		{importMode{Name: "field", Field: "Title"}, "x", Page{Name: "x", Title: "a"}, 0, true},
+		{importMode{Name: "field", Field: "Unknown"}, "a", &Page{Name: "a"}, -1, false},
+	} {
+		i, found := v.mode.match(index, v.name, v.v)
+		if found != v.found || found && i != v.i {
+			t.Errorf("%v: match(%q, %v) = %v, %v, want %v, %v", v.mode, v.name, v.v, i, found, v.i, v.found)
+		}
+	}
+}
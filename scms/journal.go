@@ -0,0 +1,245 @@
+// Copyright (c) 2012 Alexander Sychev. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package scms
+
+import (
+	"appengine"
+	"appengine/datastore"
+	"strings"
+	"time"
+)
+
+// Imports and publishing change entities of many entity groups, which a
+// transaction can't span. Their changes are written to a journal first: new
+// versions of entities are staged in "$Staged" and keys of the entities in
+// batches of the journal in "$Batches", nothing of the site is changed yet.
+// Then the journal is switched on by one put of its "$Journals" entity and
+// applied batch by batch. If writing of the journal fails, the site stays as
+// it was. A journal which is switched on is applied to the end even if
+// applying fails: it is resumed before the next journal is written and by
+// cron. So either all changes of a journal are made or none of them, though
+// a reader may see a part of them while the journal is being applied.
+
+// journal is a set of changes applied at once when Committed is set.
+type journal struct {
+	Name      string
+	Created   time.Time
+	Committed bool
+	Batches   int
+	// Revisions is set if revisions of changed entities are to be saved,
+	// drafts have their revisions already
+	Revisions bool
+}
+
+// journalBatch is a part of a journal: entities of Keys are written with
+// the staged versions if Put is set and deleted otherwise.
+type journalBatch struct {
+	Keys []*datastore.Key
+	Put  []bool
+}
+
+// journalBatchSize is the number of changes of a batch, staged versions of
+// files are up to 1 MB each.
+const journalBatchSize = 10
+
+// journalExpiry is the time after which a journal which is not switched on
+// is considered failed and removed by cron.
+const journalExpiry = time.Hour
+
+func batchKey(c appengine.Context, jk *datastore.Key, i int) *datastore.Key {
+	return datastore.NewKey(c, "$Batches", "", int64(i+1), jk)
+}
+
+func stagedKey(c appengine.Context, bk *datastore.Key, i int) *datastore.Key {
+	return datastore.NewKey(c, "$Staged", "", int64(i+1), bk)
+}
+
+// journalWriter writes changes to a journal one batch at a time.
+type journalWriter struct {
+	c     appengine.Context
+	key   *datastore.Key
+	j     journal
+	batch journalBatch
+	// changes counts added changes
+	changes int
+}
+
+// newJournal starts a journal named name, journals which are switched on
+// are applied before.
+func newJournal(c appengine.Context, name string, revisions bool) (*journalWriter, error) {
+	if err := resumeJournals(c, false); err != nil {
+		return nil, err
+	}
+	w := &journalWriter{c: c, j: journal{Name: name, Created: time.Now(), Revisions: revisions}}
+	var err error
+	if w.key, err = datastore.Put(c, datastore.NewIncompleteKey(c, "$Journals", nil), &w.j); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// add stages src as the new version of k, k is deleted if src is nil.
+func (this *journalWriter) add(k *datastore.Key, src interface{}) error {
+	if src != nil {
+		if _, err := datastore.Put(this.c, stagedKey(this.c, batchKey(this.c, this.key, this.j.Batches), len(this.batch.Keys)), src); err != nil {
+			return err
+		}
+	}
+	this.batch.Keys = append(this.batch.Keys, k)
+	this.batch.Put = append(this.batch.Put, src != nil)
+	this.changes++
+	if len(this.batch.Keys) == journalBatchSize {
+		return this.flush()
+	}
+	return nil
+}
+
+func (this *journalWriter) flush() error {
+	if len(this.batch.Keys) == 0 {
+		return nil
+	}
+	if _, err := datastore.Put(this.c, batchKey(this.c, this.key, this.j.Batches), &this.batch); err != nil {
+		return err
+	}
+	this.j.Batches++
+	this.batch = journalBatch{}
+	return nil
+}
+
+// commit switches the journal on and applies it.
+func (this *journalWriter) commit() error {
+	if err := this.flush(); err != nil {
+		this.discard()
+		return err
+	}
+	this.j.Committed = true
+	// a failed put may switch the journal on nevertheless, so the journal is
+	// left to cron which either applies or removes it
+	if _, err := datastore.Put(this.c, this.key, &this.j); err != nil {
+		return err
+	}
+	this.c.Infof("journal %q of %v changes is switched on", this.j.Name, this.changes)
+	if err := applyJournal(this.c, this.key, &this.j); err != nil {
+		this.c.Errorf("journal %q is switched on, it is applied later: %v", this.j.Name, err)
+		return err
+	}
+	return nil
+}
+
+// discard removes the journal which is not switched on.
+func (this *journalWriter) discard() {
+	if err := discardJournal(this.c, this.key); err != nil {
+		this.c.Errorf("can't remove journal %q, it is removed by cron: %v", this.j.Name, err)
+	}
+}
+
+// applyJournal writes the changes of the journal j. Every batch is removed
+// when it is written, so applying again resumes with the next one.
+func applyJournal(c appengine.Context, jk *datastore.Key, j *journal) error {
+	for i := 0; i < j.Batches; i++ {
+		bk := batchKey(c, jk, i)
+		var b journalBatch
+		if err := datastore.Get(c, bk, &b); err == datastore.ErrNoSuchEntity {
+			continue
+		} else if err != nil {
+			return err
+		}
+		var staged, puts, deletes []*datastore.Key
+		for n, k := range b.Keys {
+			if b.Put[n] {
+				staged = append(staged, stagedKey(c, bk, n))
+				puts = append(puts, k)
+			} else {
+				deletes = append(deletes, k)
+			}
+		}
+		d := make([]entity, len(staged))
+		if len(staged) != 0 {
+			if err := datastore.GetMulti(c, staged, d); err != nil {
+				return err
+			}
+			if _, err := datastore.PutMulti(c, puts, d); err != nil {
+				return err
+			}
+		}
+		if len(deletes) != 0 {
+			if err := datastore.DeleteMulti(c, deletes); err != nil {
+				return err
+			}
+		}
+		if err := discardDrafts(c, b.Keys); err != nil {
+			return err
+		}
+		for n, k := range puts {
+			written(c, k, &d[n], j.Revisions)
+		}
+		for _, k := range deletes {
+			if strings.HasPrefix(k.Kind(), "$") {
+				continue
+			}
+			if err := removeSlugs(c, k); err != nil {
+				c.Errorf("can't remove slugs of %v: %v", k, err)
+			}
+		}
+		if err := datastore.DeleteMulti(c, append(staged, bk)); err != nil {
+			return err
+		}
+	}
+	return datastore.Delete(c, jk)
+}
+
+// written updates revisions and slugs of the entity k written with e.
+func written(c appengine.Context, k *datastore.Key, e *entity, revisions bool) {
+	if revisions && (k.Kind() == "$Pages" || k.Kind() == "$Files" || !strings.HasPrefix(k.Kind(), "$")) {
+		if err := saveRevision(c, k, e); err != nil {
+			c.Errorf("can't save revision of %v: %v", k, err)
+		}
+	}
+	switch {
+	case k.Kind() == "$Groups":
+		if err := updateSlugs(c, k.StringID()); err != nil {
+			c.Errorf("can't update slugs of group %q: %v", k.StringID(), err)
+		}
+	case !strings.HasPrefix(k.Kind(), "$"):
+		if err := updateSlug(c, k, e.data); err != nil {
+			c.Errorf("can't update slug of %v: %v", k, err)
+		}
+	}
+}
+
+// discardJournal removes the journal jk with its batches and staged versions,
+// they are all returned by the ancestor query of jk.
+func discardJournal(c appengine.Context, jk *datastore.Key) error {
+	keys, err := datastore.NewQuery("").Ancestor(jk).KeysOnly().GetAll(c, nil)
+	if err != nil {
+		return err
+	}
+	return deleteAll(c, keys)
+}
+
+// resumeJournals applies journals which are switched on, journals which are
+// not switched on within journalExpiry are removed if expire is set.
+func resumeJournals(c appengine.Context, expire bool) error {
+	var js []journal
+	keys, err := datastore.NewQuery("$Journals").Order("Created").GetAll(c, &js)
+	if err != nil {
+		return err
+	}
+	for i := range js {
+		switch {
+		case js[i].Committed:
+			c.Infof("resuming journal %q", js[i].Name)
+			if err := applyJournal(c, keys[i], &js[i]); err != nil {
+				return err
+			}
+		case expire && js[i].Created.Before(time.Now().Add(-journalExpiry)):
+			c.Infof("removing failed journal %q", js[i].Name)
+			if err := discardJournal(c, keys[i]); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
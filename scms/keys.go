@@ -0,0 +1,262 @@
+// Copyright (c) 2012 Alexander Sychev. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package scms
+
+import (
+	"appengine"
+	"appengine/datastore"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+)
+
+// Encoded keys contain the application and the namespace, so exported records
+// refer to keys by portable paths: kinds and IDs of a key and its ancestors
+// from the root, an ID is a number for integer IDs and a string for names,
+// e.g. [["Posts", 42], ["Comments", "first"]]. Key fields of records are
+// exported as {"$Key": path}.
+type keyPath [][]interface{}
+
+func toPath(k *datastore.Key) keyPath {
+	var out keyPath
+	for ; k != nil; k = k.Parent() {
+		var id interface{} = k.IntID()
+		if len(k.StringID()) != 0 {
+			id = k.StringID()
+		}
+		out = append(keyPath{{k.Kind(), id}}, out...)
+	}
+	return out
+}
+
+// key builds a key of the path in the application of c.
+func (this keyPath) key(c appengine.Context) (*datastore.Key, error) {
+	var k *datastore.Key
+	for _, v := range this {
+		if len(v) != 2 {
+			return nil, fmt.Errorf("invalid element of key path: %v", v)
+		}
+		kind, ok := v[0].(string)
+		if !ok || len(kind) == 0 {
+			return nil, fmt.Errorf("invalid kind in key path: %v", v[0])
+		}
+		switch id := v[1].(type) {
+		case string:
+			k = datastore.NewKey(c, kind, id, 0, k)
+		case float64:
+			k = datastore.NewKey(c, kind, "", int64(id), k)
+		case int64:
+			k = datastore.NewKey(c, kind, "", id, k)
+		default:
+			return nil, fmt.Errorf("invalid ID in key path: %v", v[1])
+		}
+	}
+	if k == nil {
+		return nil, &scmsError{"empty key path"}
+	}
+	return k, nil
+}
+
+// decodeKey returns a key of the target application for an exported key,
+// which is either a key path or an encoded key of older exports.
+func decodeKey(c appengine.Context, raw json.RawMessage) (*datastore.Key, error) {
+	if len(raw) == 0 || string(raw) == "null" {
+		return nil, nil
+	}
+	var s string
+	if err := json.Unmarshal(raw, &s); err == nil {
+		k, err := datastore.DecodeKey(s)
+		if err != nil {
+			return nil, err
+		}
+		return toPath(k).key(c)
+	}
+	var p keyPath
+	if err := json.Unmarshal(raw, &p); err != nil {
+		return nil, err
+	}
+	return p.key(c)
+}
+
+// record is a portable form of Value used by exports of groups.
+type record struct {
+	Key      json.RawMessage        `json:"$Key,omitempty"`
+	Data     map[string]interface{} `json:"$Data,omitempty"`
+	Children []record               `json:"$Children,omitempty"`
+}
+
+func exportRecords(cur Cursor) ([]record, error) {
+	out := make([]record, 0, len(cur))
+	for _, v := range cur {
+		var r record
+		if v.Key != nil {
+			var err error
+			if r.Key, err = json.Marshal(toPath(v.Key)); err != nil {
+				return nil, err
+			}
+		}
+		r.Data = make(map[string]interface{})
+		for n, d := range v.Data {
+			if k, ok := d.(*datastore.Key); ok {
+				d = map[string]interface{}{"$Key": toPath(k)}
+			}
+			r.Data[n] = d
+		}
+		var err error
+		if r.Children, err = exportRecords(v.Children); err != nil {
+			return nil, err
+		}
+		out = append(out, r)
+	}
+	return out, nil
+}
+
+// writeRecords writes records of cur to w as json.MarshalIndent writes them.
+// Records are converted and marshalled one top-level record at a time, so
+// the JSON of a whole group is never kept in memory. Records are ordered by
+// their keys if sorted is true.
+func writeRecords(w io.Writer, cur Cursor, sorted bool) error {
+	if sorted {
+		s := cursorByKey{cur: append(Cursor(nil), cur...), keys: make([]string, len(cur))}
+		for i, v := range s.cur {
+			if v.Key != nil {
+				k, err := json.Marshal(toPath(v.Key))
+				if err != nil {
+					return err
+				}
+				s.keys[i] = string(k)
+			}
+		}
+		sort.Sort(s)
+		cur = s.cur
+	}
+	rw := newRecordWriter(w)
+	for _, v := range cur {
+		if err := rw.write(v, sorted); err != nil {
+			return err
+		}
+	}
+	return rw.close()
+}
+
+// recordWriter writes records to w one top-level record at a time as
+// json.MarshalIndent writes an array of them.
+type recordWriter struct {
+	w   io.Writer
+	sep string
+}
+
+func newRecordWriter(w io.Writer) *recordWriter {
+	return &recordWriter{w: w, sep: "[\n\t"}
+}
+
+// write writes the record v with its children, the children are ordered by
+// their keys if sorted is true.
+func (this *recordWriter) write(v Value, sorted bool) error {
+	recs, err := exportRecords(Cursor{v})
+	if err != nil {
+		return err
+	}
+	if sorted {
+		sortRecords(recs)
+	}
+	j, err := json.MarshalIndent(recs[0], "\t", "\t")
+	if err != nil {
+		return err
+	}
+	if _, err := io.WriteString(this.w, this.sep); err != nil {
+		return err
+	}
+	if _, err := this.w.Write(j); err != nil {
+		return err
+	}
+	this.sep = ",\n\t"
+	return nil
+}
+
+// close ends the array of records.
+func (this *recordWriter) close() error {
+	if this.sep == "[\n\t" {
+		_, err := io.WriteString(this.w, "[]")
+		return err
+	}
+	_, err := io.WriteString(this.w, "\n]")
+	return err
+}
+
+// cursorByKey sorts records of a cursor by their exported keys.
+type cursorByKey struct {
+	cur  Cursor
+	keys []string
+}
+
+func (this cursorByKey) Len() int           { return len(this.cur) }
+func (this cursorByKey) Less(i, j int) bool { return this.keys[i] < this.keys[j] }
+func (this cursorByKey) Swap(i, j int) {
+	this.cur[i], this.cur[j] = this.cur[j], this.cur[i]
+	this.keys[i], this.keys[j] = this.keys[j], this.keys[i]
+}
+
+func importRecords(c appengine.Context, recs []record) (Cursor, error) {
+	var out Cursor
+	for _, r := range recs {
+		var v Value
+		var err error
+		if v.Key, err = decodeKey(c, r.Key); err != nil {
+			return nil, err
+		}
+		v.Data = make(Values)
+		for n, d := range r.Data {
+			if m, ok := d.(map[string]interface{}); ok && len(m) == 1 && m["$Key"] != nil {
+				raw, err := json.Marshal(m["$Key"])
+				if err != nil {
+					return nil, err
+				}
+				if d, err = decodeKey(c, raw); err != nil {
+					return nil, fmt.Errorf("field %q: %v", n, err)
+				}
+			}
+			v.Data[n] = d
+		}
+		if v.Children, err = importRecords(c, r.Children); err != nil {
+			return nil, err
+		}
+		out = append(out, v)
+	}
+	return out, nil
+}
+
+// config is a portable form of Config kept in "config" entry of all.zip.
+type config struct {
+	Default keyPath `json:",omitempty"`
+}
+
+// remapKeys replaces keys of imported entities which got other keys in key
+// fields of records and in the default page.
+func remapKeys(changes []*Change, remap map[string]*datastore.Key) {
+	for _, v := range changes {
+		if v.from != nil && v.key != nil && !v.from.Equal(v.key) {
+			remap[v.from.Encode()] = v.key
+		}
+	}
+	if len(remap) == 0 {
+		return
+	}
+	for _, v := range changes {
+		switch d := v.value.(type) {
+		case *entity:
+			for n, f := range d.data {
+				if k, ok := f.(*datastore.Key); ok && remap[k.Encode()] != nil {
+					d.data[n] = remap[k.Encode()]
+				}
+			}
+		case *Config:
+			if d.Default != nil && remap[d.Default.Encode()] != nil {
+				d.Default = remap[d.Default.Encode()]
+			}
+		}
+	}
+}
@@ -0,0 +1,38 @@
+// Copyright (c) 2012 Alexander Sychev. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package scms
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+)
+
+func TestWriteRecords(t *testing.T) {
+	for _, cur := range []Cursor{
+		nil,
+		{{Data: Values{"Title": "a"}}},
+		{
+			{Data: Values{"Title": "a", "Count": int64(2)}, Children: Cursor{{Data: Values{"Text": "c"}}}},
+			{Data: Values{"Title": "b"}},
+		},
+	} {
+		recs, err := exportRecords(cur)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want, err := json.MarshalIndent(recs, "", "\t")
+		if err != nil {
+			t.Fatal(err)
+		}
+		b := bytes.NewBuffer(nil)
+		if err := writeRecords(b, cur, false); err != nil {
+			t.Fatal(err)
+		}
+		if b.String() != string(want) {
+			t.Errorf("writeRecords wrote\n%s\nwant\n%s", b.String(), want)
+		}
+	}
+}
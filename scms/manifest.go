@@ -0,0 +1,287 @@
+// Copyright (c) 2012 Alexander Sychev. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package scms
+
+import (
+	"appengine"
+	"appengine/datastore"
+	"archive/zip"
+	"crypto/sha1"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"sort"
+	"strings"
+	"time"
+)
+
+// formatVersion is the version of archives of the entire site made by this
+// code. Archives of version 1 have no manifest, they are upgraded on import.
+// Manifests of version 3 keep settings of groups.
+const formatVersion = 3
+
+// manifest is kept in "manifest.json" entry of all.zip and describes the archive.
+type manifest struct {
+	Format   int
+	Exported time.Time
+	Site     string                 `json:",omitempty"`
+	Sections map[string]sectionInfo `json:",omitempty"`
+	Groups   map[string]groupSchema `json:",omitempty"`
+	Config   *config                `json:",omitempty"`
+}
+
+// sectionInfo describes a nested archive of all.zip or a folder of a tree of the site.
+type sectionInfo struct {
+	Count int
+	Size  int64  `json:",omitempty"`
+	SHA1  string `json:",omitempty"`
+}
+
+// groupSchema describes records of a group: their number and types of their fields.
+type groupSchema struct {
+	Records int
+	Fields  map[string]string
+	Slug    string `json:",omitempty"`
+}
+
+// typeName returns a name of the type of a field value like in revisions.
+func typeName(v interface{}) string {
+	switch v.(type) {
+	case string:
+		return "string"
+	case bool:
+		return "bool"
+	case int64:
+		return "integer"
+	case float64:
+		return "float"
+	case time.Time:
+		return "time"
+	case *datastore.Key:
+		return "key"
+	case []byte:
+		return "bytes"
+	}
+	return fmt.Sprintf("%T", v)
+}
+
+// add adds records of cur to the schema of a group, fields of different
+// types in different records are marked as "mixed".
+func (this *groupSchema) add(cur Cursor) {
+	for _, v := range cur {
+		this.Records++
+		for n, d := range v.Data {
+			if d == nil {
+				continue
+			}
+			t := typeName(d)
+			if o, ok := this.Fields[n]; ok && o != t {
+				t = "mixed"
+			}
+			this.Fields[n] = t
+		}
+		this.add(v.Children)
+	}
+}
+
+func countRecords(cur Cursor) int {
+	n := len(cur)
+	for _, v := range cur {
+		n += countRecords(v.Children)
+	}
+	return n
+}
+
+// newManifest describes the current site, sections and schemas of groups are
+// added while they are exported.
+func newManifest(c appengine.Context) (*manifest, error) {
+	m := &manifest{
+		Format:   formatVersion,
+		Exported: time.Now().UTC(),
+		Site:     appengine.DefaultVersionHostname(c),
+		Sections: make(map[string]sectionInfo),
+		Groups:   make(map[string]groupSchema),
+	}
+	var cfg Config
+	if err := datastore.Get(c, datastore.NewKey(c, "$Config", "config", 0, nil), &cfg); err != nil && err != datastore.ErrNoSuchEntity {
+		return nil, err
+	}
+	m.Config = &config{toPath(cfg.Default)}
+	return m, nil
+}
+
+// sectionWriter computes the size and the checksum of a nested archive while it is written.
+type sectionWriter struct {
+	w    io.Writer
+	h    hash.Hash
+	size int64
+}
+
+func newSectionWriter(w io.Writer) *sectionWriter {
+	return &sectionWriter{w: w, h: sha1.New()}
+}
+
+func (this *sectionWriter) Write(p []byte) (int, error) {
+	n, err := this.w.Write(p)
+	this.h.Write(p[:n])
+	this.size += int64(n)
+	return n, err
+}
+
+// section adds the nested archive named n with count entities to the manifest.
+func (this *manifest) section(n string, s *sectionWriter, count int) {
+	this.Sections[n] = sectionInfo{count, s.size, fmt.Sprintf("%x", s.h.Sum(nil))}
+}
+
+// readManifest returns the manifest of the archive a of the entire site,
+// archives without it are upgraded from version 1.
+func readManifest(a *archive) (*manifest, error) {
+	for _, v := range a.files {
+		if v.Name != "manifest.json" {
+			continue
+		}
+		d, err := readEntry(v)
+		if err != nil {
+			return nil, err
+		}
+		m := new(manifest)
+		if err := json.Unmarshal(d, m); err != nil {
+			return nil, fmt.Errorf("invalid manifest: %v", err)
+		}
+		if m.Format > formatVersion {
+			return nil, fmt.Errorf("format %v of archive is newer than supported %v", m.Format, formatVersion)
+		}
+		if m.Format < 2 {
+			return nil, fmt.Errorf("invalid format %v of archive", m.Format)
+		}
+		return m, nil
+	}
+	return upgradeManifest(a), nil
+}
+
+// upgradeManifest makes a manifest for an archive of version 1, which has only
+// nested archives and optionally the default page in "config" entry.
+// Such archives have no checksums and counts to verify.
+func upgradeManifest(a *archive) *manifest {
+	a.c.Infof("archive has no manifest, it is upgraded from format 1")
+	return &manifest{Format: 1}
+}
+
+// verifySection checks the nested archive f against the manifest, a damaged
+// section fails the import.
+func (this *manifest) verifySection(f *zip.File) error {
+	if this.Format < 2 {
+		return nil
+	}
+	info, ok := this.Sections[f.Name]
+	if !ok {
+		return fmt.Errorf("entry %q is not in the manifest", f.Name)
+	}
+	if info.Size != int64(f.UncompressedSize) {
+		return fmt.Errorf("size of entry %q is %v, the manifest says %v", f.Name, f.UncompressedSize, info.Size)
+	}
+	sum, err := entryHash(f)
+	if err != nil {
+		return err
+	}
+	if sum != info.SHA1 {
+		return fmt.Errorf("checksum of entry %q does not match the manifest", f.Name)
+	}
+	return nil
+}
+
+// verifyCounts fails if a section of the manifest is missing in the site s,
+// and reports sections and groups of s which numbers of entities differ from
+// the manifest, e.g. because of rejected entries. Such a site is partial, so
+// it can't replace the current content.
+func (this *manifest) verifyCounts(a *archive, s *site) error {
+	if this.Format < 2 {
+		return nil
+	}
+	kinds := map[string]string{
+		"files.zip":  "$Files",
+		"pages.zip":  "$Pages",
+		"groups.zip": "$Groups",
+		"files":      "$Files",
+		"pages":      "$Pages",
+		"groups":     "$Groups",
+	}
+	counts := map[string]int{
+		"files.zip":  len(s.files),
+		"pages.zip":  len(s.pages),
+		"groups.zip": len(s.groups),
+		"files":      len(s.files),
+		"pages":      len(s.pages),
+		"groups":     len(s.groups),
+	}
+	var names []string
+	for n := range this.Sections {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	for _, n := range names {
+		if k, ok := kinds[n]; ok && !s.sections[k] {
+			return fmt.Errorf("section %q of the manifest is missing in the archive", n)
+		}
+		if c, ok := counts[n]; ok && c != this.Sections[n].Count {
+			a.reject(n, fmt.Sprintf("%v entities are found, the manifest says %v", c, this.Sections[n].Count))
+			s.partial = true
+		}
+	}
+	_, tree := this.Sections["groups"]
+	for i := range s.groups {
+		g := &s.groups[i]
+		entry := "groups.zip/" + g.name
+		if tree {
+			entry = "groups/" + g.name + ".json"
+		}
+		schema, ok := this.Groups[g.name]
+		if !ok {
+			a.reject(entry, "group is not in the manifest")
+			s.partial = true
+			continue
+		}
+		if g.settings == nil && this.Format >= 3 {
+			g.settings = &Group{Name: g.name, Slug: schema.Slug}
+		}
+		if n := countRecords(g.records); n != schema.Records {
+			a.reject(entry, fmt.Sprintf("%v records are found, the manifest says %v", n, schema.Records))
+			s.partial = true
+		}
+	}
+	return this.setConfig(a.c, s)
+}
+
+// setConfig sets the default page of the site s from the manifest.
+func (this *manifest) setConfig(c appengine.Context, s *site) error {
+	if this.Config == nil {
+		return nil
+	}
+	s.config = new(Config)
+	if len(this.Config.Default) != 0 {
+		var err error
+		if s.config.Default, err = this.Config.Default.key(c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Describe returns a short description of the archive for the preview of an import.
+func (this *manifest) Describe() string {
+	if this.Format < 2 {
+		return fmt.Sprintf("format %v, upgraded to %v", this.Format, formatVersion)
+	}
+	var out []string
+	out = append(out, fmt.Sprintf("format %v", this.Format))
+	if len(this.Site) != 0 {
+		out = append(out, "exported from "+this.Site)
+	}
+	if t := formatTime(this.Exported); len(t) != 0 {
+		out = append(out, "at "+t)
+	}
+	return strings.Join(out, ", ")
+}
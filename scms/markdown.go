@@ -0,0 +1,401 @@
+// Copyright (c) 2012 Alexander Sychev. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package scms
+
+import (
+	"appengine"
+	"appengine/datastore"
+	"archive/zip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Records of a group can be authored as Markdown files with front matter,
+// YAML between "---" lines or TOML between "+++" lines. A file is a record:
+// keys of the front matter are fields, the text after it is the field
+// "Markdown" and the name of the file without ".md" is the field "Name" if
+// the front matter has no name. Only flat front matter is supported: values
+// are strings, numbers, booleans, times, key paths like [["Posts", 42]] and
+// lists which are joined to a string by ", ". Items of lists must not contain
+// commas, so the string can be split back. The key of a record is "$Key".
+const (
+	markdownField = "Markdown"
+	markdownName  = "Name"
+)
+
+var frontMatterTimes = []string{
+	time.RFC3339Nano,
+	"2006-01-02T15:04:05",
+	"2006-01-02 15:04:05",
+	"2006-01-02",
+}
+
+// splitFrontMatter returns the front matter of a text, whether it is TOML and the body.
+func splitFrontMatter(d string) (string, bool, string) {
+	d = strings.Replace(d, "\r\n", "\n", -1)
+	for _, sep := range []string{"---", "+++"} {
+		if !strings.HasPrefix(d, sep+"\n") {
+			continue
+		}
+		rest := d[len(sep)+1:]
+		if strings.HasPrefix(rest, sep+"\n") {
+			return "", sep == "+++", rest[len(sep)+1:]
+		}
+		if i := strings.Index(rest, "\n"+sep+"\n"); i >= 0 {
+			return rest[:i+1], sep == "+++", rest[i+len(sep)+2:]
+		}
+		if strings.HasSuffix(rest, "\n"+sep) {
+			return rest[:len(rest)-len(sep)], sep == "+++", ""
+		}
+	}
+	return "", false, d
+}
+
+// unquote returns the content of a quoted string and the rest of the text after it.
+func unquote(s string) (string, string, error) {
+	if s[0] == '\'' {
+		var b []byte
+		for i := 1; i < len(s); i++ {
+			if s[i] != '\'' {
+				b = append(b, s[i])
+			} else if i+1 < len(s) && s[i+1] == '\'' {
+				b = append(b, '\'')
+				i++
+			} else {
+				return string(b), s[i+1:], nil
+			}
+		}
+		return "", "", fmt.Errorf("unterminated string %v", s)
+	}
+	for i := 1; i < len(s); i++ {
+		if s[i] == '\\' {
+			i++
+		} else if s[i] == '"' {
+			u, err := strconv.Unquote(s[:i+1])
+			return u, s[i+1:], err
+		}
+	}
+	return "", "", fmt.Errorf("unterminated string %v", s)
+}
+
+// splitList splits items of a flow list "[a, 'b, c']" respecting quotes.
+func splitList(s string) []string {
+	var out []string
+	var quote byte
+	start := 0
+	for i := 0; i < len(s); i++ {
+		switch {
+		case quote != 0:
+			if s[i] == '\\' && quote == '"' {
+				i++
+			} else if s[i] == quote {
+				quote = 0
+			}
+		case s[i] == '"' || s[i] == '\'':
+			quote = s[i]
+		case s[i] == ',':
+			out = append(out, strings.TrimSpace(s[start:i]))
+			start = i + 1
+		}
+	}
+	if t := strings.TrimSpace(s[start:]); len(t) != 0 {
+		out = append(out, t)
+	}
+	return out
+}
+
+// scalar parses a value of front matter, nil is returned for null values.
+func scalar(c appengine.Context, s string) (interface{}, error) {
+	s = strings.TrimSpace(s)
+	if len(s) == 0 {
+		return nil, nil
+	}
+	switch s[0] {
+	case '"', '\'':
+		u, rest, err := unquote(s)
+		if err != nil {
+			return nil, err
+		}
+		if rest = strings.TrimSpace(rest); len(rest) != 0 && rest[0] != '#' {
+			return nil, fmt.Errorf("unexpected %q after a string", rest)
+		}
+		return u, nil
+	case '[':
+		if strings.HasPrefix(s, "[[") {
+			return decodeKey(c, json.RawMessage(s))
+		}
+		if !strings.HasSuffix(s, "]") {
+			return nil, fmt.Errorf("unterminated list %v", s)
+		}
+		var items []string
+		for _, v := range splitList(s[1 : len(s)-1]) {
+			item, err := listItem(c, v)
+			if err != nil {
+				return nil, err
+			}
+			if len(item) != 0 {
+				items = append(items, item)
+			}
+		}
+		return strings.Join(items, ", "), nil
+	case '{', '|', '>', '&', '*', '!':
+		return nil, fmt.Errorf("unsupported value %v", s)
+	}
+	if i := strings.Index(s, " #"); i >= 0 {
+		s = strings.TrimSpace(s[:i])
+	}
+	switch s {
+	case "~", "null":
+		return nil, nil
+	case "true":
+		return true, nil
+	case "false":
+		return false, nil
+	}
+	if n, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return n, nil
+	}
+	if f, err := strconv.ParseFloat(s, 64); err == nil {
+		return f, nil
+	}
+	for _, l := range frontMatterTimes {
+		if t, err := time.Parse(l, s); err == nil {
+			return t, nil
+		}
+	}
+	return s, nil
+}
+
+// listItem returns an item of a list as a string, an item with a comma can't
+// be told apart from two items after joining.
+func listItem(c appengine.Context, s string) (string, error) {
+	d, err := scalar(c, s)
+	if err != nil || d == nil {
+		return "", err
+	}
+	item := csvValue(d)
+	if strings.Contains(item, ",") {
+		return "", fmt.Errorf("item %q of a list contains a comma", item)
+	}
+	return item, nil
+}
+
+// parseFrontMatter returns fields of the front matter fm.
+func parseFrontMatter(c appengine.Context, fm string, toml bool) (Values, error) {
+	out := make(Values)
+	sep := ":"
+	if toml {
+		sep = "="
+	}
+	// a YAML key without a value may be followed by a block list
+	var list string
+	var items []string
+	flush := func() {
+		if len(list) != 0 {
+			out[list] = strings.Join(items, ", ")
+		}
+		list, items = "", nil
+	}
+	for n, line := range strings.Split(fm, "\n") {
+		t := strings.TrimSpace(line)
+		if len(t) == 0 || t[0] == '#' {
+			continue
+		}
+		if !toml && len(list) != 0 && strings.HasPrefix(t, "- ") {
+			item, err := listItem(c, t[2:])
+			if err != nil {
+				return nil, fmt.Errorf("line %v: %v", n+1, err)
+			}
+			if len(item) != 0 {
+				items = append(items, item)
+			}
+			continue
+		}
+		flush()
+		if t[0] == '[' {
+			return nil, fmt.Errorf("line %v: tables are not supported", n+1)
+		}
+		if line[0] == ' ' || line[0] == '\t' {
+			return nil, fmt.Errorf("line %v: nested values are not supported", n+1)
+		}
+		// the separator of a quoted key is after the closing quote
+		var k, v string
+		if t[0] == '"' || t[0] == '\'' {
+			var err error
+			if k, v, err = unquote(t); err != nil {
+				return nil, fmt.Errorf("line %v: %v", n+1, err)
+			}
+			if v = strings.TrimSpace(v); !strings.HasPrefix(v, sep) {
+				return nil, fmt.Errorf("line %v: %q is expected", n+1, sep)
+			}
+			v = v[len(sep):]
+		} else {
+			i := strings.Index(t, sep)
+			if i <= 0 {
+				return nil, fmt.Errorf("line %v: %q is expected", n+1, sep)
+			}
+			k, v = strings.TrimSpace(t[:i]), t[i+len(sep):]
+		}
+		if len(strings.TrimSpace(v)) == 0 && !toml {
+			list = k
+			continue
+		}
+		d, err := scalar(c, v)
+		if err != nil {
+			return nil, fmt.Errorf("line %v: %v", n+1, err)
+		}
+		if d != nil {
+			out[k] = d
+		}
+	}
+	flush()
+	return out, nil
+}
+
+// parseMarkdown adds records of the group g from Markdown files of an archive to the site s.
+func parseMarkdown(c appengine.Context, a *archive, g string, s *site) error {
+	if strings.HasPrefix(g, "$") || strings.ContainsAny(g, "/\\") || len(g) == 0 {
+		return fmt.Errorf("invalid name of group %q", g)
+	}
+	var recs []*flatRecord
+	// a rejected Markdown file is a rejected record, other files are not
+	reject := func(name string, reason string) {
+		a.reject(name, reason)
+		s.partial = true
+	}
+	for _, v := range a.files {
+		ext := strings.ToLower(path.Ext(v.Name))
+		if ext != ".md" && ext != ".markdown" {
+			a.reject(v.Name, "not a Markdown file")
+			continue
+		}
+		d, err := readEntry(v)
+		if err != nil {
+			c.Errorf("reading of file has failed: %q", err)
+			return err
+		}
+		fm, toml, body := splitFrontMatter(string(d))
+		data, err := parseFrontMatter(c, fm, toml)
+		if err != nil {
+			reject(v.Name, err.Error())
+			continue
+		}
+		rec := &flatRecord{Value: Value{Data: data}, source: v.Name}
+		if k, ok := data[csvKey].(*datastore.Key); ok {
+			if k.Kind() != g {
+				reject(v.Name, fmt.Sprintf("%v is not a key of group %q", keyCell(k), g))
+				continue
+			}
+			rec.Key, rec.parent = k, k.Parent()
+			delete(data, csvKey)
+		} else if _, ok := data[csvKey]; ok {
+			reject(v.Name, csvKey+" is not a key path")
+			continue
+		}
+		if _, ok := data[markdownName]; !ok {
+			data[markdownName] = cleanName(v.Name[:len(v.Name)-len(ext)])
+		}
+		data[markdownField] = body
+		recs = append(recs, rec)
+	}
+	cur, rejected := nestRecords(recs)
+	for _, v := range rejected {
+		reject(v.Name, v.Reason)
+	}
+	s.groups = append(s.groups, importedGroup{name: g, records: cur})
+	return nil
+}
+
+// yamlValue formats a field value for front matter so scalar parses it back.
+func yamlValue(v interface{}) string {
+	switch d := v.(type) {
+	case string:
+		return strconv.Quote(d)
+	case float64:
+		s := csvValue(d)
+		if !strings.ContainsAny(s, ".eEnN") {
+			s += ".0"
+		}
+		return s
+	}
+	return csvValue(v)
+}
+
+// exportMarkdown writes records of the group g with drafts as Markdown files.
+func exportMarkdown(c appengine.Context, w io.Writer, g string) error {
+	ctx := &Context{ctx: c, draft: true}
+	tree, err := ctx.GetTree(g)
+	if err != nil {
+		return err
+	}
+	z := zip.NewWriter(w)
+	taken := make(map[string]bool)
+	var walk func(Cursor) error
+	walk = func(cur Cursor) error {
+		for _, v := range cur {
+			name, _ := v.Data[markdownName].(string)
+			if name = cleanName(name); len(name) == 0 || len(checkName(name)) != 0 {
+				name = strconv.FormatInt(v.Key.IntID(), 10)
+				if len(v.Key.StringID()) != 0 {
+					name = cleanName(v.Key.StringID())
+				}
+			}
+			name = uniqueName(name+".md", taken)
+			taken[name] = true
+			var fields []string
+			for n := range v.Data {
+				if n != markdownField && v.Data[n] != nil && len(csvType(v.Data[n])) != 0 {
+					fields = append(fields, n)
+				}
+			}
+			sort.Strings(fields)
+			b := []string{"---", csvKey + ": " + keyCell(v.Key)}
+			for _, n := range fields {
+				k := n
+				if strings.ContainsAny(n, ":#'\" ") {
+					k = strconv.Quote(n)
+				}
+				b = append(b, k+": "+yamlValue(v.Data[n]))
+			}
+			body, _ := v.Data[markdownField].(string)
+			b = append(b, "---", body)
+			fh := &zip.FileHeader{
+				Name:   name,
+				Method: zip.Deflate,
+			}
+			fh.SetModTime(time.Now())
+			if zw, err := z.CreateHeader(fh); err != nil {
+				return err
+			} else if _, err := io.WriteString(zw, strings.Join(b, "\n")); err != nil {
+				return err
+			}
+			if err := walk(v.Children); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if err := walk(tree); err != nil {
+		return err
+	}
+	return z.Close()
+}
+
+func serveMarkdown(c appengine.Context, w http.ResponseWriter, g string) {
+	if err := datastore.Get(c, datastore.NewKey(c, "$Groups", g, 0, nil), &Group{}); err != nil {
+		errorX(c, w, err)
+		return
+	}
+	serveExport(c, w, g+"-markdown", func(c appengine.Context, w io.Writer) error {
+		return exportMarkdown(c, w, g)
+	})
+}
@@ -0,0 +1,113 @@
+// Copyright (c) 2012 Alexander Sychev. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package scms
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestSplitFrontMatter(t *testing.T) {
+	for _, v := range []struct {
+		text string
+		fm   string
+		toml bool
+		body string
+	}{
+		{"---\na: 1\n---\nbody", "a: 1\n", false, "body"},
+		{"+++\na = 1\n+++\nbody", "a = 1\n", true, "body"},
+		{"---\r\na: 1\r\n---\r\nbody", "a: 1\n", false, "body"},
+		{"---\n---\nbody", "", false, "body"},
+		{"---\na: 1\n---", "a: 1\n", false, ""},
+		{"no front matter", "", false, "no front matter"},
+		{"---\nunterminated", "", false, "---\nunterminated"},
+	} {
+		fm, toml, body := splitFrontMatter(v.text)
+		if fm != v.fm || toml != v.toml || body != v.body {
+			t.Errorf("splitFrontMatter(%q) = %q, %v, %q, want %q, %v, %q", v.text, fm, toml, body, v.fm, v.toml, v.body)
+		}
+	}
+}
+
+func TestUnquote(t *testing.T) {
+	for _, v := range []struct {
+		s    string
+		u    string
+		rest string
+		err  bool
+	}{
+		{`"a\"b" rest`, `a"b`, " rest", false},
+		{`'it''s':x`, "it's", ":x", false},
+		{`"a:b": 1`, "a:b", ": 1", false},
+		{`"open`, "", "", true},
+		{`'open`, "", "", true},
+	} {
+		u, rest, err := unquote(v.s)
+		if u != v.u || rest != v.rest || (err != nil) != v.err {
+			t.Errorf("unquote(%q) = %q, %q, %v", v.s, u, rest, err)
+		}
+	}
+}
+
+func TestSplitList(t *testing.T) {
+	for _, v := range []struct {
+		s     string
+		items []string
+	}{
+		{"", nil},
+		{"a", []string{"a"}},
+		{`a, 'b, c', "d\", e"`, []string{"a", "'b, c'", `"d\", e"`}},
+	} {
+		if items := splitList(v.s); !reflect.DeepEqual(items, v.items) {
+			t.Errorf("splitList(%q) = %q, want %q", v.s, items, v.items)
+		}
+	}
+}
+
+func TestParseFrontMatter(t *testing.T) {
+	for _, v := range []struct {
+		fm   string
+		toml bool
+		want Values
+	}{
+		{"title: Hello\ncount: 3\nprice: 1.5\ndraft: true\nnone: ~\n", false,
+			Values{"title": "Hello", "count": int64(3), "price": 1.5, "draft": true}},
+		{"# comment\ntitle: 'a # b' # comment\n", false, Values{"title": "a # b"}},
+		{`"a:b": 1`, false, Values{"a:b": int64(1)}},
+		{`'it''s': x`, false, Values{"it's": "x"}},
+		{"tags:\n- a\n- 2\nnext: b\n", false, Values{"tags": "a, 2", "next": "b"}},
+		{"tags: [a, 'b']", false, Values{"tags": "a, b"}},
+		{"date: 2012-01-02", false, Values{"date": time.Date(2012, 1, 2, 0, 0, 0, 0, time.UTC)}},
+		{"title = \"Hello\"\ncount = 3\n", true, Values{"title": "Hello", "count": int64(3)}},
+		{`"a=b" = "c"`, true, Values{"a=b": "c"}},
+	} {
+		d, err := parseFrontMatter(nil, v.fm, v.toml)
+		if err != nil {
+			t.Errorf("parseFrontMatter(%q): %v", v.fm, err)
+			continue
+		}
+		if !reflect.DeepEqual(d, v.want) {
+			t.Errorf("parseFrontMatter(%q) = %v, want %v", v.fm, d, v.want)
+		}
+	}
+	for _, v := range []struct {
+		fm   string
+		toml bool
+	}{
+		{"title", false},
+		{"  nested: 1", false},
+		{"tags: ['a, b']", false},
+		{"tags:\n- 'a, b'\n", false},
+		{`"a:b" 1`, false},
+		{"map: {a: 1}", false},
+		{"[table]", true},
+		{"title: \"open", false},
+	} {
+		if d, err := parseFrontMatter(nil, v.fm, v.toml); err == nil {
+			t.Errorf("parseFrontMatter(%q) = %v, want an error", v.fm, d)
+		}
+	}
+}
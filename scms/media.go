@@ -0,0 +1,329 @@
+// Copyright (c) 2012 Alexander Sychev. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package scms
+
+import (
+	"appengine"
+	"appengine/datastore"
+	"appengine/user"
+	"bytes"
+	"fmt"
+	"html/template"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"unicode"
+)
+
+// Media is an image of "$Files" with the list of places it is used in.
+type Media struct {
+	Value
+	Thumbnail string
+	Used      []Usage
+}
+
+// Usage is a page, a file or a record referencing a media file.
+type Usage struct {
+	Kind string
+	Name string
+	Link string
+}
+
+func isImage(v Values) bool {
+	ct, _ := v["ContentType"].(string)
+	if len(ct) == 0 {
+		name, _ := v["Name"].(string)
+		ct = mime.TypeByExtension(path.Ext(name))
+	}
+	return strings.HasPrefix(ct, "image/")
+}
+
+// isRefSeparator reports whether r separates references in texts: white
+// space, quotes and delimiters of HTML, CSS, Markdown and templates.
+func isRefSeparator(r rune) bool {
+	return unicode.IsSpace(r) || strings.ContainsRune("\"'`()<>=,;{}[]|", r)
+}
+
+// refs returns names of files referenced by texts of a source in the folder
+// dir. A relative reference can be a name given to a template function or a
+// relative URL, so it is resolved against the root and against dir.
+func refs(text []string, dir string) map[string]bool {
+	out := make(map[string]bool)
+	for _, t := range text {
+		for _, f := range strings.FieldsFunc(t, isRefSeparator) {
+			if i := strings.IndexAny(f, "?#"); i >= 0 {
+				f = f[:i]
+			}
+			if len(f) == 0 || strings.Contains(f, "://") || strings.HasPrefix(f, "//") {
+				continue
+			}
+			if strings.HasPrefix(f, "/") {
+				if strings.HasPrefix(f, "/preview/") {
+					f = f[len("/preview"):]
+				}
+				name := cleanName(f)
+				if strings.HasPrefix(name, assetsPrefix) {
+					if s := strings.SplitN(name[len(assetsPrefix):], "/", 2); len(s) == 2 {
+						name = s[1]
+					}
+				}
+				out[name] = true
+				continue
+			}
+			out[cleanName(f)] = true
+			if len(dir) != 0 && dir != "." {
+				out[cleanName(path.Join(dir, f))] = true
+			}
+		}
+	}
+	return out
+}
+
+// texts returns all string values of v.
+func texts(v Values) []string {
+	var out []string
+	for _, d := range v {
+		if s, ok := d.(string); ok && len(s) != 0 {
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
+// usages returns places where files are used by names of the files. Pages,
+// text files and records of groups are read once for all files.
+func (this *Context) usages(files Cursor) (map[string][]Usage, error) {
+	out := make(map[string][]Usage)
+	add := func(u Usage, text []string, dir string) {
+		for name := range refs(text, dir) {
+			if u.Kind == "file" && u.Name == name {
+				continue
+			}
+			out[name] = append(out[name], u)
+		}
+	}
+	pages, err := this.Get("$Pages", "Name", "", 0, 0)
+	if err != nil {
+		return nil, err
+	}
+	for _, v := range pages {
+		name, _ := v.Data["Name"].(string)
+		add(Usage{"page", name, "/editor/pages"}, texts(v.Data), path.Dir(name))
+	}
+	for _, v := range files {
+		name, _ := v.Data["Name"].(string)
+		d, _ := v.Data["Data"].([]byte)
+		ct, _ := v.Data["ContentType"].(string)
+		if len(ct) == 0 {
+			ct = mime.TypeByExtension(path.Ext(name))
+		}
+		if len(d) == 0 || (len(ct) != 0 && !compressible(ct)) {
+			continue
+		}
+		link := "/editor/files?folder=" + url.QueryEscape(path.Dir(name))
+		add(Usage{"file", name, link}, []string{string(d)}, path.Dir(name))
+	}
+	groups, err := this.Get("$Groups", "Name", "", 0, 0)
+	if err != nil {
+		return nil, err
+	}
+	for _, g := range groups {
+		name, _ := g.Data["Name"].(string)
+		tree, err := this.GetTree(name)
+		if err != nil {
+			return nil, err
+		}
+		link := "/editor/group?gid=" + g.Key.Encode()
+		var walk func(c Cursor)
+		walk = func(c Cursor) {
+			for _, v := range c {
+				add(Usage{name, v.Key.String(), link}, texts(v.Data), "")
+				walk(v.Children)
+			}
+		}
+		walk(tree)
+	}
+	return out, nil
+}
+
+// GetMedia returns all images of "$Files" with places they are used in.
+func (this *Context) GetMedia() ([]Media, error) {
+	if this.ctx == nil {
+		return nil, &scmsError{"invalid context"}
+	}
+	files, err := this.Get("$Files", "Name", "", 0, 0)
+	if err != nil {
+		return nil, err
+	}
+	used, err := this.usages(files)
+	if err != nil {
+		return nil, err
+	}
+	key, err := loadSigningKey(this.ctx)
+	if err != nil {
+		return nil, err
+	}
+	var out []Media
+	for _, v := range files {
+		if !isImage(v.Data) {
+			continue
+		}
+		name, _ := v.Data["Name"].(string)
+		m := Media{Value: v, Used: used[name]}
+		if m.Thumbnail, err = signedImageURL(key, name, 160, 160); err != nil {
+			return nil, err
+		}
+		if this.draft {
+			m.Thumbnail = "/preview" + m.Thumbnail
+		}
+		out = append(out, m)
+	}
+	return out, nil
+}
+
+func (this *Value) GetMedia() ([]Media, error) {
+	return this.ctx.GetMedia()
+}
+
+var imageTemplate = template.Must(template.New("image").Parse(
+	`{{if .Figure}}<figure>{{end}}<img src="{{.Src}}" alt="{{.Alt}}"{{with .Width}} width="{{.}}"{{end}}{{with .Height}} height="{{.}}"{{end}}>` +
+		`{{if .Figure}}<figcaption>{{.Caption}}{{with .Credit}} <small>{{.}}</small>{{end}}</figcaption></figure>{{end}}`))
+
+// GetImage returns an <img> of the file n with its alt text, it is wrapped in
+// a <figure> if the file has a caption or a credit. Optional width and height
+// make a resized derivative of the image.
+func (this *Context) GetImage(n interface{}, size ...int) (template.HTML, error) {
+	if this.ctx == nil {
+		return "", &scmsError{"invalid context"}
+	}
+	name, ok := n.(string)
+	if !ok {
+		return "", fmt.Errorf("GetImage: unexpected type of 'name': %T, must be string", n)
+	}
+	if len(size) > 2 {
+		return "", fmt.Errorf("GetImage: too many sizes: %v", size)
+	}
+	name = cleanName(name)
+	var f File
+	if err := getEntity(this.ctx, datastore.NewKey(this.ctx, "$Files", name, 0, nil), &f, this.draft); err != nil {
+		return "", fmt.Errorf("GetImage: file %q: %v", name, err)
+	}
+	data := struct {
+		Src                  string
+		Alt, Caption, Credit string
+		Width, Height        int
+		Figure               bool
+	}{Alt: f.Alt, Caption: f.Caption, Credit: f.Credit}
+	data.Figure = len(f.Caption) != 0 || len(f.Credit) != 0
+	if len(size) != 0 {
+		data.Width = size[0]
+		if len(size) == 2 {
+			data.Height = size[1]
+		}
+		key, err := loadSigningKey(this.ctx)
+		if err != nil {
+			return "", err
+		}
+		if data.Src, err = signedImageURL(key, name, data.Width, data.Height); err != nil {
+			return "", err
+		}
+	} else if this.draft || len(f.Hash) < hashLen {
+		data.Src = "/" + name
+	} else {
+		data.Src = assetURL(&f)
+	}
+	if this.draft {
+		data.Src = "/preview" + data.Src
+	}
+	b := bytes.NewBuffer(nil)
+	if err := imageTemplate.Execute(b, &data); err != nil {
+		return "", err
+	}
+	return template.HTML(b.String()), nil
+}
+
+func (this *Value) GetImage(name interface{}, size ...int) (template.HTML, error) {
+	return this.ctx.GetImage(name, size...)
+}
+
+var mediaTemplate = template.Must(template.New("media").Funcs(funcMap).Parse(
+	`
+<html>
+<body>
+<a href="/">Main</a><br>
+<a href="/editor">Editor</a><br>
+<a href="/editor/files">Files</a><br>
+<a href="/logout">Logout</a><br>
+{{range .GetMedia}}
+<form action="/editor/media?id={{.Key.Encode}}" method="post">
+	<fieldset>
+		<legend>Image "{{.Data.Name}}"</legend>
+		<a href="{{.Thumbnail}}"><img src="{{.Thumbnail}}" alt="{{with .Data.Alt}}{{.}}{{end}}"></a><br>
+		{{with .Data.Size}}Size: {{FormatSize .}}<br>{{end}}
+		<label>Alt text:<br><input type="text" name="alt" value="{{with .Data.Alt}}{{.}}{{end}}" size=80></label><br>
+		<label>Caption:<br><textarea name="caption" rows="3" cols="80">{{with .Data.Caption}}{{.}}{{end}}</textarea></label><br>
+		<label>Credit:<br><input type="text" name="credit" value="{{with .Data.Credit}}{{.}}{{end}}" size=80></label><br>
+		{{if .Used}}
+		Used by:<br>
+		{{range .Used}}&nbsp;&nbsp;{{.Kind}} <a href="{{.Link}}">{{.Name}}</a><br>{{end}}
+		{{else}}
+		Not used<br>
+		{{end}}
+		<input type="submit" value="Submit">
+		<input type="reset" value="Reset">
+	</fieldset>
+</form>
+{{end}}
+</body>
+</html>
+`))
+
+func mediaHandler(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+	if u := user.Current(c); u == nil {
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return
+	}
+	if r.Method == "GET" {
+		var data Context
+		data.ctx = c
+		data.draft = true
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		if err := mediaTemplate.Execute(w, &data); err != nil {
+			errorX(c, w, err)
+		}
+		return
+	} else if r.Method != "POST" {
+		error404(w, r)
+		return
+	}
+	k, err := datastore.DecodeKey(r.URL.Query().Get("id"))
+	if err != nil {
+		errorX(c, w, err)
+		return
+	}
+	if err := editMedia(c, r, k); err != nil {
+		errorX(c, w, err)
+		return
+	}
+	invalidate(c)
+	http.Redirect(w, r, r.URL.Path, http.StatusFound)
+}
+
+func editMedia(c appengine.Context, r *http.Request, k *datastore.Key) error {
+	if k.Kind() != "$Files" {
+		return &scmsError{"it is not a file"}
+	}
+	var f File
+	if err := getDraft(c, k, &f); err != nil {
+		return err
+	}
+	f.Alt = strings.TrimSpace(r.FormValue("alt"))
+	f.Caption = strings.TrimSpace(r.FormValue("caption"))
+	f.Credit = strings.TrimSpace(r.FormValue("credit"))
+	return putDraft(c, k, &f)
+}
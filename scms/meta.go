@@ -0,0 +1,117 @@
+// Copyright (c) 2012 Alexander Sychev. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package scms
+
+import (
+	"appengine"
+	"appengine/datastore"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Meta is metadata of a page available to templates via GetMeta.
+type Meta struct {
+	Title       string
+	Description string
+	Canonical   string
+	Image       string
+	Params      map[string]string
+}
+
+// parseParams parses "key=value" lines of Page.Params.
+func parseParams(s string) map[string]string {
+	out := make(map[string]string)
+	for _, l := range strings.Split(s, "\n") {
+		l = strings.TrimSpace(l)
+		if len(l) == 0 {
+			continue
+		}
+		if i := strings.Index(l, "="); i > 0 {
+			out[strings.TrimSpace(l[:i])] = strings.TrimSpace(l[i+1:])
+		} else {
+			out[l] = ""
+		}
+	}
+	return out
+}
+
+func newMeta(p Page) Meta {
+	return Meta{
+		Title:       p.Title,
+		Description: p.Description,
+		Canonical:   p.Canonical,
+		Image:       p.Image,
+		Params:      parseParams(p.Params),
+	}
+}
+
+// override replaces metadata by string fields of a record with the same names.
+func (this *Meta) override(data Values) {
+	for k, v := range data {
+		s, ok := v.(string)
+		if !ok {
+			continue
+		}
+		switch k {
+		case "Title":
+			this.Title = s
+		case "Description":
+			this.Description = s
+		case "Canonical":
+			this.Canonical = s
+		case "Image":
+			this.Image = s
+		default:
+			if _, ok := this.Params[k]; ok {
+				this.Params[k] = s
+			}
+		}
+	}
+}
+
+// recordOf returns a record specified in a request parameter p of a detail page.
+// The parameter holds either an encoded key or a slug of the record, see findSlug.
+// Published pages don't take metadata of records out of their schedules.
+func recordOf(c appengine.Context, r *http.Request, p string, draft bool) (Values, error) {
+	id := r.URL.Query().Get(p)
+	if len(id) == 0 {
+		return nil, nil
+	}
+	k, err := datastore.DecodeKey(id)
+	if err != nil {
+		sl, err := findSlug(c, r.URL.Query(), id)
+		if err != nil || sl == nil {
+			return nil, err
+		}
+		k = sl.Record
+	}
+	var e entity
+	if err := getEntity(c, k, &e, draft); err != nil {
+		if err == datastore.ErrNoSuchEntity {
+			return nil, nil
+		}
+		return nil, err
+	}
+	if !draft && !visible(e.data, time.Now()) {
+		return nil, nil
+	}
+	return e.data, nil
+}
+
+func (this *Context) GetMeta() (Meta, error) {
+	if this.ctx == nil {
+		return Meta{}, &scmsError{"invalid context"}
+	}
+	if this.meta == nil {
+		return Meta{}, fmt.Errorf("GetMeta: no page metadata")
+	}
+	return *this.meta, nil
+}
+
+func (this *Value) GetMeta() (Meta, error) {
+	return this.ctx.GetMeta()
+}
@@ -7,11 +7,10 @@ package scms
 import (
 	"net/http"
 	"html/template"
-	"os"
 	"encoding/json"
 	"io"
-	"bytes"
 	"strings"
+	"time"
 	"archive/zip"
 	"appengine"
 	"appengine/datastore"
@@ -23,9 +22,17 @@ type Config struct {
 }
 
 type Page struct {
-	Name     string
-	Base     string
-	Template string
+	Name        string
+	Base        string
+	Template    string
+	Title       string
+	Description string `datastore:",noindex"`
+	Canonical   string
+	Image       string
+	Params      string `datastore:",noindex"`
+	Record      string
+	PublishAt   time.Time
+	UnpublishAt time.Time
 }
 
 var pagesTemplate = template.Must(template.New("pages").Funcs(funcMap).Parse(
@@ -69,6 +76,22 @@ var pagesTemplate = template.Must(template.New("pages").Funcs(funcMap).Parse(
 			{{end}}
 		</select>
 		<br>
+		<legend>Title:</legend>
+		<input type="text" name="title" value="" size=100><br>
+		<legend>Description:</legend>
+		<textarea name="description" rows=3 cols=100></textarea><br>
+		<legend>Canonical URL:</legend>
+		<input type="text" name="canonical" value="" size=100><br>
+		<legend>Open Graph image:</legend>
+		<input type="text" name="image" value="" size=100><br>
+		<legend>Parameters (a "key=value" per line):</legend>
+		<textarea name="params" rows=5 cols=100></textarea><br>
+		<legend>Request parameter with a record for metadata:</legend>
+		<input type="text" name="record" value=""><br>
+		<legend>Publish at (UTC, e.g. 2012-12-31 23:59):</legend>
+		<input type="text" name="publish" value=""><br>
+		<legend>Unpublish at (UTC):</legend>
+		<input type="text" name="unpublish" value=""><br>
 		<input type="submit" value="Submit">
 	</fieldset>
 </form>
@@ -78,6 +101,7 @@ var pagesTemplate = template.Must(template.New("pages").Funcs(funcMap).Parse(
 		<a href=/editor/pages.zip>Download all pages</a><br>
 	{{end}}
 		<label>Upload pages: <input type="file" name="file" value=""></label><br>
+		{{template "importMode"}}
 		<input type="submit" value="Submit">
 	</fieldset>
 </form>
@@ -85,6 +109,7 @@ var pagesTemplate = template.Must(template.New("pages").Funcs(funcMap).Parse(
 <form action="/editor/pages?id={{.Key.Encode}}" method="post" enctype="multipart/form-data">
 	<fieldset>
 		<legend>Page "{{.Data.Name}}"</legend>
+		<a href="/editor/history?id={{.Key.Encode}}">History</a><br>
 		<legend>File with HTML-template:</legend>
 		{{$base := .Data.Template}}
 		<select name="file">
@@ -101,6 +126,22 @@ var pagesTemplate = template.Must(template.New("pages").Funcs(funcMap).Parse(
 			{{end}}
 		</select>
 		<br>
+		<legend>Title:</legend>
+		<input type="text" name="title" value="{{with .Data.Title}}{{.}}{{end}}" size=100><br>
+		<legend>Description:</legend>
+		<textarea name="description" rows=3 cols=100>{{with .Data.Description}}{{.}}{{end}}</textarea><br>
+		<legend>Canonical URL:</legend>
+		<input type="text" name="canonical" value="{{with .Data.Canonical}}{{.}}{{end}}" size=100><br>
+		<legend>Open Graph image:</legend>
+		<input type="text" name="image" value="{{with .Data.Image}}{{.}}{{end}}" size=100><br>
+		<legend>Parameters (a "key=value" per line):</legend>
+		<textarea name="params" rows=5 cols=100>{{with .Data.Params}}{{.}}{{end}}</textarea><br>
+		<legend>Request parameter with a record for metadata:</legend>
+		<input type="text" name="record" value="{{with .Data.Record}}{{.}}{{end}}"><br>
+		<legend>Publish at (UTC, e.g. 2012-12-31 23:59):</legend>
+		<input type="text" name="publish" value="{{with .Data.PublishAt}}{{FormatTime .}}{{end}}"><br>
+		<legend>Unpublish at (UTC):</legend>
+		<input type="text" name="unpublish" value="{{with .Data.UnpublishAt}}{{FormatTime .}}{{end}}"><br>
 		<input type="submit" value="Submit">
 		<input type="reset" value="Reset">
 		<input type="button" value="Delete">
@@ -109,7 +150,7 @@ var pagesTemplate = template.Must(template.New("pages").Funcs(funcMap).Parse(
 {{end}}
 </body>
 </html>
-`))
+` + importModeTemplate))
 
 func pagesHandler(w http.ResponseWriter, r *http.Request) {
 	c := appengine.NewContext(r)
@@ -135,6 +176,7 @@ func pagesHandler(w http.ResponseWriter, r *http.Request) {
 		}
 		var data Context
 		data.ctx = c
+		data.draft = true
 		w.Header().Set("Content-Type", "text/html; charset=utf-8")
 		if err := pagesTemplate.Execute(w, &data); err != nil {
 			errorX(c, w, err)
@@ -145,19 +187,10 @@ func pagesHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	if r.FormValue("action") == "upload" {
-		file, _, err := r.FormFile("file")
-		if err != nil {
+		if err := previewImport(c, w, r, "pages", r.URL.Path); err != nil {
 			errorX(c, w, err)
-			c.Errorf("can't get an archive with imported pages: %q", err)
-			return
-		}
-		if n, err := file.Seek(0, os.SEEK_END); err != nil {
-			errorX(c, w, err)
-			return
-		} else if err := importPages(c, file, n); err != nil {
-			errorX(c, w, err)
-			return
 		}
+		return
 	} else if def := r.FormValue("default"); len(def) != 0 {
 		if err := setDefault(c, r, def); err != nil {
 			errorX(c, w, err)
@@ -174,7 +207,7 @@ func pagesHandler(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 	}
-	createHandlers(c)
+	invalidate(c)
 	http.Redirect(w, r, r.URL.Path, http.StatusFound)
 }
 
@@ -210,29 +243,49 @@ func newPage(c appengine.Context, r *http.Request) error {
 	key := datastore.NewKey(c, "$Pages", name, 0, nil)
 	c.Infof("new key: %#v", key)
 	p := Page{
-		Name:     name,
-		Base:     base,
-		Template: file,
+		Name:        name,
+		Base:        base,
+		Template:    file,
+		Title:       r.FormValue("title"),
+		Description: r.FormValue("description"),
+		Canonical:   r.FormValue("canonical"),
+		Image:       r.FormValue("image"),
+		Params:      r.FormValue("params"),
+		Record:      r.FormValue("record"),
 	}
-	c.Infof("new page %#v", p)
-	if _, err := datastore.Put(c, key, &p); err != nil {
+	var err error
+	if p.PublishAt, err = parseTime(r.FormValue("publish")); err != nil {
 		return err
 	}
-	return nil
+	if p.UnpublishAt, err = parseTime(r.FormValue("unpublish")); err != nil {
+		return err
+	}
+	c.Infof("new page %#v", p)
+	return putDraft(c, key, &p)
 }
 
 func editPage(c appengine.Context, r *http.Request, k *datastore.Key) error {
 	var p Page
-	if err := datastore.Get(c, k, &p); err != nil {
+	if err := getDraft(c, k, &p); err != nil {
 		return err
 	}
 	p.Base = r.FormValue("base")
 	p.Template = r.FormValue("file")
-	c.Infof("changed page %#v", p)
-	if _, err := datastore.Put(c, k, &p); err != nil {
+	p.Title = r.FormValue("title")
+	p.Description = r.FormValue("description")
+	p.Canonical = r.FormValue("canonical")
+	p.Image = r.FormValue("image")
+	p.Params = r.FormValue("params")
+	p.Record = r.FormValue("record")
+	var err error
+	if p.PublishAt, err = parseTime(r.FormValue("publish")); err != nil {
 		return err
 	}
-	return nil
+	if p.UnpublishAt, err = parseTime(r.FormValue("unpublish")); err != nil {
+		return err
+	}
+	c.Infof("changed page %#v", p)
+	return putDraft(c, k, &p)
 }
 
 func getTemplate(w http.ResponseWriter, c appengine.Context, r *http.Request, k *datastore.Key) error {
@@ -240,7 +293,7 @@ func getTemplate(w http.ResponseWriter, c appengine.Context, r *http.Request, k
 		return &scmsError{"it is not a page"}
 	}
 	var p Page
-	if err := datastore.Get(c, k, &p); err != nil {
+	if err := getDraft(c, k, &p); err != nil {
 		return err
 	}
 	w.Header().Set("Content-Type", "multipart/form-data; charset=utf-8")
@@ -249,43 +302,50 @@ func getTemplate(w http.ResponseWriter, c appengine.Context, r *http.Request, k
 }
 
 func exportPages(c appengine.Context, w io.Writer) error {
-	q := datastore.NewQuery("$Pages")
-	var p []Page
-	if _, err := q.GetAll(c, &p); err != nil {
-		return err
-	}
-	b := bytes.NewBuffer(nil)
-	z := zip.NewWriter(b)
-	j, err := json.MarshalIndent(p, "", "\t")
+	z := zip.NewWriter(w)
+	zw, err := z.Create("pages")
 	if err != nil {
 		return err
 	}
-	if zw, err := z.Create("pages"); err != nil {
-		return err
-	} else if _, err := zw.Write(j); err != nil {
-		return err
+	// pages are written one by one in the same layout as json.MarshalIndent of all of them
+	sep := "[\n\t"
+	for t := datastore.NewQuery("$Pages").Run(c); ; {
+		var p Page
+		if _, err := t.Next(&p); err == datastore.Done {
+			break
+		} else if err != nil {
+			return err
+		}
+		j, err := json.MarshalIndent(&p, "\t", "\t")
+		if err != nil {
+			return err
+		}
+		if _, err := io.WriteString(zw, sep); err != nil {
+			return err
+		}
+		if _, err := zw.Write(j); err != nil {
+			return err
+		}
+		sep = ",\n\t"
+	}
+	end := "\n]"
+	if sep == "[\n\t" {
+		end = "[]"
 	}
-	z.Close()
-	if _, err := w.Write(b.Bytes()); err != nil {
+	if _, err := io.WriteString(zw, end); err != nil {
 		return err
 	}
-	return nil
+	return z.Close()
 }
 
-func importPages(c appengine.Context, file io.ReaderAt, size int64) error {
-	r, err := zip.NewReader(file, size)
-	if err != nil {
-		return err
-	}
-	for _, v := range r.File {
-		d := make([]byte, v.UncompressedSize)
-		if rc, err := v.Open(); err != nil {
-			return err
-		} else if _, err := io.ReadFull(rc, d); err != nil {
+// parsePages adds pages of an archive to the site s.
+func parsePages(c appengine.Context, a *archive, s *site) error {
+	s.sections["$Pages"] = true
+	for _, v := range a.files {
+		d, err := readEntry(v)
+		if err != nil {
 			c.Errorf("reading of file has failed: %q", err)
-			//return err
-		} else {
-			rc.Close()
+			return err
 		}
 		var p []Page
 		if err := json.Unmarshal(d, &p); err != nil {
@@ -294,12 +354,8 @@ func importPages(c appengine.Context, file io.ReaderAt, size int64) error {
 		}
 		for _, v := range p {
 			v.Name = strings.ToLower(v.Name)
-			key := datastore.NewKey(c, "$Pages", v.Name, 0, nil)
-			if _, err := datastore.Put(c, key, &v); err != nil {
-				return err
-			}
+			s.pages = append(s.pages, v)
 		}
 	}
-
 	return nil
 }
@@ -0,0 +1,167 @@
+// Copyright (c) 2012 Alexander Sychev. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package scms
+
+import (
+	"appengine"
+	"appengine/datastore"
+	"appengine/memcache"
+	"appengine/user"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Records are scheduled by time fields with these names, pages by the same fields of Page.
+const (
+	publishAt   = "PublishAt"
+	unpublishAt = "UnpublishAt"
+)
+
+var timeLayouts = []string{
+	time.RFC3339,
+	"2006-01-02 15:04:05.999999999 -0700 MST",
+	"2006-01-02 15:04:05",
+	"2006-01-02 15:04",
+	"2006-01-02",
+}
+
+// parseTime parses a time entered in the editor, an empty string means no
+// time, so an empty schedule publishes nothing.
+func parseTime(s string) (time.Time, error) {
+	s = strings.TrimSpace(s)
+	if len(s) == 0 {
+		return time.Time{}, nil
+	}
+	var err error
+	for _, l := range timeLayouts {
+		var t time.Time
+		if t, err = time.Parse(l, s); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, err
+}
+
+func scheduled(p, u time.Time, now time.Time) bool {
+	if !p.IsZero() && now.Before(p) {
+		return false
+	}
+	if !u.IsZero() && !now.Before(u) {
+		return false
+	}
+	return true
+}
+
+// visible reports whether a record is published at the moment.
+func visible(data Values, now time.Time) bool {
+	p, _ := data[publishAt].(time.Time)
+	u, _ := data[unpublishAt].(time.Time)
+	return scheduled(p, u, now)
+}
+
+func (this Page) visible(now time.Time) bool {
+	return scheduled(this.PublishAt, this.UnpublishAt, now)
+}
+
+// The generation of handlers is shared by all instances through memcache,
+// an instance recreates its handlers when the generation has been changed.
+const generationKey = "scms:generation"
+
+var generation uint64
+
+// invalidate makes all instances recreate their handlers.
+func invalidate(c appengine.Context) {
+	if _, err := memcache.Increment(c, generationKey, 1, 0); err != nil {
+		c.Errorf("can't invalidate handlers: %v", err)
+	}
+}
+
+func checkGeneration(c appengine.Context) {
+	n, err := memcache.Increment(c, generationKey, 0, 0)
+	if err != nil {
+		c.Errorf("can't get generation of handlers: %v", err)
+		return
+	}
+	handlersLock.RLock()
+	same := n == generation
+	handlersLock.RUnlock()
+	if same {
+		return
+	}
+	handlersLock.Lock()
+	defer handlersLock.Unlock()
+	if n != generation {
+		c.Infof("generation of handlers has been changed: %v -> %v", generation, n)
+		generation = n
+		created = false
+	}
+}
+
+type schedule struct {
+	Last time.Time
+}
+
+// changed reports whether any page or record has been published or unpublished between from and to.
+func changed(c appengine.Context, from, to time.Time) (bool, error) {
+	var g []Group
+	if _, err := datastore.NewQuery("$Groups").GetAll(c, &g); err != nil {
+		return false, err
+	}
+	kinds := []string{"$Pages"}
+	for _, v := range g {
+		kinds = append(kinds, v.Name)
+	}
+	for _, k := range kinds {
+		for _, f := range []string{publishAt, unpublishAt} {
+			n, err := datastore.NewQuery(k).Filter(f+" >", from).Filter(f+" <=", to).KeysOnly().Count(c)
+			if err != nil {
+				return false, err
+			}
+			if n != 0 {
+				c.Infof("%v of %q are scheduled at %v", n, k, f)
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+// cronRequest reports whether r is made by cron or by an administrator. App
+// Engine removes the header from requests which are not made by cron.
+func cronRequest(c appengine.Context, r *http.Request) bool {
+	if r.Header.Get("X-Appengine-Cron") == "true" {
+		return true
+	}
+	u := user.Current(c)
+	return u != nil && u.Admin
+}
+
+// scheduleHandler is called by cron to invalidate cached handlers when scheduled content
+// is published or unpublished.
+func scheduleHandler(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+	if !cronRequest(c, r) {
+		error404(w, r)
+		return
+	}
+	now := time.Now()
+	var s schedule
+	k := datastore.NewKey(c, "$Config", "schedule", 0, nil)
+	if err := datastore.Get(c, k, &s); err != nil && err != datastore.ErrNoSuchEntity {
+		errorX(c, w, err)
+		return
+	}
+	if ok, err := changed(c, s.Last, now); err != nil {
+		errorX(c, w, err)
+		return
+	} else if ok {
+		invalidate(c)
+	}
+	s.Last = now
+	if _, err := datastore.Put(c, k, &s); err != nil {
+		errorX(c, w, err)
+	}
+}
@@ -0,0 +1,266 @@
+// Copyright (c) 2012 Alexander Sychev. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package scms
+
+import (
+	"appengine"
+	"appengine/datastore"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Slug binds a human-readable name to a record. Slugs are stored in "$Slugs"
+// under the parent of the record (or under the group for top-level records),
+// so a slug is unique within its group and parent. When the slug of a record
+// changes, the old one is kept as an alias.
+type Slug struct {
+	Name   string
+	Record *datastore.Key
+	Alias  bool
+}
+
+func makeSlug(s string) string {
+	out := make([]rune, 0, len(s))
+	dash := false
+	for _, r := range strings.ToLower(s) {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			out = append(out, r)
+			dash = false
+		} else if !dash && len(out) != 0 {
+			out = append(out, '-')
+			dash = true
+		}
+	}
+	return strings.TrimRight(string(out), "-")
+}
+
+// sameSlug reports whether s is name or name with a numeric suffix added for uniqueness.
+func sameSlug(s, name string) bool {
+	if s == name {
+		return true
+	}
+	if !strings.HasPrefix(s, name+"-") {
+		return false
+	}
+	_, err := strconv.Atoi(s[len(name)+1:])
+	return err == nil
+}
+
+func slugParent(c appengine.Context, kind string, parent *datastore.Key) *datastore.Key {
+	if parent != nil {
+		return parent
+	}
+	return datastore.NewKey(c, "$Groups", kind, 0, nil)
+}
+
+func currentSlugs(c appengine.Context, k *datastore.Key) ([]*datastore.Key, []Slug, error) {
+	q := datastore.NewQuery("$Slugs").Ancestor(slugParent(c, k.Kind(), k.Parent())).Filter("Record =", k).Filter("Alias =", false)
+	var s []Slug
+	keys, err := q.GetAll(c, &s)
+	return keys, s, err
+}
+
+// updateSlug generates a slug for the record from the field chosen for its group
+// and keeps the previous slug as an alias.
+func updateSlug(c appengine.Context, k *datastore.Key, data Values) error {
+	var g Group
+	if err := datastore.Get(c, datastore.NewKey(c, "$Groups", k.Kind(), 0, nil), &g); err != nil {
+		if err == datastore.ErrNoSuchEntity {
+			return nil
+		}
+		return err
+	}
+	if len(g.Slug) == 0 {
+		return nil
+	}
+	v, ok := data[g.Slug]
+	if !ok {
+		return nil
+	}
+	name := makeSlug(fmt.Sprint(v))
+	if len(name) == 0 {
+		return nil
+	}
+	// slugs of a group and a parent are in one entity group, so a slug is
+	// checked and claimed in a transaction
+	parent := slugParent(c, k.Kind(), k.Parent())
+	return datastore.RunInTransaction(c, func(c appengine.Context) error {
+		keys, cur, err := currentSlugs(c, k)
+		if err != nil {
+			return err
+		}
+		for _, v := range cur {
+			if sameSlug(v.Name, name) {
+				return nil
+			}
+		}
+		slug := name
+		for i := 2; ; i++ {
+			var s Slug
+			sk := datastore.NewKey(c, "$Slugs", slug, 0, parent)
+			if err := datastore.Get(c, sk, &s); err == datastore.ErrNoSuchEntity || (err == nil && s.Record.Equal(k)) {
+				s = Slug{Name: slug, Record: k}
+				if _, err := datastore.Put(c, sk, &s); err != nil {
+					return err
+				}
+				break
+			} else if err != nil {
+				return err
+			}
+			slug = fmt.Sprintf("%s-%d", name, i)
+		}
+		c.Infof("slug of %v: %q", k, slug)
+		for i, v := range cur {
+			if v.Name == slug {
+				continue
+			}
+			v.Alias = true
+			if _, err := datastore.Put(c, keys[i], &v); err != nil {
+				return err
+			}
+		}
+		return nil
+	}, nil)
+}
+
+// removeSlugs removes the slug and the aliases of the deleted record k.
+func removeSlugs(c appengine.Context, k *datastore.Key) error {
+	keys, err := datastore.NewQuery("$Slugs").Ancestor(slugParent(c, k.Kind(), k.Parent())).Filter("Record =", k).KeysOnly().GetAll(c, nil)
+	if err != nil || len(keys) == 0 {
+		return err
+	}
+	return datastore.DeleteMulti(c, keys)
+}
+
+// updateSlugs regenerates slugs for all records of group g.
+func updateSlugs(c appengine.Context, g string) error {
+	var d []entity
+	keys, err := datastore.NewQuery(g).GetAll(c, &d)
+	if err != nil {
+		return err
+	}
+	for i, v := range d {
+		if err := updateSlug(c, keys[i], v.data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// findSlug returns the slug s named in a request or nil. Slugs are unique
+// within a group and a parent only, so the request names them by parameters
+// "group" and "parent", without them the slug must be the only one in the site.
+func findSlug(c appengine.Context, q url.Values, s string) (*Slug, error) {
+	var sl Slug
+	if g := q.Get("group"); len(g) != 0 {
+		var parent *datastore.Key
+		if p := q.Get("parent"); len(p) != 0 {
+			var err error
+			if parent, err = datastore.DecodeKey(p); err != nil {
+				return nil, err
+			}
+		}
+		if err := datastore.Get(c, datastore.NewKey(c, "$Slugs", s, 0, slugParent(c, g, parent)), &sl); err == datastore.ErrNoSuchEntity {
+			return nil, nil
+		} else if err != nil {
+			return nil, err
+		}
+		return &sl, nil
+	}
+	var found []Slug
+	if _, err := datastore.NewQuery("$Slugs").Filter("Name =", s).Limit(2).GetAll(c, &found); err != nil {
+		return nil, err
+	}
+	if len(found) != 1 {
+		return nil, nil
+	}
+	return &found[0], nil
+}
+
+// slugRedirect returns the current slug of a record if s is an alias only.
+func slugRedirect(c appengine.Context, q url.Values, s string) (string, bool) {
+	sl, err := findSlug(c, q, s)
+	if err != nil || sl == nil || !sl.Alias {
+		return "", false
+	}
+	_, cur, err := currentSlugs(c, sl.Record)
+	if err != nil || len(cur) == 0 {
+		return "", false
+	}
+	return cur[0].Name, true
+}
+
+func redirectSlug(c appengine.Context, w http.ResponseWriter, r *http.Request) bool {
+	s := r.URL.Query().Get("slug")
+	if len(s) == 0 {
+		return false
+	}
+	to, ok := slugRedirect(c, r.URL.Query(), s)
+	if !ok {
+		return false
+	}
+	q := r.URL.Query()
+	q.Set("slug", to)
+	c.Infof("slug %q is an alias of %q", s, to)
+	http.Redirect(w, r, r.URL.Path+"?"+q.Encode(), http.StatusMovedPermanently)
+	return true
+}
+
+func (this *Context) GetBySlug(k interface{}, s interface{}, p interface{}) (Value, error) {
+	var out Value
+	if this.ctx == nil {
+		return out, &scmsError{"invalid context"}
+	}
+	kind, ok := k.(string)
+	if !ok {
+		return out, fmt.Errorf("GetBySlug: unexpected type of 'kind': %T, must be string", k)
+	}
+	slug, ok := s.(string)
+	if !ok {
+		return out, fmt.Errorf("GetBySlug: unexpected type of 'slug': %T, must be string", s)
+	}
+	var parent *datastore.Key
+	switch p.(type) {
+	case string:
+		if len(p.(string)) != 0 {
+			var err error
+			parent, err = datastore.DecodeKey(p.(string))
+			if err != nil {
+				return out, err
+			}
+		}
+	case *datastore.Key:
+		parent = p.(*datastore.Key)
+	}
+	var sl Slug
+	key := datastore.NewKey(this.ctx, "$Slugs", slug, 0, slugParent(this.ctx, kind, parent))
+	if err := datastore.Get(this.ctx, key, &sl); err != nil {
+		if err != datastore.ErrNoSuchEntity {
+			return out, err
+		}
+		return out, nil
+	}
+	return this.GetByKey(sl.Record)
+}
+
+func (this *Value) GetBySlug(kind interface{}, slug interface{}, parent interface{}) (Value, error) {
+	return this.ctx.GetBySlug(kind, slug, parent)
+}
+
+// GetSlug returns the current slug of the record or an empty string.
+func (this *Value) GetSlug() (string, error) {
+	if this.Key == nil || this.ctx.ctx == nil {
+		return "", nil
+	}
+	_, cur, err := currentSlugs(this.ctx.ctx, this.Key)
+	if err != nil || len(cur) == 0 {
+		return "", err
+	}
+	return cur[0].Name, nil
+}
@@ -0,0 +1,115 @@
+// Copyright (c) 2012 Alexander Sychev. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package scms
+
+import (
+	"appengine"
+	"appengine/datastore"
+	"appengine/user"
+	"io"
+	"net/http"
+	"time"
+)
+
+// Snapshots are archives of the entire site taken before imports, they are
+// kept in "$Snapshots" as files named by the time. Only the last maxSnapshots
+// are kept.
+const maxSnapshots = 5
+
+// takeSnapshot exports the site straight to chunks of the snapshot.
+func takeSnapshot(c appengine.Context, reason string) error {
+	now := time.Now().UTC()
+	f := File{
+		Name:        "snapshot-" + now.Format("20060102-150405.000000") + ".zip",
+		ContentType: "application/zip",
+		Caption:     reason,
+	}
+	w := newChunkWriter(c, f.Name)
+	if err := exportAll(c, w); err != nil {
+		return err
+	}
+	if err := w.close(&f); err != nil {
+		return err
+	}
+	c.Infof("taking snapshot %q %s", f.Name, reason)
+	if _, err := datastore.Put(c, datastore.NewKey(c, "$Snapshots", f.Name, 0, nil), &f); err != nil {
+		return err
+	}
+	return pruneSnapshots(c)
+}
+
+// pruneSnapshots removes snapshots except the last maxSnapshots along with
+// their chunks. Chunks of a snapshot staged for restoring are left to
+// sweepChunks.
+func pruneSnapshots(c appengine.Context) error {
+	var old []File
+	keys, err := datastore.NewQuery("$Snapshots").Order("-Uploaded").Offset(maxSnapshots).GetAll(c, &old)
+	if err != nil {
+		return err
+	}
+	var chunks []*datastore.Key
+	for _, f := range old {
+		if f.Chunks == 0 {
+			continue
+		}
+		if err := datastore.Get(c, datastore.NewKey(c, "$Imports", f.Hash, 0, nil), &File{}); err == nil {
+			continue
+		} else if err != datastore.ErrNoSuchEntity {
+			return err
+		}
+		for i := int64(0); i < f.Chunks; i++ {
+			chunks = append(chunks, chunkKey(c, f.Hash, i))
+		}
+	}
+	if err := datastore.DeleteMulti(c, keys); err != nil {
+		return err
+	}
+	return datastore.DeleteMulti(c, chunks)
+}
+
+func (this *Context) GetSnapshots() (Cursor, error) {
+	if this.ctx == nil {
+		return nil, &scmsError{"invalid context"}
+	}
+	ctx := Context{ctx: this.ctx}
+	return ctx.Get("$Snapshots", "-Uploaded", "", 0, 0)
+}
+
+func (this *Value) GetSnapshots() (Cursor, error) {
+	return this.ctx.GetSnapshots()
+}
+
+// snapshotHandler serves a snapshot for downloading on GET and
+// shows changes of restoring it on POST.
+func snapshotHandler(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+	if u := user.Current(c); u == nil {
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return
+	}
+	var f File
+	if err := datastore.Get(c, datastore.NewKey(c, "$Snapshots", r.FormValue("id"), 0, nil), &f); err != nil {
+		errorX(c, w, err)
+		return
+	}
+	switch r.Method {
+	case "GET":
+		w.Header().Set("Content-Type", "application/zip")
+		w.Header().Set("Content-Disposition", `attachment; filename="`+f.Name+`"`)
+		if _, err := io.Copy(w, f.reader(c)); err != nil {
+			c.Errorf("download of snapshot %q has failed: %v", f.Name, err)
+		}
+	case "POST":
+		if err := stage(c, &f); err != nil {
+			errorX(c, w, err)
+			return
+		}
+		if err := previewStaged(c, w, &f, "all", replaceMode, "/editor"); err != nil {
+			errorX(c, w, err)
+		}
+	default:
+		error404(w, r)
+	}
+}
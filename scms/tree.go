@@ -0,0 +1,261 @@
+// Copyright (c) 2012 Alexander Sychev. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package scms
+
+import (
+	"appengine"
+	"appengine/datastore"
+	"archive/zip"
+	"encoding/json"
+	"io"
+	"sort"
+	"strings"
+)
+
+// A site can be exported as a tree of plain files to be kept in a version
+// control system and reviewed there. The archive is unpacked into a folder:
+//
+//	manifest.json        the manifest with the default page and counts
+//	files.json           properties of files, ordered by name
+//	files/<name>         files as they are
+//	pages/<name>.json    properties of a page in the order of fields of Page
+//	groups.json          settings of groups
+//	groups/<name>.json   records of a group, ordered by their keys
+//
+// JSON is pretty printed, so every change of the site is a small change of
+// the tree. A tree packed back into a zip archive is imported as all.zip is,
+// either from the root of the archive or from its only top-level folder.
+
+// unwrap returns entries of the only top-level folder of the archive a as an
+// archive, e.g. of "site/" when the folder of the tree itself is zipped. nil is
+// returned if the entries are not in one folder.
+func (this *archive) unwrap() *archive {
+	dir := ""
+	for _, v := range this.files {
+		i := strings.Index(v.Name, "/")
+		if i <= 0 || (len(dir) != 0 && v.Name[:i] != dir) {
+			return nil
+		}
+		dir = v.Name[:i]
+	}
+	if len(dir) == 0 {
+		return nil
+	}
+	return this.subtree(dir, nil)
+}
+
+// isTree reports whether the archive a is a tree of the site.
+func isTree(a *archive) bool {
+	for _, v := range a.files {
+		if v.Name == "files.json" || v.Name == "groups.json" || strings.HasPrefix(v.Name, "files/") || strings.HasPrefix(v.Name, "pages/") || strings.HasPrefix(v.Name, "groups/") {
+			return true
+		}
+	}
+	return false
+}
+
+func exportTree(c appengine.Context, w io.Writer) error {
+	m, err := newManifest(c)
+	if err != nil {
+		return err
+	}
+	z := zip.NewWriter(w)
+	create := func(name string, v interface{}) error {
+		j, err := json.MarshalIndent(v, "", "\t")
+		if err != nil {
+			return err
+		}
+		zw, err := z.Create(name)
+		if err != nil {
+			return err
+		}
+		if _, err := zw.Write(j); err != nil {
+			return err
+		}
+		_, err = io.WriteString(zw, "\n")
+		return err
+	}
+	info := make([]fileInfo, 0)
+	for t := datastore.NewQuery("$Files").Run(c); ; {
+		var v File
+		if _, err := t.Next(&v); err == datastore.Done {
+			break
+		} else if err != nil {
+			return err
+		}
+		fh := &zip.FileHeader{
+			Name:   "files/" + v.Name,
+			Method: zip.Deflate,
+		}
+		fh.SetModTime(v.Uploaded)
+		if zw, err := z.CreateHeader(fh); err != nil {
+			return err
+		} else if _, err := io.Copy(zw, v.reader(c)); err != nil {
+			return err
+		}
+		info = append(info, fileInfo{v.Name, v.ContentType, v.Hash, v.Size, v.Uploaded, v.Uploader, v.Alt, v.Caption, v.Credit})
+	}
+	if err := create("files.json", info); err != nil {
+		return err
+	}
+	m.Sections["files"] = sectionInfo{Count: len(info)}
+	var pages int
+	for t := datastore.NewQuery("$Pages").Run(c); ; {
+		var p Page
+		if _, err := t.Next(&p); err == datastore.Done {
+			break
+		} else if err != nil {
+			return err
+		}
+		if err := create("pages/"+p.Name+".json", &p); err != nil {
+			return err
+		}
+		pages++
+	}
+	m.Sections["pages"] = sectionInfo{Count: pages}
+	var g []Group
+	if _, err := datastore.NewQuery("$Groups").GetAll(c, &g); err != nil {
+		return err
+	}
+	for _, v := range g {
+		zw, err := z.Create("groups/" + v.Name + ".json")
+		if err != nil {
+			return err
+		}
+		// top-level records follow in the order of their keys, children
+		// of each of them are sorted
+		s := groupSchema{Fields: make(map[string]string)}
+		rw := newRecordWriter(zw)
+		if err := walkGroup(c, v.Name, func(r Value) error {
+			s.add(Cursor{r})
+			return rw.write(r, true)
+		}); err != nil {
+			return err
+		}
+		if err := rw.close(); err != nil {
+			return err
+		}
+		s.Slug = v.Slug
+		m.Groups[v.Name] = s
+		if _, err := io.WriteString(zw, "\n"); err != nil {
+			return err
+		}
+	}
+	if err := create("groups.json", g); err != nil {
+		return err
+	}
+	m.Sections["groups"] = sectionInfo{Count: len(g)}
+	if err := create("manifest.json", m); err != nil {
+		return err
+	}
+	return z.Close()
+}
+
+type recordsByKey []record
+
+func (this recordsByKey) Len() int           { return len(this) }
+func (this recordsByKey) Less(i, j int) bool { return string(this[i].Key) < string(this[j].Key) }
+func (this recordsByKey) Swap(i, j int)      { this[i], this[j] = this[j], this[i] }
+
+// sortRecords orders records and their children by keys.
+func sortRecords(recs []record) {
+	sort.Sort(recordsByKey(recs))
+	for _, v := range recs {
+		sortRecords(v.Children)
+	}
+}
+
+// subtree returns entries of the folder dir of the archive, named relative to it.
+// rename changes or drops names, it may be nil.
+func (this *archive) subtree(dir string, rename func(string) string) *archive {
+	a := *this
+	a.name = dir
+	a.files = nil
+	for _, v := range this.files {
+		if !strings.HasPrefix(v.Name, dir+"/") {
+			continue
+		}
+		f := *v
+		f.Name = v.Name[len(dir)+1:]
+		if rename != nil {
+			if f.Name = rename(f.Name); len(f.Name) == 0 {
+				a.reject(v.Name[len(dir)+1:], "unknown entry")
+				continue
+			}
+		}
+		a.files = append(a.files, &f)
+	}
+	return &a
+}
+
+// parseTree adds all sections of a tree of the site to the site s.
+func parseTree(c appengine.Context, a *archive, s *site) error {
+	for _, v := range a.files {
+		switch {
+		case v.Name == "manifest.json" || v.Name == "files.json" || v.Name == "groups.json":
+		case strings.HasPrefix(v.Name, "files/") || strings.HasPrefix(v.Name, "pages/") || strings.HasPrefix(v.Name, "groups/"):
+		default:
+			a.reject(v.Name, "unknown entry")
+		}
+	}
+	files := a.subtree("files", nil)
+	for _, v := range a.files {
+		if v.Name == "files.json" {
+			f := *v
+			f.Name = "$Files"
+			files.files = append(files.files, &f)
+		}
+	}
+	c.Infof("parsing files of tree")
+	if err := parseFiles(c, files, s); err != nil {
+		return err
+	}
+	c.Infof("parsing pages of tree")
+	if err := parseTreePages(c, a.subtree("pages", nil), s); err != nil {
+		return err
+	}
+	c.Infof("parsing groups of tree")
+	groups := a.subtree("groups", func(n string) string {
+		if !strings.HasSuffix(n, ".json") {
+			return ""
+		}
+		return n[:len(n)-len(".json")]
+	})
+	for _, v := range a.files {
+		if v.Name == "groups.json" {
+			f := *v
+			f.Name = "$Groups"
+			groups.files = append(groups.files, &f)
+		}
+	}
+	return parseGroups(c, groups, s)
+}
+
+// parseTreePages adds pages of the folder "pages" of a tree to the site s.
+func parseTreePages(c appengine.Context, a *archive, s *site) error {
+	s.sections["$Pages"] = true
+	for _, v := range a.files {
+		if !strings.HasSuffix(v.Name, ".json") {
+			a.reject(v.Name, "unknown entry")
+			continue
+		}
+		d, err := readEntry(v)
+		if err != nil {
+			c.Errorf("reading of file has failed: %q", err)
+			return err
+		}
+		var p Page
+		if err := json.Unmarshal(d, &p); err != nil {
+			c.Errorf("json can't unmarshal: %q", err)
+			return err
+		}
+		if len(p.Name) == 0 {
+			p.Name = v.Name[:len(v.Name)-len(".json")]
+		}
+		p.Name = strings.ToLower(p.Name)
+		s.pages = append(s.pages, p)
+	}
+	return nil
+}
@@ -0,0 +1,38 @@
+// Copyright (c) 2012 Alexander Sychev. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package scms
+
+import (
+	"archive/zip"
+	"bytes"
+	"testing"
+)
+
+func TestUnwrap(t *testing.T) {
+	for _, v := range []struct {
+		entries []string
+		tree    bool
+	}{
+		{[]string{"manifest.json", "{}", "pages/index.json", "{}"}, true},
+		{[]string{"site/manifest.json", "{}", "site/pages/index.json", "{}"}, true},
+		{[]string{"site/pages/index.json", "{}", "other/pages/a.json", "{}"}, false},
+		{[]string{"site/files.zip", "", "site/pages.zip", ""}, false},
+		{[]string{"files.zip", "", "pages.zip", ""}, false},
+	} {
+		d := testZip(t, v.entries...)
+		r, err := zip.NewReader(bytes.NewReader(d), int64(len(d)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		a := testArchive(defaultLimits)
+		a.files = r.File
+		if u := a.unwrap(); u != nil && isTree(u) {
+			a = u
+		}
+		if isTree(a) != v.tree {
+			t.Errorf("archive of %q: tree is %v, want %v", v.entries, !v.tree, v.tree)
+		}
+	}
+}
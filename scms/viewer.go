@@ -9,8 +9,10 @@ import (
 	"html/template"
 	ttpl "text/template"
 	"bytes"
+	"time"
 	"appengine"
 	"appengine/datastore"
+	"sync"
 )
 
 type scmsError struct {
@@ -19,6 +21,11 @@ type scmsError struct {
 
 var created = false
 var paths = make(map[string]bool)
+var handlers = make(map[string]func(w http.ResponseWriter, r *http.Request))
+
+// handlersLock guards created, paths and handlers, they are recreated while
+// other requests are served.
+var handlersLock sync.RWMutex
 
 func init() {
 	http.HandleFunc("/", rootHandler)
@@ -27,6 +34,14 @@ func init() {
 	http.HandleFunc("/editor/groups", groupsHandler)
 	http.HandleFunc("/editor/group", groupHandler)
 	http.HandleFunc("/editor/files", filesHandler)
+	http.HandleFunc("/editor/media", mediaHandler)
+	http.HandleFunc("/editor/import", importHandler)
+	http.HandleFunc("/editor/snapshot", snapshotHandler)
+	http.HandleFunc("/editor/history", historyHandler)
+	http.HandleFunc("/editor/schedule", scheduleHandler)
+	http.HandleFunc("/editor/chunks", chunksHandler)
+	http.HandleFunc("/preview/", previewHandler)
+	http.HandleFunc("/api/", apiHandler)
 	http.HandleFunc("/login", loginHandler)
 	http.HandleFunc("/logout", logoutHandler)
 }
@@ -64,23 +79,49 @@ func rootHandler(w http.ResponseWriter, r *http.Request) {
 		}
 		errorX(c, w, &scmsError{"no default page is specified"})
 		return
-	} else if err := exportFile(c, w, r.URL.Path[1:]); err == nil {
+	} else if err := exportFile(c, w, r, cleanName(r.URL.Path), false); err == nil {
 		return
 	}
-	if !created {
-		if err := createHandlers(c); err != nil {
-			http.Redirect(w, r, "/editor", http.StatusFound)
-			return
-		}
-		created = true
+	if err := ensureHandlers(c); err != nil {
+		http.Redirect(w, r, "/editor", http.StatusFound)
+		return
 	}
-	if _, ok := paths[r.URL.Path]; ok {
+	handlersLock.RLock()
+	_, ok := paths[r.URL.Path]
+	handlersLock.RUnlock()
+	if ok {
 		http.Redirect(w, r, r.URL.RawQuery, http.StatusFound)
 	} else {
 		http.NotFound(w, r)
 	}
 }
 
+// ensureHandlers creates handlers of pages if they are not created yet or
+// their generation has been changed.
+func ensureHandlers(c appengine.Context) error {
+	checkGeneration(c)
+	if _, err := loadSigningKey(c); err != nil {
+		c.Errorf("can't load the key of derivatives: %v", err)
+	}
+	handlersLock.RLock()
+	ok := created
+	handlersLock.RUnlock()
+	if ok {
+		return nil
+	}
+	handlersLock.Lock()
+	defer handlersLock.Unlock()
+	if created {
+		return nil
+	}
+	if err := createHandlers(c); err != nil {
+		return err
+	}
+	created = true
+	return nil
+}
+
+// createHandlers creates handlers of pages, handlersLock must be held.
 func createHandlers(c appengine.Context) error {
 	q := datastore.NewQuery("$Pages")
 	var p []Page
@@ -103,7 +144,10 @@ func createHandlers(c appengine.Context) error {
 			return err
 		}
 		c.Infof("handling  page: %#v, handler: %#v", v.Name, h)
-		http.HandleFunc("/"+v.Name, h)
+		if !paths["/"+v.Name] {
+			http.HandleFunc("/"+v.Name, pageHandler)
+		}
+		handlers["/"+v.Name] = h
 		paths["/"+v.Name] = true
 	}
 	if len(paths) == 0 {
@@ -113,30 +157,11 @@ func createHandlers(c appengine.Context) error {
 }
 
 func createHandler(c appengine.Context, p Page) (func(w http.ResponseWriter, r *http.Request), error) {
-	b := bytes.NewBuffer(nil)
-	var base File
-	if err := datastore.Get(c, datastore.NewKey(c, "$Files", p.Base, 0, nil), &base); err != nil {
-		return nil, err
-	}
-	c.Infof("base template: %q", string(base.Data))
-	var templ File
-	if err := datastore.Get(c, datastore.NewKey(c, "$Files", p.Template, 0, nil), &templ); err != nil {
-		return nil, err
-	}
-	c.Infof("template: %q", string(templ.Data))
-	if tpl, err := ttpl.New(p.Base).Parse(string(base.Data)); err != nil {
-		return nil, err
-	} else if err := tpl.Execute(b, string(templ.Data)); err != nil {
-		return nil, err
-	}
-	c.Infof("creating handler for page %#v", p.Name)
-	c.Infof("ready template: %q", b.String())
-	tpl, err := template.New(p.Name).Parse(b.String())
+	tpl, err := parsePage(c, p, false)
 	if err != nil {
 		return nil, err
 	}
 	name := "/" + p.Name
-	tpl.Funcs(funcMap)
 	return func(w http.ResponseWriter, r *http.Request) {
 		c := appengine.NewContext(r)
 		c.Infof("request in custom handler of '%#v': %#v", name, r)
@@ -148,14 +173,87 @@ func createHandler(c appengine.Context, p Page) (func(w http.ResponseWriter, r *
 			error404(w, r)
 			return
 		}
-		ctx := Context{
-			ctx: c,
-		}
-		w.Header().Set("Content-Type", "text/html; charset=utf-8")
-		if err := tpl.Execute(w, &ctx); err != nil {
+		executePage(c, w, r, tpl, p, false)
+	}, nil
+}
+
+func parsePage(c appengine.Context, p Page, draft bool) (*template.Template, error) {
+	b := bytes.NewBuffer(nil)
+	var base File
+	if err := getEntity(c, datastore.NewKey(c, "$Files", p.Base, 0, nil), &base, draft); err != nil {
+		return nil, err
+	}
+	bd, err := base.content(c)
+	if err != nil {
+		return nil, err
+	}
+	c.Infof("base template: %q", string(bd))
+	var templ File
+	if err := getEntity(c, datastore.NewKey(c, "$Files", p.Template, 0, nil), &templ, draft); err != nil {
+		return nil, err
+	}
+	td, err := templ.content(c)
+	if err != nil {
+		return nil, err
+	}
+	c.Infof("template: %q", string(td))
+	if tpl, err := ttpl.New(p.Base).Parse(string(bd)); err != nil {
+		return nil, err
+	} else if err := tpl.Execute(b, string(td)); err != nil {
+		return nil, err
+	}
+	c.Infof("creating handler for page %#v", p.Name)
+	c.Infof("ready template: %q", b.String())
+	tpl, err := template.New(p.Name).Funcs(funcMap).Parse(b.String())
+	if err != nil {
+		return nil, err
+	}
+	return tpl, nil
+}
+
+func executePage(c appengine.Context, w http.ResponseWriter, r *http.Request, tpl *template.Template, p Page, draft bool) {
+	if !draft && !p.visible(time.Now()) {
+		error404(w, r)
+		return
+	}
+	if redirectSlug(c, w, r) {
+		return
+	}
+	meta := newMeta(p)
+	if len(p.Record) != 0 {
+		if d, err := recordOf(c, r, p.Record, draft); err != nil {
 			c.Errorf("%v", err)
+		} else if d != nil {
+			meta.override(d)
 		}
-	}, nil
+	}
+	ctx := Context{
+		ctx:    c,
+		meta:   &meta,
+		draft:  draft,
+		public: !draft,
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	cw, done := compressResponse(w, r, "text/html")
+	defer done()
+	if err := tpl.Execute(cw, &ctx); err != nil {
+		c.Errorf("%v", err)
+	}
+}
+
+func pageHandler(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+	if err := ensureHandlers(c); err != nil {
+		c.Errorf("createHandlers returns error: %q", err)
+	}
+	handlersLock.RLock()
+	h, ok := handlers[r.URL.Path]
+	handlersLock.RUnlock()
+	if ok {
+		h(w, r)
+		return
+	}
+	error404(w, r)
 }
 
 func (this scmsError) Error() string {
@@ -0,0 +1,556 @@
+// Copyright (c) 2012 Alexander Sychev. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package scms
+
+import (
+	"appengine"
+	"appengine/datastore"
+	"bytes"
+	"encoding/xml"
+	"io"
+	"net/url"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A WordPress site is imported from its export file (WXR) as section "wxr".
+// Posts, pages, categories, tags and comments become records of the groups
+// below. Parents are kept as ancestors of keys: a page is a child of its
+// parent page, a category is a child of its parent category and a comment is
+// a child of the comment it replies to; the field "Post" of a comment is the
+// key of its post or page. Posts, pages and comments keep their ids and
+// categories and tags keep their slugs, so a repeated import merges the
+// records. Items in the trash, automatic drafts and comments in the trash or
+// spam are not imported. Other items which are not published and comments
+// which are not approved are hidden by UnpublishAt set to wxrHidden, scheduled
+// items are published at their date by PublishAt. Nothing is downloaded: the export may
+// be uploaded in a zip archive along with the uploaded files of WordPress,
+// they become files of the site and references to them in the content are
+// replaced by references to the files.
+const (
+	wxrPosts      = "Posts"
+	wxrPages      = "Pages"
+	wxrCategories = "Categories"
+	wxrTags       = "Tags"
+	wxrComments   = "Comments"
+)
+
+// wxrHidden is UnpublishAt of records which are not published in WordPress,
+// it is a fixed time, so repeated previews of an import make the same changes.
+var wxrHidden = time.Unix(0, 0).UTC()
+
+type wxrChannel struct {
+	Version    string        `xml:"wxr_version"`
+	Categories []wxrCategory `xml:"category"`
+	Tags       []wxrTag      `xml:"tag"`
+	Items      []wxrItem     `xml:"item"`
+}
+
+type wxrCategory struct {
+	Slug        string `xml:"category_nicename"`
+	Parent      string `xml:"category_parent"`
+	Name        string `xml:"cat_name"`
+	Description string `xml:"category_description"`
+}
+
+type wxrTag struct {
+	Slug        string `xml:"tag_slug"`
+	Name        string `xml:"tag_name"`
+	Description string `xml:"tag_description"`
+}
+
+type wxrItem struct {
+	Title         string       `xml:"title"`
+	Link          string       `xml:"link"`
+	PubDate       string       `xml:"pubDate"`
+	Creator       string       `xml:"creator"`
+	Encoded       []wxrEncoded `xml:"encoded"`
+	PostID        string       `xml:"post_id"`
+	PostDate      string       `xml:"post_date"`
+	PostDateGMT   string       `xml:"post_date_gmt"`
+	Name          string       `xml:"post_name"`
+	Status        string       `xml:"status"`
+	Parent        string       `xml:"post_parent"`
+	MenuOrder     string       `xml:"menu_order"`
+	Type          string       `xml:"post_type"`
+	AttachmentURL string       `xml:"attachment_url"`
+	Terms         []wxrTerm    `xml:"category"`
+	Meta          []wxrMeta    `xml:"postmeta"`
+	Comments      []wxrComment `xml:"comment"`
+}
+
+// wxrEncoded is either content:encoded or excerpt:encoded, namespaces of
+// excerpts differ in versions of WXR.
+type wxrEncoded struct {
+	XMLName xml.Name
+	Text    string `xml:",chardata"`
+}
+
+type wxrTerm struct {
+	Domain string `xml:"domain,attr"`
+	Slug   string `xml:"nicename,attr"`
+	Name   string `xml:",chardata"`
+}
+
+type wxrMeta struct {
+	Key   string `xml:"meta_key"`
+	Value string `xml:"meta_value"`
+}
+
+type wxrComment struct {
+	ID       string `xml:"comment_id"`
+	Author   string `xml:"comment_author"`
+	Email    string `xml:"comment_author_email"`
+	URL      string `xml:"comment_author_url"`
+	Date     string `xml:"comment_date"`
+	DateGMT  string `xml:"comment_date_gmt"`
+	Content  string `xml:"comment_content"`
+	Approved string `xml:"comment_approved"`
+	Type     string `xml:"comment_type"`
+	Parent   string `xml:"comment_parent"`
+}
+
+func (this *wxrItem) encoded(ns string) string {
+	for _, v := range this.Encoded {
+		if strings.Contains(v.XMLName.Space, ns) {
+			return v.Text
+		}
+	}
+	return ""
+}
+
+func (this *wxrItem) meta(k string) string {
+	for _, v := range this.Meta {
+		if v.Key == k {
+			return v.Value
+		}
+	}
+	return ""
+}
+
+// wxrID returns a numeric id of WordPress, 0 means there is no id.
+func wxrID(s string) int64 {
+	n, _ := strconv.ParseInt(strings.TrimSpace(s), 10, 64)
+	return n
+}
+
+// wxrTime returns the first valid time of WordPress, drafts have zero times in GMT.
+func wxrTime(gmt, local, pub string) (time.Time, bool) {
+	for _, s := range []string{gmt, local} {
+		if t, err := time.Parse("2006-01-02 15:04:05", strings.TrimSpace(s)); err == nil {
+			return t, true
+		}
+	}
+	if t, err := time.Parse(time.RFC1123Z, strings.TrimSpace(pub)); err == nil {
+		return t.UTC(), true
+	}
+	return time.Time{}, false
+}
+
+// read adds the content of the export r to the channel.
+func (this *wxrChannel) read(r io.Reader) error {
+	var rss struct {
+		Channel wxrChannel `xml:"channel"`
+	}
+	if err := xml.NewDecoder(r).Decode(&rss); err != nil {
+		return err
+	}
+	if len(rss.Channel.Version) == 0 {
+		return &scmsError{"not an export of WordPress"}
+	}
+	this.Version = rss.Channel.Version
+	this.Categories = append(this.Categories, rss.Channel.Categories...)
+	this.Tags = append(this.Tags, rss.Channel.Tags...)
+	this.Items = append(this.Items, rss.Channel.Items...)
+	return nil
+}
+
+// wxrUploads maps URLs of files uploaded to WordPress to files of the archive.
+type wxrUploads struct {
+	files map[string]int
+	bases map[string]*wxrBase
+}
+
+// wxrBase is a folder of uploads, re matches URLs of files in it.
+type wxrBase struct {
+	url    string
+	folder string
+	re     *regexp.Regexp
+}
+
+// match returns the file of the archive for the URL u of an attachment. The
+// file is the one with the longest trailing part of its name which is also
+// the trailing part of the path of u.
+func (this *wxrUploads) match(u string) (string, bool) {
+	p, err := url.Parse(strings.TrimSpace(u))
+	if err != nil || len(p.Host) == 0 {
+		return "", false
+	}
+	var name, tail string
+	for n := range this.files {
+		for t := n; ; {
+			if strings.HasSuffix(p.Path, "/"+t) {
+				if len(t) > len(tail) || len(t) == len(tail) && n < name {
+					name, tail = n, t
+				}
+				break
+			}
+			i := strings.Index(t, "/")
+			if i < 0 {
+				break
+			}
+			t = t[i+1:]
+		}
+	}
+	if len(name) == 0 {
+		return "", false
+	}
+	base := p.Host + p.Path[:len(p.Path)-len(tail)]
+	if _, ok := this.bases[base]; !ok {
+		this.bases[base] = &wxrBase{
+			url:    base,
+			folder: name[:len(name)-len(tail)],
+			re:     regexp.MustCompile(`(?:https?:)?//` + regexp.QuoteMeta(base) + `[^"'\s<>()\[\]?#]+`),
+		}
+	}
+	return name, true
+}
+
+// rewrite replaces URLs of uploaded files in the text s by URLs of files of the archive.
+func (this *wxrUploads) rewrite(s string) string {
+	for _, b := range this.bases {
+		s = b.re.ReplaceAllStringFunc(s, func(m string) string {
+			t, err := url.Parse(m[strings.Index(m, "//")+2+len(b.url):])
+			if err != nil {
+				return m
+			}
+			n := b.folder + t.Path
+			if _, ok := this.files[n]; !ok {
+				return m
+			}
+			return (&url.URL{Path: "/" + n}).String()
+		})
+	}
+	return s
+}
+
+// wxrKeys returns keys of entities nested by their parents. parents maps ids
+// to ids of parents, newKey makes a key of an entity with a parent which is
+// nil for top-level entities. Cycles of parents are broken.
+func wxrKeys(parents map[string]string, newKey func(id string, parent *datastore.Key) *datastore.Key) map[string]*datastore.Key {
+	keys := make(map[string]*datastore.Key)
+	// an entity which parents are being resolved is a parent of itself, its
+	// child becomes a top-level entity
+	visiting := make(map[string]bool)
+	var key func(id string) *datastore.Key
+	key = func(id string) *datastore.Key {
+		if k, ok := keys[id]; ok {
+			return k
+		}
+		if visiting[id] {
+			return nil
+		}
+		visiting[id] = true
+		var p *datastore.Key
+		if pid, ok := parents[id]; ok {
+			if _, ok := parents[pid]; ok {
+				p = key(pid)
+			}
+		}
+		keys[id] = newKey(id, p)
+		return keys[id]
+	}
+	for id := range parents {
+		key(id)
+	}
+	return keys
+}
+
+// wxrRecord returns a record with the key k, its parent is set if it is of the same group.
+func wxrRecord(source string, k *datastore.Key, data Values) *flatRecord {
+	r := &flatRecord{Value: Value{Key: k, Data: data}, source: source}
+	if p := k.Parent(); p != nil && p.Kind() == k.Kind() {
+		r.parent = p
+	}
+	return r
+}
+
+// parseWXRArchive adds the content of exports of WordPress in the archive a
+// to the site s, other entries of the archive are uploaded files.
+func parseWXRArchive(c appengine.Context, a *archive, s *site) error {
+	var ch wxrChannel
+	files := *a
+	files.files = nil
+	found := false
+	for _, v := range a.files {
+		if strings.ToLower(path.Ext(v.Name)) != ".xml" {
+			files.files = append(files.files, v)
+			continue
+		}
+		d, err := readEntry(v)
+		if err != nil {
+			c.Errorf("reading of file has failed: %q", err)
+			return err
+		}
+		if err := ch.read(bytes.NewReader(d)); err != nil {
+			a.reject(v.Name, err.Error())
+			continue
+		}
+		found = true
+	}
+	if !found {
+		return &scmsError{"export of WordPress is not found in the archive"}
+	}
+	return ch.parse(c, &files, s)
+}
+
+// openWXR parses an export of WordPress uploaded without files.
+func openWXR(c appengine.Context, r io.Reader) (*site, []rejection, error) {
+	var ch wxrChannel
+	if err := ch.read(r); err != nil {
+		return nil, nil, err
+	}
+	a := &archive{c: c, rejected: new([]rejection)}
+	s := newSite()
+	err := ch.parse(c, a, s)
+	return s, *a.rejected, err
+}
+
+// parse adds records of the channel to the site s, the archive a has the uploaded files.
+func (this *wxrChannel) parse(c appengine.Context, a *archive, s *site) error {
+	s.keyed = true
+	if len(a.files) != 0 {
+		if err := parseFiles(c, a, s); err != nil {
+			return err
+		}
+	}
+	up := &wxrUploads{files: make(map[string]int), bases: make(map[string]*wxrBase)}
+	for i, v := range s.files {
+		up.files[v.info.Name] = i
+	}
+	// attachments are files, their ids are used by featured images
+	images := make(map[int64]string)
+	for _, v := range this.Items {
+		if v.Type != "attachment" {
+			continue
+		}
+		n, ok := up.match(v.AttachmentURL)
+		if !ok {
+			a.reject(v.AttachmentURL, "file is not in the archive")
+			continue
+		}
+		images[wxrID(v.PostID)] = n
+		f := &s.files[up.files[n]].info
+		if alt := v.meta("_wp_attachment_image_alt"); len(alt) != 0 {
+			f.Alt = alt
+		}
+		if e := v.encoded("excerpt"); len(e) != 0 {
+			f.Caption = e
+		}
+	}
+
+	// categories and tags are also listed by items they are assigned to
+	cats := make(map[string]wxrCategory)
+	var catOrder []string
+	addCategory := func(v wxrCategory) {
+		if _, ok := cats[v.Slug]; !ok && len(v.Slug) != 0 {
+			cats[v.Slug] = v
+			catOrder = append(catOrder, v.Slug)
+		}
+	}
+	tags := make(map[string]wxrTag)
+	var tagOrder []string
+	addTag := func(v wxrTag) {
+		if _, ok := tags[v.Slug]; !ok && len(v.Slug) != 0 {
+			tags[v.Slug] = v
+			tagOrder = append(tagOrder, v.Slug)
+		}
+	}
+	for _, v := range this.Categories {
+		addCategory(v)
+	}
+	for _, v := range this.Tags {
+		addTag(v)
+	}
+	for _, v := range this.Items {
+		for _, t := range v.Terms {
+			switch t.Domain {
+			case "category":
+				addCategory(wxrCategory{Slug: t.Slug, Name: t.Name})
+			case "post_tag":
+				addTag(wxrTag{Slug: t.Slug, Name: t.Name})
+			}
+		}
+	}
+	catParents := make(map[string]string)
+	for _, v := range cats {
+		catParents[v.Slug] = v.Parent
+	}
+	catKeys := wxrKeys(catParents, func(id string, p *datastore.Key) *datastore.Key {
+		return datastore.NewKey(c, wxrCategories, id, 0, p)
+	})
+	var recs []*flatRecord
+	for _, slug := range catOrder {
+		v := cats[slug]
+		data := Values{"Name": v.Name, "Slug": v.Slug}
+		if len(v.Description) != 0 {
+			data["Description"] = v.Description
+		}
+		recs = append(recs, wxrRecord("category "+slug, catKeys[slug], data))
+	}
+	s.addWXRGroup(a, wxrCategories, recs)
+	recs = nil
+	for _, slug := range tagOrder {
+		v := tags[slug]
+		data := Values{"Name": v.Name, "Slug": v.Slug}
+		if len(v.Description) != 0 {
+			data["Description"] = v.Description
+		}
+		recs = append(recs, wxrRecord("tag "+slug, datastore.NewKey(c, wxrTags, slug, 0, nil), data))
+	}
+	s.addWXRGroup(a, wxrTags, recs)
+
+	// posts and pages are nested by parents of the same type
+	groups := map[string]string{"post": wxrPosts, "page": wxrPages}
+	parents := map[string]map[string]string{"post": {}, "page": {}}
+	for _, v := range this.Items {
+		switch {
+		case v.Type == "attachment":
+		case len(groups[v.Type]) == 0:
+			a.reject("item "+v.PostID, "type "+strconv.Quote(v.Type)+" is not supported")
+		case wxrID(v.PostID) == 0:
+			a.reject("item "+strconv.Quote(v.Title), "item has no id")
+		case v.Status == "trash" || v.Status == "auto-draft":
+			a.reject("item "+v.PostID, "item of status "+strconv.Quote(v.Status)+" is not imported")
+		default:
+			parents[v.Type][strconv.FormatInt(wxrID(v.PostID), 10)] = strconv.FormatInt(wxrID(v.Parent), 10)
+		}
+	}
+	keys := make(map[string]*datastore.Key)
+	for t, g := range groups {
+		g := g
+		for id, k := range wxrKeys(parents[t], func(id string, p *datastore.Key) *datastore.Key {
+			return datastore.NewKey(c, g, "", wxrID(id), p)
+		}) {
+			keys[id] = k
+		}
+	}
+	posts := make(map[string][]*flatRecord)
+	comments := make(map[string]string)
+	commentPosts := make(map[string]*datastore.Key)
+	var commentData []wxrComment
+	for _, v := range this.Items {
+		id := strconv.FormatInt(wxrID(v.PostID), 10)
+		k, ok := keys[id]
+		if !ok || len(groups[v.Type]) == 0 {
+			continue
+		}
+		data := Values{"Title": v.Title, "Content": up.rewrite(v.encoded("content"))}
+		set := func(n, s string) {
+			if len(s) != 0 {
+				data[n] = s
+			}
+		}
+		set("Slug", v.Name)
+		set("Excerpt", up.rewrite(v.encoded("excerpt")))
+		set("Author", v.Creator)
+		set("Status", v.Status)
+		set("Link", v.Link)
+		date, dated := wxrTime(v.PostDateGMT, v.PostDate, v.PubDate)
+		if dated {
+			data["Date"] = date
+		}
+		switch {
+		case v.Status == "publish":
+		case v.Status == "future" && dated:
+			data[publishAt] = date
+		default:
+			data[unpublishAt] = wxrHidden
+		}
+		if v.Type == "page" {
+			data["Order"] = wxrID(v.MenuOrder)
+		}
+		var vc, vt []string
+		for _, t := range v.Terms {
+			switch {
+			case len(t.Slug) == 0:
+			case t.Domain == "category":
+				vc = append(vc, t.Slug)
+			case t.Domain == "post_tag":
+				vt = append(vt, t.Slug)
+			}
+		}
+		set("Categories", strings.Join(vc, ", "))
+		set("Tags", strings.Join(vt, ", "))
+		set("Image", images[wxrID(v.meta("_thumbnail_id"))])
+		posts[v.Type] = append(posts[v.Type], wxrRecord("item "+id, k, data))
+		for _, m := range v.Comments {
+			cid := strconv.FormatInt(wxrID(m.ID), 10)
+			if cid == "0" {
+				a.reject("comment of item "+id, "comment has no id")
+				continue
+			}
+			if m.Approved == "spam" || m.Approved == "trash" || m.Approved == "post-trashed" {
+				a.reject("comment "+cid, "comment of status "+strconv.Quote(m.Approved)+" is not imported")
+				continue
+			}
+			comments[cid] = strconv.FormatInt(wxrID(m.Parent), 10)
+			commentPosts[cid] = k
+			commentData = append(commentData, m)
+		}
+	}
+	s.addWXRGroup(a, wxrPosts, posts["post"])
+	s.addWXRGroup(a, wxrPages, posts["page"])
+
+	// comments are children of the comments they reply to and refer to posts
+	commentKeys := wxrKeys(comments, func(id string, p *datastore.Key) *datastore.Key {
+		return datastore.NewKey(c, wxrComments, "", wxrID(id), p)
+	})
+	recs = nil
+	for _, m := range commentData {
+		id := strconv.FormatInt(wxrID(m.ID), 10)
+		data := Values{"Content": up.rewrite(m.Content), "Post": commentPosts[id]}
+		set := func(n, s string) {
+			if len(s) != 0 {
+				data[n] = s
+			}
+		}
+		set("Author", m.Author)
+		set("Email", m.Email)
+		set("URL", m.URL)
+		set("Type", m.Type)
+		switch m.Approved {
+		case "1":
+			data["Status"] = "approved"
+		case "0":
+			data["Status"] = "pending"
+			data[unpublishAt] = wxrHidden
+		default:
+			set("Status", m.Approved)
+			data[unpublishAt] = wxrHidden
+		}
+		if t, ok := wxrTime(m.DateGMT, m.Date, ""); ok {
+			data["Date"] = t
+		}
+		recs = append(recs, wxrRecord("comment "+id, commentKeys[id], data))
+	}
+	s.addWXRGroup(a, wxrComments, recs)
+	return nil
+}
+
+// addWXRGroup adds records of the group g to the site if there are any.
+func (this *site) addWXRGroup(a *archive, g string, recs []*flatRecord) {
+	if len(recs) == 0 {
+		return
+	}
+	cur, rejected := nestRecords(recs)
+	for _, v := range rejected {
+		a.reject(v.Name, v.Reason)
+	}
+	this.groups = append(this.groups, importedGroup{name: g, records: cur})
+}
@@ -0,0 +1,115 @@
+// Copyright (c) 2012 Alexander Sychev. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package scms
+
+import (
+	"appengine/datastore"
+	"testing"
+	"time"
+)
+
+func TestWXRKeys(t *testing.T) {
+	for _, v := range []struct {
+		parents map[string]string
+		// want maps ids to ids of parents, entities of cycles are not listed
+		want  map[string]string
+		cycle []string
+	}{
+		{map[string]string{"1": "0", "2": "1", "3": "2"}, map[string]string{"1": "", "2": "1", "3": "2"}, nil},
+		{map[string]string{"1": "1"}, map[string]string{"1": ""}, nil},
+		{map[string]string{"1": "2", "2": "1"}, map[string]string{}, []string{"1", "2"}},
+		{map[string]string{"1": "2", "2": "3", "3": "1", "4": "3"}, map[string]string{}, []string{"1", "2", "3"}},
+	} {
+		ids := make(map[*datastore.Key]string)
+		got := make(map[string]string)
+		made := make(map[string]int)
+		keys := wxrKeys(v.parents, func(id string, parent *datastore.Key) *datastore.Key {
+			k := new(datastore.Key)
+			ids[k] = id
+			got[id] = ids[parent]
+			made[id]++
+			return k
+		})
+		for id := range v.parents {
+			if made[id] != 1 || ids[keys[id]] != id {
+				t.Errorf("%v: key of %q is made %v times", v.parents, id, made[id])
+			}
+			// parents of every entity end with a top-level entity
+			n := 0
+			for p := id; len(p) != 0; p = got[p] {
+				if n++; n > len(v.parents) {
+					t.Errorf("%v: parents of %q are a cycle", v.parents, id)
+					break
+				}
+			}
+		}
+		for id, p := range v.want {
+			if got[id] != p {
+				t.Errorf("%v: parent of %q is %q, want %q", v.parents, id, got[id], p)
+			}
+		}
+		roots := 0
+		for _, id := range v.cycle {
+			if len(got[id]) == 0 {
+				roots++
+			}
+		}
+		if len(v.cycle) != 0 && roots != 1 {
+			t.Errorf("%v: %v top-level entities of the cycle, want 1", v.parents, roots)
+		}
+	}
+}
+
+func TestWXRUploads(t *testing.T) {
+	up := &wxrUploads{
+		files: map[string]int{"uploads/2012/05/a.jpg": 0, "media/b.png": 1},
+		bases: make(map[string]*wxrBase),
+	}
+	for _, v := range []struct {
+		url  string
+		name string
+		ok   bool
+	}{
+		{"http://example.com/wp-content/uploads/2012/05/a.jpg", "uploads/2012/05/a.jpg", true},
+		{"https://cdn.example.com/files/b.png", "media/b.png", true},
+		{"http://example.com/wp-content/uploads/c.jpg", "", false},
+		{"/wp-content/uploads/2012/05/a.jpg", "", false},
+		{"not a url", "", false},
+	} {
+		if n, ok := up.match(v.url); n != v.name || ok != v.ok {
+			t.Errorf("match(%q) = %q, %v, want %q, %v", v.url, n, ok, v.name, v.ok)
+		}
+	}
+	for _, v := range []struct {
+		text string
+		want string
+	}{
+		{`<img src="http://example.com/wp-content/uploads/2012/05/a.jpg">`, `<img src="/uploads/2012/05/a.jpg">`},
+		{`<a href='//cdn.example.com/files/b.png?x=1'>`, `<a href='/media/b.png?x=1'>`},
+		{`<img src="http://example.com/wp-content/uploads/c.jpg">`, `<img src="http://example.com/wp-content/uploads/c.jpg">`},
+		{`http://other.com/files/b.png`, `http://other.com/files/b.png`},
+	} {
+		if s := up.rewrite(v.text); s != v.want {
+			t.Errorf("rewrite(%q) = %q, want %q", v.text, s, v.want)
+		}
+	}
+}
+
+func TestWXRTime(t *testing.T) {
+	for _, v := range []struct {
+		gmt, local, pub string
+		want            time.Time
+		ok              bool
+	}{
+		{"2012-05-01 10:00:00", "2012-05-01 12:00:00", "", time.Date(2012, 5, 1, 10, 0, 0, 0, time.UTC), true},
+		{"0000-00-00 00:00:00", "2012-05-01 12:00:00", "", time.Date(2012, 5, 1, 12, 0, 0, 0, time.UTC), true},
+		{"", "", "Tue, 01 May 2012 10:00:00 +0200", time.Date(2012, 5, 1, 8, 0, 0, 0, time.UTC), true},
+		{"0000-00-00 00:00:00", "", "", time.Time{}, false},
+	} {
+		if tm, ok := wxrTime(v.gmt, v.local, v.pub); !tm.Equal(v.want) || ok != v.ok {
+			t.Errorf("wxrTime(%q, %q, %q) = %v, %v, want %v, %v", v.gmt, v.local, v.pub, tm, ok, v.want, v.ok)
+		}
+	}
+}
@@ -0,0 +1,646 @@
+// Copyright (c) 2012 Alexander Sychev. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build !appengine
+
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/sha1"
+	"encoding/json"
+	"fmt"
+	htpl "html/template"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	ttpl "text/template"
+	"time"
+)
+
+// local is a tree of a site in a folder, laid out as in tree.zip:
+// manifest.json, files.json, files/, pages/, groups.json and groups/.
+type local struct {
+	dir string
+}
+
+// path returns the path of the entry n of the tree, n must not leave the tree.
+func (this *local) path(n string) (string, error) {
+	c := path.Clean("/" + strings.Replace(n, "\\", "/", -1))[1:]
+	if len(c) == 0 || c != n {
+		return "", fmt.Errorf("invalid name %q", n)
+	}
+	return filepath.Join(this.dir, filepath.FromSlash(c)), nil
+}
+
+func (this *local) read(n string) ([]byte, error) {
+	p, err := this.path(n)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadFile(p)
+}
+
+func (this *local) write(n string, d []byte) error {
+	p, err := this.path(n)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(p, d, 0644)
+}
+
+// writeJSON writes v pretty printed like exports of the server.
+func (this *local) writeJSON(n string, v interface{}) error {
+	j, err := json.MarshalIndent(v, "", "\t")
+	if err != nil {
+		return err
+	}
+	return this.write(n, append(j, '\n'))
+}
+
+func (this *local) readJSON(n string, v interface{}) error {
+	d, err := this.read(n)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(d, v); err != nil {
+		return fmt.Errorf("%v: %v", n, err)
+	}
+	return nil
+}
+
+// entry returns the name of the entry of the tree for an entity of kind named name.
+func entry(kind, name string) (string, error) {
+	switch kind {
+	case "pages", "groups":
+		if len(name) == 0 || strings.ContainsAny(name, "/\\") {
+			return "", fmt.Errorf("invalid name %q", name)
+		}
+		return kind + "/" + name + ".json", nil
+	case "files":
+		return "files/" + name, nil
+	}
+	return "", fmt.Errorf("unknown kind %q", kind)
+}
+
+// filesInfo returns properties of files, unknown properties are kept as they are.
+func (this *local) filesInfo() ([]map[string]interface{}, error) {
+	var out []map[string]interface{}
+	if err := this.readJSON("files.json", &out); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	return out, nil
+}
+
+// groupsInfo returns settings of groups, unknown settings are kept as they are.
+func (this *local) groupsInfo() ([]map[string]interface{}, error) {
+	var out []map[string]interface{}
+	if err := this.readJSON("groups.json", &out); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	return out, nil
+}
+
+// setGroup sets the slug field of the group name in groups.json, the group is
+// removed from there if remove is true.
+func (this *local) setGroup(name, slug string, remove bool) error {
+	info, err := this.groupsInfo()
+	if err != nil {
+		return err
+	}
+	out := make([]map[string]interface{}, 0, len(info)+1)
+	for _, v := range info {
+		if v["Name"] != name {
+			out = append(out, v)
+		} else if !remove {
+			v["Slug"] = slug
+			out = append(out, v)
+			remove = true
+		}
+	}
+	if !remove {
+		out = append(out, map[string]interface{}{"Name": name, "Slug": slug})
+	}
+	sort.Sort(infoByName(out))
+	return this.writeJSON("groups.json", out)
+}
+
+type infoByName []map[string]interface{}
+
+func (this infoByName) Len() int { return len(this) }
+func (this infoByName) Less(i, j int) bool {
+	a, _ := this[i]["Name"].(string)
+	b, _ := this[j]["Name"].(string)
+	return a < b
+}
+func (this infoByName) Swap(i, j int) { this[i], this[j] = this[j], this[i] }
+
+func (this *local) list(kind string) ([]string, error) {
+	var out []string
+	if kind == "files" {
+		info, err := this.filesInfo()
+		if err != nil {
+			return nil, err
+		}
+		for _, v := range info {
+			if n, ok := v["Name"].(string); ok {
+				out = append(out, n)
+			}
+		}
+		return out, nil
+	}
+	if _, err := entry(kind, "-"); err != nil {
+		return nil, err
+	}
+	fi, err := ioutil.ReadDir(filepath.Join(this.dir, kind))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	for _, v := range fi {
+		if n := v.Name(); !v.IsDir() && strings.HasSuffix(n, ".json") {
+			out = append(out, n[:len(n)-len(".json")])
+		}
+	}
+	return out, nil
+}
+
+func (this *local) get(kind, name string) ([]byte, error) {
+	n, err := entry(kind, name)
+	if err != nil {
+		return nil, err
+	}
+	return this.read(n)
+}
+
+func (this *local) put(kind, name string, d []byte) error {
+	n, err := entry(kind, name)
+	if err != nil {
+		return err
+	}
+	switch kind {
+	case "pages":
+		var p map[string]interface{}
+		if err := json.Unmarshal(d, &p); err != nil {
+			return fmt.Errorf("invalid page: %v", err)
+		}
+		if name != strings.ToLower(name) {
+			return fmt.Errorf("invalid name of page %q", name)
+		}
+		p["Name"] = name
+		return this.writeJSON(n, p)
+	case "groups":
+		var g struct{ Slug string }
+		if err := json.Unmarshal(d, &g); err != nil {
+			return fmt.Errorf("invalid group: %v", err)
+		}
+		if err := this.setGroup(name, g.Slug, false); err != nil {
+			return err
+		}
+		if _, err := this.read(n); err == nil {
+			return nil
+		}
+		return this.writeJSON(n, []record{})
+	}
+	if _, err := this.path(n); err != nil {
+		return err
+	}
+	info, err := this.filesInfo()
+	if err != nil {
+		return err
+	}
+	var f map[string]interface{}
+	for _, v := range info {
+		if v["Name"] == name {
+			f = v
+		}
+	}
+	if f == nil {
+		f = map[string]interface{}{"Name": name}
+		info = append(info, f)
+	}
+	h := sha1.New()
+	h.Write(d)
+	f["Hash"] = fmt.Sprintf("%x", h.Sum(nil))
+	f["Size"] = len(d)
+	f["Uploaded"] = time.Now().UTC()
+	if err := this.write(n, d); err != nil {
+		return err
+	}
+	sort.Sort(infoByName(info))
+	return this.writeJSON("files.json", info)
+}
+
+func (this *local) remove(kind, name string) error {
+	n, err := entry(kind, name)
+	if err != nil {
+		return err
+	}
+	p, err := this.path(n)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(p); err != nil {
+		return err
+	}
+	if kind == "groups" {
+		return this.setGroup(name, "", true)
+	}
+	if kind != "files" {
+		return nil
+	}
+	info, err := this.filesInfo()
+	if err != nil {
+		return err
+	}
+	out := make([]map[string]interface{}, 0, len(info))
+	for _, v := range info {
+		if v["Name"] != name {
+			out = append(out, v)
+		}
+	}
+	return this.writeJSON("files.json", out)
+}
+
+func (this *local) records(group string) ([]record, error) {
+	n, err := entry("groups", group)
+	if err != nil {
+		return nil, err
+	}
+	var out []record
+	if err := this.readJSON(n, &out); err != nil {
+		return nil, err
+	}
+	return out, compactKeys(out)
+}
+
+// compactKeys removes spaces from keys of records as they are in exports,
+// keys are indented in pretty printed files.
+func compactKeys(recs []record) error {
+	for i := range recs {
+		k, err := normalKey(string(recs[i].Key))
+		if err != nil {
+			return err
+		}
+		recs[i].Key = json.RawMessage(k)
+		if err := compactKeys(recs[i].Children); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// normalKey returns a key path in the form it is exported.
+func normalKey(k string) (string, error) {
+	var p interface{}
+	if err := json.Unmarshal([]byte(k), &p); err != nil {
+		return "", fmt.Errorf("invalid key %q: %v", k, err)
+	}
+	if _, ok := p.([]interface{}); !ok {
+		return "", fmt.Errorf("invalid key %q", k)
+	}
+	d, err := json.Marshal(p)
+	return string(d), err
+}
+
+// find returns the record with the key k and the slice containing it.
+func find(recs *[]record, k string) (*record, *[]record) {
+	for i := range *recs {
+		v := &(*recs)[i]
+		if string(v.Key) == k {
+			return v, recs
+		}
+		if r, s := find(&v.Children, k); r != nil {
+			return r, s
+		}
+	}
+	return nil, nil
+}
+
+// maxID returns the largest integer ID of records.
+func maxID(recs []record) int64 {
+	var out int64
+	for _, v := range recs {
+		var p [][]interface{}
+		if json.Unmarshal(v.Key, &p) == nil && len(p) != 0 && len(p[len(p)-1]) == 2 {
+			if id, ok := p[len(p)-1][1].(float64); ok && int64(id) > out {
+				out = int64(id)
+			}
+		}
+		if id := maxID(v.Children); id > out {
+			out = id
+		}
+	}
+	return out
+}
+
+type recordsByKey []record
+
+func (this recordsByKey) Len() int           { return len(this) }
+func (this recordsByKey) Less(i, j int) bool { return string(this[i].Key) < string(this[j].Key) }
+func (this recordsByKey) Swap(i, j int)      { this[i], this[j] = this[j], this[i] }
+
+func sortRecords(recs []record) {
+	sort.Sort(recordsByKey(recs))
+	for _, v := range recs {
+		sortRecords(v.Children)
+	}
+}
+
+func (this *local) getRecord(group, key string) ([]byte, error) {
+	recs, err := this.records(group)
+	if err != nil {
+		return nil, err
+	}
+	k, err := normalKey(key)
+	if err != nil {
+		return nil, err
+	}
+	r, _ := find(&recs, k)
+	if r == nil {
+		return nil, fmt.Errorf("record %v is not found", key)
+	}
+	out := *r
+	out.Children = nil
+	d, err := json.MarshalIndent(&out, "", "\t")
+	return append(d, '\n'), err
+}
+
+func (this *local) putRecord(group, key, parent string, d []byte) (string, error) {
+	recs, err := this.records(group)
+	if err != nil {
+		return "", err
+	}
+	var in record
+	if err := json.Unmarshal(d, &in); err != nil {
+		return "", fmt.Errorf("invalid record: %v", err)
+	}
+	if len(key) != 0 {
+		k, err := normalKey(key)
+		if err != nil {
+			return "", err
+		}
+		r, _ := find(&recs, k)
+		if r == nil {
+			return "", fmt.Errorf("record %v is not found", key)
+		}
+		r.Data = in.Data
+		key = k
+	} else {
+		var p [][]interface{}
+		siblings := &recs
+		if len(parent) != 0 {
+			k, err := normalKey(parent)
+			if err != nil {
+				return "", err
+			}
+			r, _ := find(&recs, k)
+			if r == nil {
+				return "", fmt.Errorf("record %v is not found", parent)
+			}
+			json.Unmarshal(r.Key, &p)
+			siblings = &r.Children
+		}
+		k, err := json.Marshal(append(p, []interface{}{group, maxID(recs) + 1}))
+		if err != nil {
+			return "", err
+		}
+		*siblings = append(*siblings, record{Key: k, Data: in.Data})
+		key = string(k)
+	}
+	sortRecords(recs)
+	n, _ := entry("groups", group)
+	return key, this.writeJSON(n, recs)
+}
+
+func (this *local) removeRecord(group, key string) error {
+	recs, err := this.records(group)
+	if err != nil {
+		return err
+	}
+	k, err := normalKey(key)
+	if err != nil {
+		return err
+	}
+	r, s := find(&recs, k)
+	if r == nil {
+		return fmt.Errorf("record %v is not found", key)
+	}
+	for i := range *s {
+		if &(*s)[i] == r {
+			*s = append((*s)[:i], (*s)[i+1:]...)
+			break
+		}
+	}
+	n, _ := entry("groups", group)
+	return this.writeJSON(n, recs)
+}
+
+func (this *local) setDefault(page string) error {
+	n, err := entry("pages", page)
+	if err != nil {
+		return err
+	}
+	if _, err := this.read(n); err != nil {
+		return err
+	}
+	m := map[string]interface{}{"Format": 2}
+	if err := this.readJSON("manifest.json", &m); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	m["Config"] = map[string]interface{}{"Default": [][]interface{}{{"$Pages", page}}}
+	return this.writeJSON("manifest.json", m)
+}
+
+// walk calls fn for every file of the tree with its name in the tree and its
+// path. Hidden files and folders like ".git" are not a part of the tree.
+func (this *local) walk(fn func(n string, p string, fi os.FileInfo) error) error {
+	return filepath.Walk(this.dir, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if strings.HasPrefix(fi.Name(), ".") && p != this.dir {
+			if fi.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if fi.IsDir() {
+			return nil
+		}
+		n, err := filepath.Rel(this.dir, p)
+		if err != nil {
+			return err
+		}
+		return fn(filepath.ToSlash(n), p, fi)
+	})
+}
+
+// export packs the tree to an archive which is imported by the server as all.zip.
+func (this *local) export(section string, w io.Writer) error {
+	if section != "tree" {
+		return fmt.Errorf("a folder is exported only as a tree")
+	}
+	z := zip.NewWriter(w)
+	err := this.walk(func(n string, p string, fi os.FileInfo) error {
+		fh, err := zip.FileInfoHeader(fi)
+		if err != nil {
+			return err
+		}
+		fh.Name = n
+		fh.Method = zip.Deflate
+		zw, err := z.CreateHeader(fh)
+		if err != nil {
+			return err
+		}
+		f, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(zw, f)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return z.Close()
+}
+
+// importArchive unpacks an archive of a tree to the folder. Existing entries
+// are overwritten, in the replace mode all others are removed.
+func (this *local) importArchive(d []byte) ([]byte, error) {
+	if *section != "all" {
+		return nil, fmt.Errorf("only entire trees are imported to a folder")
+	}
+	if *mode != "merge" && *mode != "replace" {
+		return nil, fmt.Errorf("mode %q is not supported for a folder", *mode)
+	}
+	z, err := zip.NewReader(bytes.NewReader(d), int64(len(d)))
+	if err != nil {
+		return nil, err
+	}
+	out := bytes.NewBuffer(nil)
+	known := make(map[string]bool)
+	for _, v := range z.File {
+		if strings.HasSuffix(v.Name, "/") {
+			continue
+		}
+		if strings.HasSuffix(v.Name, ".zip") {
+			return nil, fmt.Errorf("%v: only trees are imported to a folder", v.Name)
+		}
+		if _, err := this.path(v.Name); err != nil {
+			return nil, err
+		}
+		known[v.Name] = true
+		rc, err := v.Open()
+		if err != nil {
+			return nil, err
+		}
+		nd, err := ioutil.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			return nil, err
+		}
+		od, err := this.read(v.Name)
+		switch {
+		case err != nil:
+			fmt.Fprintf(out, "add %v\n", v.Name)
+		case !bytes.Equal(od, nd):
+			fmt.Fprintf(out, "change %v\n", v.Name)
+		default:
+			continue
+		}
+		if !*dry {
+			if err := this.write(v.Name, nd); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if *mode != "replace" {
+		return out.Bytes(), nil
+	}
+	var removed []string
+	err = this.walk(func(n string, p string, fi os.FileInfo) error {
+		if !known[n] {
+			removed = append(removed, p)
+			fmt.Fprintf(out, "delete %v\n", n)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !*dry {
+		for _, v := range removed {
+			if err := os.Remove(v); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return out.Bytes(), nil
+}
+
+// funcs are stubs of functions available in templates of the server,
+// they are needed only to parse templates.
+var funcs = htpl.FuncMap{
+	"Type":        func(...interface{}) interface{} { return nil },
+	"EqualString": func(...interface{}) interface{} { return nil },
+	"FormatTime":  func(...interface{}) interface{} { return nil },
+	"FormatSize":  func(...interface{}) interface{} { return nil },
+	"ImageURL":    func(...interface{}) interface{} { return nil },
+}
+
+// validate parses templates of pages as the server does: the template of a
+// page is executed in its base template and the result is parsed.
+func (this *local) validate() ([]templateError, error) {
+	pages, err := this.list("pages")
+	if err != nil {
+		return nil, err
+	}
+	var out []templateError
+	for _, n := range pages {
+		if err := this.validatePage(n); err != nil {
+			out = append(out, templateError{n, err.Error()})
+		}
+	}
+	return out, nil
+}
+
+func (this *local) validatePage(n string) error {
+	var p struct {
+		Base     string
+		Template string
+	}
+	if err := this.readJSON("pages/"+n+".json", &p); err != nil {
+		return err
+	}
+	base, err := this.read("files/" + p.Base)
+	if err != nil {
+		return err
+	}
+	tpl, err := this.read("files/" + p.Template)
+	if err != nil {
+		return err
+	}
+	b := bytes.NewBuffer(nil)
+	if t, err := ttpl.New(p.Base).Parse(string(base)); err != nil {
+		return err
+	} else if err := t.Execute(b, string(tpl)); err != nil {
+		return err
+	}
+	_, err = htpl.New(n).Funcs(funcs).Parse(b.String())
+	return err
+}
+
+func (this *local) publish() error {
+	return fmt.Errorf("a folder has no drafts to publish")
+}
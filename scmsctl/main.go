@@ -0,0 +1,284 @@
+// Copyright (c) 2012 Alexander Sychev. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build !appengine
+
+// Scmsctl manages a site either through the API of a running server or in a
+// local folder with a tree of the site as it is exported to tree.zip.
+//
+// Usage:
+//
+//	scmsctl -server https://app.example.com -token TOKEN command [arguments]
+//	scmsctl -dir site command [arguments]
+//
+// The token is generated in the editor, it also may be set by SCMS_TOKEN.
+//
+// Commands:
+//
+//	list pages|files|groups
+//	list records GROUP
+//	get page|file|group NAME
+//	get record GROUP KEY
+//	put page NAME [FILE]
+//	put file NAME [FILE]
+//	put group NAME [SLUG]
+//	put record GROUP [KEY] [FILE]
+//	delete page|file|group NAME
+//	delete record GROUP KEY
+//	export all|tree FILE
+//	import FILE|FOLDER
+//	validate
+//	default PAGE
+//	publish
+//
+// KEY is a key path like [["Posts",42]]. Data is read from the standard input
+// if FILE is omitted or "-". Pages and records are JSON as in exports.
+// A folder is packed to a zip archive to be imported, e.g. a folder of
+// Markdown files with -section markdown/GROUP. An export of WordPress is
+// imported with -section wxr either alone or in a zip archive with the
+// uploaded files.
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+var (
+	server  = flag.String("server", "", "URL of a running site")
+	token   = flag.String("token", os.Getenv("SCMS_TOKEN"), "token of the API of the site")
+	dir     = flag.String("dir", "", "folder with a tree of a site")
+	mode    = flag.String("mode", "merge", "mode of import: merge, field, replace or append")
+	field   = flag.String("field", "", "field to match records for import in the field mode")
+	section = flag.String("section", "all", "section of import: all, files, pages, groups, wxr or markdown/GROUP")
+	dry     = flag.Bool("dry", false, "only list changes of import")
+	parent  = flag.String("parent", "", "key path of the parent of a new record")
+)
+
+// store is a site on a server or in a folder.
+type store interface {
+	list(kind string) ([]string, error)
+	get(kind, name string) ([]byte, error)
+	put(kind, name string, d []byte) error
+	remove(kind, name string) error
+	records(group string) ([]record, error)
+	getRecord(group, key string) ([]byte, error)
+	putRecord(group, key, parent string, d []byte) (string, error)
+	removeRecord(group, key string) error
+	setDefault(page string) error
+	export(section string, w io.Writer) error
+	importArchive(d []byte) ([]byte, error)
+	validate() ([]templateError, error)
+	publish() error
+}
+
+// record is a record of a group as in exports.
+type record struct {
+	Key      json.RawMessage        `json:"$Key,omitempty"`
+	Data     map[string]interface{} `json:"$Data,omitempty"`
+	Children []record               `json:"$Children,omitempty"`
+}
+
+type templateError struct {
+	Page  string
+	Error string
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: scmsctl [-server URL -token TOKEN | -dir FOLDER] command [arguments]\n")
+	flag.PrintDefaults()
+	os.Exit(2)
+}
+
+func fatal(err error) {
+	fmt.Fprintf(os.Stderr, "scmsctl: %v\n", err)
+	os.Exit(1)
+}
+
+// input returns the content of the file named by the argument i of args,
+// the standard input is read if there is no such argument or it is "-".
+func input(args []string, i int) ([]byte, error) {
+	if len(args) <= i || args[i] == "-" {
+		return ioutil.ReadAll(os.Stdin)
+	}
+	return ioutil.ReadFile(args[i])
+}
+
+func printRecords(recs []record, indent string) {
+	for _, v := range recs {
+		d, _ := json.Marshal(v.Data)
+		fmt.Printf("%s%s %s\n", indent, v.Key, d)
+		printRecords(v.Children, indent+"\t")
+	}
+}
+
+// kinds maps names of kinds in arguments to names used by stores.
+var kinds = map[string]string{
+	"page":   "pages",
+	"pages":  "pages",
+	"file":   "files",
+	"files":  "files",
+	"group":  "groups",
+	"groups": "groups",
+}
+
+func run(s store, args []string) error {
+	arg := func(i int) string {
+		if len(args) <= i {
+			usage()
+		}
+		return args[i]
+	}
+	kind := func(i int) string {
+		k, ok := kinds[arg(i)]
+		if !ok {
+			usage()
+		}
+		return k
+	}
+	switch arg(0) {
+	case "list":
+		if arg(1) == "records" {
+			recs, err := s.records(arg(2))
+			if err != nil {
+				return err
+			}
+			printRecords(recs, "")
+			return nil
+		}
+		n, err := s.list(kind(1))
+		if err != nil {
+			return err
+		}
+		for _, v := range n {
+			fmt.Println(v)
+		}
+	case "get":
+		var d []byte
+		var err error
+		if arg(1) == "record" {
+			d, err = s.getRecord(arg(2), arg(3))
+		} else {
+			d, err = s.get(kind(1), arg(2))
+		}
+		if err != nil {
+			return err
+		}
+		os.Stdout.Write(d)
+	case "put":
+		switch arg(1) {
+		case "group":
+			var slug string
+			if len(args) > 3 {
+				slug = args[3]
+			}
+			d, err := json.Marshal(map[string]string{"Slug": slug})
+			if err != nil {
+				return err
+			}
+			return s.put("groups", arg(2), d)
+		case "record":
+			key, i := "", 3
+			if len(args) > 3 && strings.HasPrefix(args[3], "[") {
+				key, i = args[3], 4
+			}
+			d, err := input(args, i)
+			if err != nil {
+				return err
+			}
+			k, err := s.putRecord(arg(2), key, *parent, d)
+			if err != nil {
+				return err
+			}
+			fmt.Println(k)
+			return nil
+		}
+		d, err := input(args, 3)
+		if err != nil {
+			return err
+		}
+		return s.put(kind(1), arg(2), d)
+	case "delete":
+		if arg(1) == "record" {
+			return s.removeRecord(arg(2), arg(3))
+		}
+		return s.remove(kind(1), arg(2))
+	case "export":
+		f, err := os.Create(arg(2))
+		if err != nil {
+			return err
+		}
+		if err := s.export(arg(1), f); err != nil {
+			f.Close()
+			os.Remove(arg(2))
+			return err
+		}
+		return f.Close()
+	case "import":
+		var d []byte
+		if fi, err := os.Stat(arg(1)); err != nil {
+			return err
+		} else if fi.IsDir() {
+			b := bytes.NewBuffer(nil)
+			if err := (&local{arg(1)}).export("tree", b); err != nil {
+				return err
+			}
+			d = b.Bytes()
+		} else if d, err = ioutil.ReadFile(arg(1)); err != nil {
+			return err
+		}
+		out, err := s.importArchive(d)
+		if err != nil {
+			return err
+		}
+		os.Stdout.Write(out)
+	case "validate":
+		errs, err := s.validate()
+		if err != nil {
+			return err
+		}
+		for _, v := range errs {
+			fmt.Printf("%s: %s\n", v.Page, v.Error)
+		}
+		if len(errs) != 0 {
+			return fmt.Errorf("%v pages have invalid templates", len(errs))
+		}
+	case "default":
+		return s.setDefault(arg(1))
+	case "publish":
+		return s.publish()
+	default:
+		usage()
+	}
+	return nil
+}
+
+func main() {
+	flag.Usage = usage
+	flag.Parse()
+	var s store
+	switch {
+	case len(*server) != 0 && len(*dir) == 0:
+		if len(*token) == 0 {
+			fatal(fmt.Errorf("token is not set"))
+		}
+		s = &remote{strings.TrimRight(*server, "/"), *token}
+	case len(*dir) != 0 && len(*server) == 0:
+		s = &local{*dir}
+	default:
+		usage()
+	}
+	if flag.NArg() == 0 {
+		usage()
+	}
+	if err := run(s, flag.Args()); err != nil {
+		fatal(err)
+	}
+}
@@ -0,0 +1,165 @@
+// Copyright (c) 2012 Alexander Sychev. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build !appengine
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+)
+
+// remote is a site on a server, it is managed through the API.
+type remote struct {
+	server string
+	token  string
+}
+
+// do makes a request to the API and returns the response if it is successful.
+func (this *remote) do(method string, p string, q url.Values, body []byte, ct string) (*http.Response, error) {
+	u, err := url.Parse(this.server)
+	if err != nil {
+		return nil, err
+	}
+	u.Path += "/api/" + p
+	u.RawQuery = q.Encode()
+	var b io.Reader
+	if body != nil {
+		b = bytes.NewReader(body)
+	}
+	req, err := http.NewRequest(method, u.String(), b)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+this.token)
+	if len(ct) != 0 {
+		req.Header.Set("Content-Type", ct)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 == 2 {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+	var e struct {
+		Error string
+	}
+	d, _ := ioutil.ReadAll(resp.Body)
+	if json.Unmarshal(d, &e) != nil || len(e.Error) == 0 {
+		e.Error = resp.Status
+	}
+	return nil, fmt.Errorf("%v %v: %v", method, u.Path, e.Error)
+}
+
+// call makes a request to the API and returns the body of the response.
+func (this *remote) call(method string, p string, q url.Values, body []byte, ct string) ([]byte, error) {
+	resp, err := this.do(method, p, q, body, ct)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	return ioutil.ReadAll(resp.Body)
+}
+
+func (this *remote) list(kind string) ([]string, error) {
+	d, err := this.call("GET", kind, nil, nil, "")
+	if err != nil {
+		return nil, err
+	}
+	var out []string
+	return out, json.Unmarshal(d, &out)
+}
+
+func (this *remote) get(kind, name string) ([]byte, error) {
+	return this.call("GET", kind+"/"+name, nil, nil, "")
+}
+
+func (this *remote) put(kind, name string, d []byte) error {
+	ct := "application/json"
+	if kind == "files" {
+		ct = "application/octet-stream"
+	}
+	_, err := this.call("PUT", kind+"/"+name, nil, d, ct)
+	return err
+}
+
+func (this *remote) remove(kind, name string) error {
+	_, err := this.call("DELETE", kind+"/"+name, nil, nil, "")
+	return err
+}
+
+func (this *remote) records(group string) ([]record, error) {
+	d, err := this.call("GET", "groups/"+group, nil, nil, "")
+	if err != nil {
+		return nil, err
+	}
+	var out []record
+	return out, json.Unmarshal(d, &out)
+}
+
+func (this *remote) getRecord(group, key string) ([]byte, error) {
+	return this.call("GET", "records/"+group, url.Values{"key": {key}}, nil, "")
+}
+
+func (this *remote) putRecord(group, key, parent string, d []byte) (string, error) {
+	q := make(url.Values)
+	if len(key) != 0 {
+		q.Set("key", key)
+	}
+	if len(parent) != 0 {
+		q.Set("parent", parent)
+	}
+	k, err := this.call("PUT", "records/"+group, q, d, "application/json")
+	return string(k), err
+}
+
+func (this *remote) removeRecord(group, key string) error {
+	_, err := this.call("DELETE", "records/"+group, url.Values{"key": {key}}, nil, "")
+	return err
+}
+
+func (this *remote) setDefault(page string) error {
+	_, err := this.call("PUT", "default", nil, []byte(page), "text/plain")
+	return err
+}
+
+func (this *remote) export(section string, w io.Writer) error {
+	resp, err := this.do("GET", "export/"+section+".zip", nil, nil, "")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, err = io.Copy(w, resp.Body)
+	return err
+}
+
+func (this *remote) importArchive(d []byte) ([]byte, error) {
+	q := url.Values{"section": {*section}, "mode": {*mode}, "field": {*field}}
+	if *dry {
+		q.Set("dry", "1")
+	}
+	return this.call("POST", "import", q, d, "application/zip")
+}
+
+func (this *remote) validate() ([]templateError, error) {
+	d, err := this.call("POST", "validate", nil, nil, "")
+	if err != nil {
+		return nil, err
+	}
+	var out []templateError
+	return out, json.Unmarshal(d, &out)
+}
+
+func (this *remote) publish() error {
+	_, err := this.call("POST", "publish", nil, nil, "")
+	return err
+}